@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS "domains" (
+	"id" text PRIMARY KEY NOT NULL,
+	"name" varchar(255) NOT NULL,
+	"enabled" boolean DEFAULT true NOT NULL,
+	"catch_all" boolean DEFAULT false NOT NULL,
+	"max_message_size" integer DEFAULT 0 NOT NULL,
+	"reject_policy" varchar(20) DEFAULT 'reject' NOT NULL,
+	"created_at" timestamp DEFAULT now() NOT NULL,
+	"updated_at" timestamp DEFAULT now() NOT NULL,
+	CONSTRAINT "domains_name_unique" UNIQUE("name")
+);
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS "domains_name_idx" ON "domains" ("name");--> statement-breakpoint
+INSERT INTO "domains" ("id", "name") VALUES
+	(gen_random_uuid(), 'mail.localhost'),
+	(gen_random_uuid(), 'jotko.site')
+ON CONFLICT ("name") DO NOTHING;
@@ -0,0 +1,2 @@
+ALTER TABLE "mailboxes" ADD COLUMN "expires_at" timestamp;--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS "mailboxes_expires_at_idx" ON "mailboxes" ("expires_at");
@@ -0,0 +1,2 @@
+ALTER TABLE "emails" ADD COLUMN "spf_result" varchar(20);--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN "spf_domain" varchar(255);
@@ -0,0 +1 @@
+ALTER TABLE "email_metadata" ADD COLUMN "dkim_results" jsonb DEFAULT '[]'::jsonb NOT NULL;
@@ -0,0 +1,5 @@
+ALTER TABLE "domains" ADD COLUMN "dmarc_override" varchar(20) DEFAULT '' NOT NULL;--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN "dmarc_result" varchar(20);--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN "dmarc_disposition" varchar(20);--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN "folder" varchar(20) DEFAULT 'inbox' NOT NULL;--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS "emails_folder_idx" ON "emails" ("folder");
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS "dkim_keys" (
+	"id" text PRIMARY KEY NOT NULL,
+	"domain_id" text NOT NULL,
+	"selector" varchar(63) NOT NULL,
+	"algorithm" varchar(20) NOT NULL,
+	"private_key" text NOT NULL,
+	"public_key" text NOT NULL,
+	"status" varchar(20) DEFAULT 'pending' NOT NULL,
+	"activated_at" timestamp,
+	"retire_at" timestamp,
+	"created_at" timestamp DEFAULT now() NOT NULL,
+	"updated_at" timestamp DEFAULT now() NOT NULL,
+	CONSTRAINT "dkim_keys_domain_id_selector_unique" UNIQUE("domain_id","selector")
+);
+--> statement-breakpoint
+DO $$ BEGIN
+ ALTER TABLE "dkim_keys" ADD CONSTRAINT "dkim_keys_domain_id_domains_id_fk" FOREIGN KEY ("domain_id") REFERENCES "domains"("id") ON DELETE cascade ON UPDATE no action;
+EXCEPTION
+ WHEN duplicate_object THEN null;
+END $$;
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS "dkim_keys_domain_id_idx" ON "dkim_keys" ("domain_id");
@@ -0,0 +1,40 @@
+CREATE TABLE IF NOT EXISTS "outbound_queue" (
+	"id" text PRIMARY KEY NOT NULL,
+	"email_id" text NOT NULL,
+	"user_id" text NOT NULL,
+	"mailbox_id" text,
+	"sender" varchar(255) NOT NULL,
+	"domain" varchar(255) NOT NULL,
+	"recipients" jsonb NOT NULL,
+	"minio_path" text NOT NULL,
+	"status" varchar(20) DEFAULT 'queued' NOT NULL,
+	"attempts" integer DEFAULT 0 NOT NULL,
+	"last_error" text,
+	"next_attempt_at" timestamp DEFAULT now() NOT NULL,
+	"expires_at" timestamp NOT NULL,
+	"created_at" timestamp DEFAULT now() NOT NULL,
+	"updated_at" timestamp DEFAULT now() NOT NULL,
+	CONSTRAINT "outbound_queue_email_id_domain_unique" UNIQUE("email_id","domain")
+);
+--> statement-breakpoint
+CREATE TABLE IF NOT EXISTS "outbound_domains" (
+	"domain" varchar(255) PRIMARY KEY NOT NULL,
+	"failures" integer DEFAULT 0 NOT NULL,
+	"retry_at" timestamp NOT NULL,
+	"last_error" text,
+	"updated_at" timestamp DEFAULT now() NOT NULL
+);
+--> statement-breakpoint
+DO $$ BEGIN
+ ALTER TABLE "outbound_queue" ADD CONSTRAINT "outbound_queue_user_id_users_id_fk" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE cascade ON UPDATE no action;
+EXCEPTION
+ WHEN duplicate_object THEN null;
+END $$;
+--> statement-breakpoint
+DO $$ BEGIN
+ ALTER TABLE "outbound_queue" ADD CONSTRAINT "outbound_queue_mailbox_id_mailboxes_id_fk" FOREIGN KEY ("mailbox_id") REFERENCES "mailboxes"("id") ON DELETE set null ON UPDATE no action;
+EXCEPTION
+ WHEN duplicate_object THEN null;
+END $$;
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS "outbound_queue_due_idx" ON "outbound_queue" ("status","next_attempt_at");
@@ -0,0 +1,5 @@
+ALTER TABLE "queue_jobs" ADD COLUMN IF NOT EXISTS "locked_by" varchar(255);
+--> statement-breakpoint
+ALTER TABLE "queue_jobs" ADD COLUMN IF NOT EXISTS "locked_until" timestamp;
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS "queue_jobs_locked_until_idx" ON "queue_jobs" ("locked_until");
@@ -0,0 +1,5 @@
+ALTER TABLE "queue_jobs" ADD COLUMN IF NOT EXISTS "next_attempt_at" timestamp DEFAULT now() NOT NULL;
+--> statement-breakpoint
+ALTER TABLE "queue_jobs" ADD COLUMN IF NOT EXISTS "last_error" text;
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS "queue_jobs_next_attempt_at_idx" ON "queue_jobs" ("status","next_attempt_at");
@@ -0,0 +1,10 @@
+ALTER TABLE "mailboxes" ADD COLUMN IF NOT EXISTS "email_count" integer DEFAULT 0 NOT NULL;
+--> statement-breakpoint
+ALTER TABLE "mailboxes" ADD COLUMN IF NOT EXISTS "size_bytes" bigint DEFAULT 0 NOT NULL;
+--> statement-breakpoint
+UPDATE "mailboxes" SET "email_count" = "counts"."email_count", "size_bytes" = "counts"."size_bytes"
+FROM (
+  SELECT "mailbox_id", count(*) AS "email_count", coalesce(sum("size"), 0) AS "size_bytes"
+  FROM "emails" GROUP BY "mailbox_id"
+) AS "counts"
+WHERE "mailboxes"."id" = "counts"."mailbox_id";
@@ -0,0 +1,29 @@
+ALTER TABLE "emails" ADD COLUMN IF NOT EXISTS "reply_to" jsonb;
+--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN IF NOT EXISTS "in_reply_to" text;
+--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN IF NOT EXISTS "references" jsonb;
+--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN IF NOT EXISTS "sent_at" timestamp;
+--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN IF NOT EXISTS "list_id" text;
+--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN IF NOT EXISTS "list_help" text;
+--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN IF NOT EXISTS "list_unsubscribe" text;
+--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN IF NOT EXISTS "list_unsubscribe_post" text;
+--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN IF NOT EXISTS "list_subscribe" text;
+--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN IF NOT EXISTS "list_post" text;
+--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN IF NOT EXISTS "list_owner" text;
+--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN IF NOT EXISTS "list_archive" text;
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS "emails_in_reply_to_idx" ON "emails" ("in_reply_to");
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS "emails_list_id_idx" ON "emails" ("list_id");
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS "email_metadata_headers_idx" ON "email_metadata" USING gin ("headers" jsonb_path_ops);
@@ -0,0 +1 @@
+ALTER TABLE "emails" ADD COLUMN IF NOT EXISTS "sha256" varchar(64);
@@ -0,0 +1,12 @@
+ALTER TABLE "users" ADD COLUMN IF NOT EXISTS "plan" varchar(20) DEFAULT 'free' NOT NULL;
+--> statement-breakpoint
+ALTER TABLE "users" ADD COLUMN IF NOT EXISTS "quota_bytes" bigint;
+--> statement-breakpoint
+ALTER TABLE "users" ADD COLUMN IF NOT EXISTS "used_bytes" bigint DEFAULT 0 NOT NULL;
+--> statement-breakpoint
+UPDATE "users" SET "used_bytes" = "usage"."used_bytes"
+FROM (
+  SELECT "user_id", coalesce(sum("size_bytes"), 0) AS "used_bytes"
+  FROM "mailboxes" GROUP BY "user_id"
+) AS "usage"
+WHERE "users"."id" = "usage"."user_id";
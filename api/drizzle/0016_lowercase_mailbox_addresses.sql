@@ -0,0 +1 @@
+UPDATE "mailboxes" SET "address" = lower("address") WHERE "address" <> lower("address");
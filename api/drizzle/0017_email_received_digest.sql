@@ -0,0 +1,2 @@
+ALTER TABLE "emails" RENAME COLUMN "sha256" TO "received_sha256";--> statement-breakpoint
+ALTER TABLE "emails" ADD COLUMN IF NOT EXISTS "received_size" integer;
\ No newline at end of file
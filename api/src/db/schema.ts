@@ -1,27 +1,47 @@
-import { pgTable, text, timestamp, integer, boolean, jsonb, varchar, index } from 'drizzle-orm/pg-core';
+import { pgTable, text, timestamp, integer, bigint, boolean, jsonb, varchar, index, unique } from 'drizzle-orm/pg-core';
 import { relations } from 'drizzle-orm';
 
 export const users = pgTable('users', {
   id: text('id').primaryKey().$defaultFn(() => crypto.randomUUID()),
   email: varchar('email', { length: 255 }).notNull().unique(),
   passwordHash: text('password_hash').notNull(),
+  // Storage quota: quota_bytes overrides the plan's default (0 is unlimited);
+  // used_bytes is the sum of the user's mailbox sizes, kept by the worker
+  plan: varchar('plan', { length: 20 }).default('free').notNull(),
+  quotaBytes: bigint('quota_bytes', { mode: 'number' }),
+  usedBytes: bigint('used_bytes', { mode: 'number' }).default(0).notNull(),
   createdAt: timestamp('created_at').defaultNow().notNull(),
   updatedAt: timestamp('updated_at').defaultNow().notNull(),
 }, (table) => ({
   emailIdx: index('users_email_idx').on(table.email),
 }));
 
+export const appPasswords = pgTable('app_passwords', {
+  id: text('id').primaryKey().$defaultFn(() => crypto.randomUUID()),
+  userId: text('user_id').references(() => users.id, { onDelete: 'cascade' }).notNull(),
+  name: varchar('name', { length: 100 }).notNull(),
+  passwordHash: text('password_hash').notNull(),
+  lastUsedAt: timestamp('last_used_at'),
+  createdAt: timestamp('created_at').defaultNow().notNull(),
+}, (table) => ({
+  userIdIdx: index('app_passwords_user_id_idx').on(table.userId),
+}));
+
 export const mailboxes = pgTable('mailboxes', {
   id: text('id').primaryKey().$defaultFn(() => crypto.randomUUID()),
   userId: text('user_id').references(() => users.id, { onDelete: 'cascade' }).notNull(),
   address: varchar('address', { length: 255 }).notNull(),
   isAlias: boolean('is_alias').default(false).notNull(),
   isTemp: boolean('is_temp').default(false).notNull(),
+  expiresAt: timestamp('expires_at'),
+  emailCount: integer('email_count').default(0).notNull(),
+  sizeBytes: bigint('size_bytes', { mode: 'number' }).default(0).notNull(),
   createdAt: timestamp('created_at').defaultNow().notNull(),
   updatedAt: timestamp('updated_at').defaultNow().notNull(),
 }, (table) => ({
   addressIdx: index('mailboxes_address_idx').on(table.address),
   userIdIdx: index('mailboxes_user_id_idx').on(table.userId),
+  expiresAtIdx: index('mailboxes_expires_at_idx').on(table.expiresAt),
 }));
 
 export const emails = pgTable('emails', {
@@ -36,25 +56,64 @@ export const emails = pgTable('emails', {
   textBody: text('text_body'),
   htmlBody: text('html_body'),
   minioPath: text('minio_path').notNull(),
+  // Size of the stored copy; the received ones are of the message before
+  // this server's trace fields
   size: integer('size').notNull(),
+  receivedSize: integer('received_size'),
+  receivedSha256: varchar('received_sha256', { length: 64 }),
+  spfResult: varchar('spf_result', { length: 20 }),
+  spfDomain: varchar('spf_domain', { length: 255 }),
+  dmarcResult: varchar('dmarc_result', { length: 20 }),
+  dmarcDisposition: varchar('dmarc_disposition', { length: 20 }),
+  folder: varchar('folder', { length: 20 }).default('inbox').notNull(),
+  replyTo: jsonb('reply_to').$type<string[]>(),
+  inReplyTo: text('in_reply_to'),
+  references: jsonb('references').$type<string[]>(),
+  sentAt: timestamp('sent_at'),
+  listId: text('list_id'),
+  listHelp: text('list_help'),
+  listUnsubscribe: text('list_unsubscribe'),
+  listUnsubscribePost: text('list_unsubscribe_post'),
+  listSubscribe: text('list_subscribe'),
+  listPost: text('list_post'),
+  listOwner: text('list_owner'),
+  listArchive: text('list_archive'),
   receivedAt: timestamp('received_at').defaultNow().notNull(),
   createdAt: timestamp('created_at').defaultNow().notNull(),
 }, (table) => ({
   mailboxIdIdx: index('emails_mailbox_id_idx').on(table.mailboxId),
   messageIdIdx: index('emails_message_id_idx').on(table.messageId),
   receivedAtIdx: index('emails_received_at_idx').on(table.receivedAt),
+  folderIdx: index('emails_folder_idx').on(table.folder),
+  inReplyToIdx: index('emails_in_reply_to_idx').on(table.inReplyTo),
+  listIdIdx: index('emails_list_id_idx').on(table.listId),
 }));
 
 export const emailMetadata = pgTable('email_metadata', {
   id: text('id').primaryKey().$defaultFn(() => crypto.randomUUID()),
   emailId: text('email_id').references(() => emails.id, { onDelete: 'cascade' }).notNull().unique(),
-  headers: jsonb('headers').$type<Record<string, string>>().notNull(),
+  // Lowercased field name to its values in message order; raw is set when
+  // RFC 2047 decoding changed the value. GIN-indexed (jsonb_path_ops) by
+  // migration 0013 for containment queries.
+  headers: jsonb('headers').$type<Record<string, Array<{ value: string; raw?: string }>>>().notNull(),
   attachments: jsonb('attachments').$type<Array<{
     filename: string;
     contentType: string;
     size: number;
     minioPath: string;
+    sha256: string;
+    contentId?: string;
+    inline?: boolean;
   }>>(),
+  dkimResults: jsonb('dkim_results').$type<Array<{
+    domain: string;
+    selector: string;
+    identity?: string;
+    algorithm?: string;
+    result: 'none' | 'pass' | 'fail' | 'neutral' | 'policy' | 'temperror' | 'permerror';
+    reason?: string;
+    header_b?: string;
+  }>>().default([]).notNull(),
   createdAt: timestamp('created_at').defaultNow().notNull(),
 }, (table) => ({
   emailIdIdx: index('email_metadata_email_id_idx').on(table.emailId),
@@ -66,16 +125,90 @@ export const queueJobs = pgTable('queue_jobs', {
   payload: jsonb('payload').notNull(),
   status: varchar('status', { length: 20 }).default('pending').notNull(),
   attempts: integer('attempts').default(0).notNull(),
+  lockedBy: varchar('locked_by', { length: 255 }),
+  lockedUntil: timestamp('locked_until'),
+  nextAttemptAt: timestamp('next_attempt_at').defaultNow().notNull(),
+  lastError: text('last_error'),
   createdAt: timestamp('created_at').defaultNow().notNull(),
   processedAt: timestamp('processed_at'),
 }, (table) => ({
   statusIdx: index('queue_jobs_status_idx').on(table.status),
   typeIdx: index('queue_jobs_type_idx').on(table.type),
+  lockedUntilIdx: index('queue_jobs_locked_until_idx').on(table.lockedUntil),
+  nextAttemptAtIdx: index('queue_jobs_next_attempt_at_idx').on(table.status, table.nextAttemptAt),
 }));
 
+export const domains = pgTable('domains', {
+  id: text('id').primaryKey().$defaultFn(() => crypto.randomUUID()),
+  name: varchar('name', { length: 255 }).notNull().unique(),
+  enabled: boolean('enabled').default(true).notNull(),
+  catchAll: boolean('catch_all').default(false).notNull(),
+  maxMessageSize: integer('max_message_size').default(0).notNull(),
+  rejectPolicy: varchar('reject_policy', { length: 20 }).default('reject').notNull(),
+  dmarcOverride: varchar('dmarc_override', { length: 20 }).default('').notNull(),
+  createdAt: timestamp('created_at').defaultNow().notNull(),
+  updatedAt: timestamp('updated_at').defaultNow().notNull(),
+}, (table) => ({
+  nameIdx: index('domains_name_idx').on(table.name),
+}));
+
+export const dkimKeys = pgTable('dkim_keys', {
+  id: text('id').primaryKey().$defaultFn(() => crypto.randomUUID()),
+  domainId: text('domain_id').references(() => domains.id, { onDelete: 'cascade' }).notNull(),
+  selector: varchar('selector', { length: 63 }).notNull(),
+  algorithm: varchar('algorithm', { length: 20 }).notNull(),
+  privateKey: text('private_key').notNull(),
+  publicKey: text('public_key').notNull(),
+  status: varchar('status', { length: 20 }).default('pending').notNull(),
+  activatedAt: timestamp('activated_at'),
+  retireAt: timestamp('retire_at'),
+  createdAt: timestamp('created_at').defaultNow().notNull(),
+  updatedAt: timestamp('updated_at').defaultNow().notNull(),
+}, (table) => ({
+  domainSelectorUnique: unique('dkim_keys_domain_id_selector_unique').on(table.domainId, table.selector),
+  domainIdIdx: index('dkim_keys_domain_id_idx').on(table.domainId),
+}));
+
+export const outboundQueue = pgTable('outbound_queue', {
+  id: text('id').primaryKey().$defaultFn(() => crypto.randomUUID()),
+  emailId: text('email_id').notNull(),
+  userId: text('user_id').references(() => users.id, { onDelete: 'cascade' }).notNull(),
+  mailboxId: text('mailbox_id').references(() => mailboxes.id, { onDelete: 'set null' }),
+  sender: varchar('sender', { length: 255 }).notNull(),
+  domain: varchar('domain', { length: 255 }).notNull(),
+  recipients: jsonb('recipients').$type<string[]>().notNull(),
+  minioPath: text('minio_path').notNull(),
+  status: varchar('status', { length: 20 }).default('queued').notNull(),
+  attempts: integer('attempts').default(0).notNull(),
+  lastError: text('last_error'),
+  nextAttemptAt: timestamp('next_attempt_at').defaultNow().notNull(),
+  expiresAt: timestamp('expires_at').notNull(),
+  createdAt: timestamp('created_at').defaultNow().notNull(),
+  updatedAt: timestamp('updated_at').defaultNow().notNull(),
+}, (table) => ({
+  emailDomainUnique: unique('outbound_queue_email_id_domain_unique').on(table.emailId, table.domain),
+  dueIdx: index('outbound_queue_due_idx').on(table.status, table.nextAttemptAt),
+}));
+
+export const outboundDomains = pgTable('outbound_domains', {
+  domain: varchar('domain', { length: 255 }).primaryKey(),
+  failures: integer('failures').default(0).notNull(),
+  retryAt: timestamp('retry_at').notNull(),
+  lastError: text('last_error'),
+  updatedAt: timestamp('updated_at').defaultNow().notNull(),
+});
+
 // Relations
 export const usersRelations = relations(users, ({ many }) => ({
   mailboxes: many(mailboxes),
+  appPasswords: many(appPasswords),
+}));
+
+export const appPasswordsRelations = relations(appPasswords, ({ one }) => ({
+  user: one(users, {
+    fields: [appPasswords.userId],
+    references: [users.id],
+  }),
 }));
 
 export const mailboxesRelations = relations(mailboxes, ({ one, many }) => ({
@@ -86,6 +219,17 @@ export const mailboxesRelations = relations(mailboxes, ({ one, many }) => ({
   emails: many(emails),
 }));
 
+export const domainsRelations = relations(domains, ({ many }) => ({
+  dkimKeys: many(dkimKeys),
+}));
+
+export const dkimKeysRelations = relations(dkimKeys, ({ one }) => ({
+  domain: one(domains, {
+    fields: [dkimKeys.domainId],
+    references: [domains.id],
+  }),
+}));
+
 export const emailsRelations = relations(emails, ({ one }) => ({
   mailbox: one(mailboxes, {
     fields: [emails.mailboxId],
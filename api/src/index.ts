@@ -5,6 +5,7 @@ import { config } from '@shared/config';
 import authRoutes from './routes/auth';
 import mailboxRoutes from './routes/mailboxes';
 import emailRoutes from './routes/emails';
+import appPasswordRoutes from './routes/appPasswords';
 import { ensureBucket } from './services/minio';
 
 const app = new Hono();
@@ -22,6 +23,7 @@ app.get('/health', (c) => {
 app.route('/api/auth', authRoutes);
 app.route('/api/mailboxes', mailboxRoutes);
 app.route('/api/emails', emailRoutes);
+app.route('/api/app-passwords', appPasswordRoutes);
 
 // Initialize MinIO bucket
 ensureBucket().catch(console.error);
@@ -0,0 +1,72 @@
+import { and, eq } from 'drizzle-orm';
+import { Hono } from 'hono';
+import { z } from 'zod';
+import { db } from '../db';
+import { appPasswords } from '../db/schema';
+import { authMiddleware } from '../middleware/auth';
+import { generateAppPassword, hashPassword } from '../services/auth';
+
+const app = new Hono<{ Variables: { userId: string } }>();
+
+app.use('/*', authMiddleware);
+
+const createAppPasswordSchema = z.object({
+  name: z.string().min(1).max(100),
+});
+
+app.get('/', async (c) => {
+  const userId = c.get('userId');
+  const passwords = await db.select({
+    id: appPasswords.id,
+    name: appPasswords.name,
+    lastUsedAt: appPasswords.lastUsedAt,
+    createdAt: appPasswords.createdAt,
+  }).from(appPasswords).where(eq(appPasswords.userId, userId));
+  return c.json({ appPasswords: passwords });
+});
+
+// The generated password is only ever returned here; we keep just the hash
+app.post('/', async (c) => {
+  try {
+    const userId = c.get('userId');
+    const body = await c.req.json();
+    const { name } = createAppPasswordSchema.parse(body);
+
+    const password = generateAppPassword();
+    const [created] = await db.insert(appPasswords).values({
+      userId,
+      name,
+      passwordHash: await hashPassword(password.replace(/ /g, '')),
+    }).returning();
+
+    return c.json({
+      appPassword: {
+        id: created.id,
+        name: created.name,
+        createdAt: created.createdAt,
+      },
+      password,
+    });
+  } catch (error) {
+    if (error instanceof z.ZodError) {
+      return c.json({ error: error.errors }, 400);
+    }
+    return c.json({ error: 'src server error' }, 500);
+  }
+});
+
+app.delete('/:id', async (c) => {
+  const userId = c.get('userId');
+  const id = c.req.param('id');
+
+  const [deleted] = await db.delete(appPasswords)
+    .where(and(eq(appPasswords.id, id), eq(appPasswords.userId, userId)))
+    .returning({ id: appPasswords.id });
+
+  if (!deleted) {
+    return c.json({ error: 'App password not found' }, 404);
+  }
+  return c.json({ success: true });
+});
+
+export default app;
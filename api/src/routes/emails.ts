@@ -1,9 +1,9 @@
 import { Hono } from 'hono';
 import { db } from '../db';
-import { emails, mailboxes, emailMetadata } from '../db/schema';
-import { eq, and, desc } from 'drizzle-orm';
+import { emails, mailboxes, emailMetadata, users } from '../db/schema';
+import { eq, and, desc, sql } from 'drizzle-orm';
 import { authMiddleware } from '../middleware/auth';
-import { getEmail } from '../services/minio';
+import { getEmail, deleteEmail } from '../services/minio';
 
 const app = new Hono<{ Variables: { userId: string } }>();
 
@@ -14,6 +14,13 @@ app.get('/', async (c) => {
   const mailboxId = c.req.query('mailboxId');
   const limit = parseInt(c.req.query('limit') || '50');
   const offset = parseInt(c.req.query('offset') || '0');
+  // The inbox unless another folder is asked for; 'all' lists every folder,
+  // quarantined and sent copies included
+  const folder = c.req.query('folder') || 'inbox';
+  const conditions = [eq(mailboxes.userId, userId)];
+  if (folder !== 'all') {
+    conditions.push(eq(emails.folder, folder));
+  }
 
   const query = db.select({
     id: emails.id,
@@ -24,6 +31,7 @@ app.get('/', async (c) => {
     bcc: emails.bcc,
     subject: emails.subject,
     size: emails.size,
+    folder: emails.folder,
     receivedAt: emails.receivedAt,
     createdAt: emails.createdAt,
     mailboxId: emails.mailboxId,
@@ -31,7 +39,7 @@ app.get('/', async (c) => {
   })
     .from(emails)
     .innerJoin(mailboxes, eq(emails.mailboxId, mailboxes.id))
-    .where(eq(mailboxes.userId, userId))
+    .where(and(...conditions))
     .orderBy(desc(emails.receivedAt))
     .limit(limit)
     .offset(offset);
@@ -60,6 +68,22 @@ app.get('/:id', async (c) => {
     textBody: emails.textBody,
     htmlBody: emails.htmlBody,
     size: emails.size,
+    folder: emails.folder,
+    spfResult: emails.spfResult,
+    dmarcResult: emails.dmarcResult,
+    dmarcDisposition: emails.dmarcDisposition,
+    replyTo: emails.replyTo,
+    inReplyTo: emails.inReplyTo,
+    references: emails.references,
+    sentAt: emails.sentAt,
+    listId: emails.listId,
+    listHelp: emails.listHelp,
+    listUnsubscribe: emails.listUnsubscribe,
+    listUnsubscribePost: emails.listUnsubscribePost,
+    listSubscribe: emails.listSubscribe,
+    listPost: emails.listPost,
+    listOwner: emails.listOwner,
+    listArchive: emails.listArchive,
     receivedAt: emails.receivedAt,
     createdAt: emails.createdAt,
     minioPath: emails.minioPath,
@@ -110,6 +134,29 @@ app.get('/:id/raw', async (c) => {
   return c.body(Buffer.from(rawEmail));
 });
 
+app.get('/:id/attachments/:index', async (c) => {
+  const userId = c.get('userId');
+  const id = c.req.param('id');
+  const index = parseInt(c.req.param('index'));
+
+  const [row] = await db.select({ attachments: emailMetadata.attachments })
+    .from(emailMetadata)
+    .innerJoin(emails, eq(emailMetadata.emailId, emails.id))
+    .innerJoin(mailboxes, eq(emails.mailboxId, mailboxes.id))
+    .where(and(eq(emails.id, id), eq(mailboxes.userId, userId)))
+    .limit(1);
+
+  const attachment = row?.attachments?.[index];
+  if (!attachment) {
+    return c.json({ error: 'Attachment not found' }, 404);
+  }
+
+  const content = await getEmail(attachment.minioPath);
+  c.header('Content-Type', attachment.contentType);
+  c.header('Content-Disposition', `attachment; filename*=UTF-8''${encodeURIComponent(attachment.filename)}`);
+  return c.body(content);
+});
+
 app.delete('/:id', async (c) => {
   const userId = c.get('userId');
   const id = c.req.param('id');
@@ -117,9 +164,11 @@ app.delete('/:id', async (c) => {
   const [email] = await db.select({
     id: emails.id,
     minioPath: emails.minioPath,
+    attachments: emailMetadata.attachments,
   })
     .from(emails)
     .innerJoin(mailboxes, eq(emails.mailboxId, mailboxes.id))
+    .leftJoin(emailMetadata, eq(emailMetadata.emailId, emails.id))
     .where(and(eq(emails.id, id), eq(mailboxes.userId, userId)))
     .limit(1);
 
@@ -127,7 +176,41 @@ app.delete('/:id', async (c) => {
     return c.json({ error: 'Email not found' }, 404);
   }
 
-  await db.delete(emails).where(eq(emails.id, id));
+  // Keep the mailbox counters the worker maintains in step
+  await db.transaction(async (tx) => {
+    const [deleted] = await tx.delete(emails)
+      .where(eq(emails.id, id))
+      .returning({ mailboxId: emails.mailboxId, size: emails.size });
+    if (deleted) {
+      const [mailbox] = await tx.update(mailboxes)
+        .set({
+          emailCount: sql`${mailboxes.emailCount} - 1`,
+          sizeBytes: sql`${mailboxes.sizeBytes} - ${deleted.size}`,
+        })
+        .where(eq(mailboxes.id, deleted.mailboxId))
+        .returning({ userId: mailboxes.userId });
+      if (mailbox) {
+        await tx.update(users)
+          .set({ usedBytes: sql`${users.usedBytes} - ${deleted.size}` })
+          .where(eq(users.id, mailbox.userId));
+      }
+    }
+  });
+
+  // Copies stored before each recipient got its own object may share one,
+  // so the object and its attachments go with the last email using them
+  const [shared] = await db.select({ id: emails.id })
+    .from(emails)
+    .where(eq(emails.minioPath, email.minioPath))
+    .limit(1);
+  if (!shared) {
+    const paths = [email.minioPath, ...(email.attachments ?? []).map((a) => a.minioPath)];
+    try {
+      await Promise.all(paths.map((path) => deleteEmail(path)));
+    } catch (err) {
+      console.error('Failed to delete email objects:', err);
+    }
+  }
   return c.json({ success: true });
 });
 
@@ -1,17 +1,19 @@
 import { config } from '@shared/config';
-import { and, eq } from 'drizzle-orm';
+import { and, eq, sql } from 'drizzle-orm';
 import { Hono } from 'hono';
 import { z } from 'zod';
 import { db } from '../db';
-import { mailboxes } from '../db/schema';
+import { mailboxes, users } from '../db/schema';
 import { authMiddleware } from '../middleware/auth';
+import { redis } from '../services/redis';
  
 const app = new Hono<{ Variables: { userId: string } }>();
 
 app.use('/*', authMiddleware);
 
 const createMailboxSchema = z.object({
-  address: z.string().email(),
+  // SMTP matches recipients case-insensitively by storing addresses lowercased
+  address: z.string().email().transform((address) => address.toLowerCase()),
   isAlias: z.boolean().optional().default(false),
 });
 
@@ -29,7 +31,7 @@ app.post('/', async (c) => {
 
     // Validate domain
     const domain = address.split('@')[1];
-    if (domain !== config.smtp.domain) {
+    if (domain !== config.smtp.domain.toLowerCase()) {
       return c.json({ error: 'Invalid domain' }, 400);
     }
 
@@ -46,6 +48,14 @@ app.post('/', async (c) => {
       isTemp: false,
     }).returning();
 
+    // Let SMTP accept mail for it straight away rather than after its next
+    // recipient filter rebuild; that rebuild picks it up if this is lost
+    try {
+      await redis.publish('mailbox:created', mailbox.address);
+    } catch (error) {
+      console.error('Failed to publish mailbox creation:', error);
+    }
+
     return c.json({ mailbox });
   } catch (error) {
     if (error instanceof z.ZodError) {
@@ -67,7 +77,17 @@ app.delete('/:id', async (c) => {
     return c.json({ error: 'Mailbox not found' }, 404);
   }
 
-  await db.delete(mailboxes).where(eq(mailboxes.id, id));
+  // Its emails go with it, and with them their share of the user's usage
+  await db.transaction(async (tx) => {
+    const [deleted] = await tx.delete(mailboxes)
+      .where(eq(mailboxes.id, id))
+      .returning({ sizeBytes: mailboxes.sizeBytes });
+    if (deleted) {
+      await tx.update(users)
+        .set({ usedBytes: sql`${users.usedBytes} - ${deleted.sizeBytes}` })
+        .where(eq(users.id, userId));
+    }
+  });
   return c.json({ success: true });
 });
 
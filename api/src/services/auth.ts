@@ -1,4 +1,5 @@
 import bcrypt from 'bcrypt';
+import { randomInt } from 'crypto';
 import { sign, verify } from 'hono/jwt';
 import { config } from '@shared/config';
 
@@ -10,6 +11,14 @@ export async function verifyPassword(password: string, hash: string): Promise<bo
   return bcrypt.compare(password, hash);
 }
 
+// App passwords are 16 lowercase letters, shown in groups of four. Spaces are
+// ignored when they are checked, so they can be pasted either way.
+export function generateAppPassword(): string {
+  const letters = 'abcdefghijklmnopqrstuvwxyz';
+  const chars = Array.from({ length: 16 }, () => letters[randomInt(letters.length)]);
+  return chars.join('').match(/.{4}/g)!.join(' ');
+}
+
 export async function generateToken(userId: string): Promise<string> {
   const payload = {
     userId,
@@ -0,0 +1,135 @@
+// Package jobs defines the payloads that the smtp service and the worker
+// exchange through the queue. Every payload carries the schema Version it
+// was written with, so a worker never guesses at a shape it doesn't know.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mymail/shared/queue"
+)
+
+// Job types.
+const (
+	TypeProcessEmail     = "process_email"
+	TypeSendEmail        = "send_email"
+	TypeCleanupTemp      = "cleanup_temp"
+	TypeRecalculateUsage = "recalculate_usage"
+)
+
+// Version is the payload schema version this build writes and reads. Bump
+// it when a change would make existing payloads decode wrongly, and keep
+// decoding the old version until queues have drained.
+const Version = 1
+
+// Meta is embedded in every payload.
+type Meta struct {
+	Version int `json:"version"`
+}
+
+func (m *Meta) meta() *Meta { return m }
+
+// Payload is a typed job payload.
+type Payload interface {
+	JobType() string
+	meta() *Meta
+}
+
+// VersionError is returned by Decode for a payload written with a schema
+// version this build doesn't know. Retrying can't help, so the worker
+// buries such jobs straight away.
+type VersionError struct {
+	Type    string
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("unsupported %s payload version %d (this build reads version %d)", e.Type, e.Version, Version)
+}
+
+// Enqueue stamps p with the current Version and queues it.
+func Enqueue(ctx context.Context, q queue.Queue, p Payload) error {
+	p.meta().Version = Version
+	return q.Enqueue(ctx, p.JobType(), p)
+}
+
+// Decode reads a job's payload into p, checking its version. Payloads
+// queued before versioning have no version field and the version 1 shape.
+func Decode(job *queue.Job, p Payload) error {
+	if job.Type != p.JobType() {
+		return fmt.Errorf("cannot decode %s job as %s", job.Type, p.JobType())
+	}
+	if err := json.Unmarshal(job.Payload, p); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", job.Type, err)
+	}
+
+	m := p.meta()
+	if m.Version == 0 {
+		m.Version = 1
+	}
+	if m.Version != Version {
+		return &VersionError{Type: job.Type, Version: m.Version}
+	}
+	return nil
+}
+
+// ProcessEmail files a stored message in a mailbox. There is one job per
+// recipient copy; the worker parses the bodies from the stored message.
+type ProcessEmail struct {
+	Meta
+	EmailID   string   `json:"email_id"`
+	MailboxID string   `json:"mailbox_id"`
+	MessageID string   `json:"message_id"`
+	From      string   `json:"from"`
+	To        []string `json:"to"`
+	Subject   string   `json:"subject"`
+	MinIOPath string   `json:"minio_path"`
+	Size      int64    `json:"size"`
+	Folder    string   `json:"folder"`
+	// Size is that of the stored copy, and ReceivedSize and ReceivedSHA256
+	// those of the message as received, before the trace fields each copy
+	// is stamped with
+	ReceivedSize   int64  `json:"received_size,omitempty"`
+	ReceivedSHA256 string `json:"received_sha256,omitempty"`
+
+	// Bcc lists the recipients of a sent copy that its header doesn't name
+	Bcc []string `json:"bcc,omitempty"`
+
+	// Authentication results, set for inbound mail only
+	SPFResult        string       `json:"spf_result,omitempty"`
+	SPFDomain        string       `json:"spf_domain,omitempty"`
+	DKIM             []DKIMResult `json:"dkim,omitempty"`
+	DMARCResult      string       `json:"dmarc_result,omitempty"`
+	DMARCDisposition string       `json:"dmarc_disposition,omitempty"`
+}
+
+func (*ProcessEmail) JobType() string { return TypeProcessEmail }
+
+// DKIMResult is the outcome of verifying one DKIM signature, as stored in
+// email_metadata.dkim_results.
+type DKIMResult struct {
+	Domain    string `json:"domain"`
+	Selector  string `json:"selector"`
+	Identity  string `json:"identity,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Result    string `json:"result"`
+	Reason    string `json:"reason,omitempty"`
+	HeaderB   string `json:"header_b,omitempty"`
+}
+
+// SendEmail delivers a submitted message to its remote recipients.
+type SendEmail struct {
+	Meta
+	EmailID    string   `json:"email_id"`
+	UserID     string   `json:"user_id"`
+	MailboxID  string   `json:"mailbox_id"`
+	MessageID  string   `json:"message_id"`
+	From       string   `json:"from"`
+	Recipients []string `json:"recipients"`
+	MinIOPath  string   `json:"minio_path"`
+	Size       int64    `json:"size"`
+}
+
+func (*SendEmail) JobType() string { return TypeSendEmail }
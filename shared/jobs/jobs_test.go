@@ -0,0 +1,153 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/mymail/shared/queue"
+)
+
+// recorder keeps what is enqueued as the queue backends store it, as a job
+// with a JSON payload.
+type recorder struct {
+	queue.Queue
+	jobs []*queue.Job
+}
+
+func (r *recorder) Enqueue(ctx context.Context, jobType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	r.jobs = append(r.jobs, &queue.Job{Type: jobType, Payload: data})
+	return nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		sent    Payload
+		decoded Payload
+	}{
+		{
+			// As the smtp service enqueues an inbound copy
+			sent: &ProcessEmail{
+				EmailID:   "6f1c2a4e-0b7d-4d8e-9a51-3c2f0e8b7a10",
+				MailboxID: "mbx-1",
+				MessageID: "<abc@example.com>",
+				From:      "alice@example.com",
+				To:        []string{"bob@example.net", "carol@example.net"},
+				Subject:   "Lunch",
+				MinIOPath: "user-1/2026/10/18/6f1c2a4e-0b7d-4d8e-9a51-3c2f0e8b7a10.eml",
+				Size:      2048,
+				Folder:    "inbox",
+
+				ReceivedSize:   1536,
+				ReceivedSHA256: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+
+				SPFResult: "pass",
+				SPFDomain: "example.com",
+				DKIM: []DKIMResult{{
+					Domain: "example.com", Selector: "sel", Algorithm: "ed25519-sha256",
+					Result: "pass", HeaderB: "dGVzdA==",
+				}},
+				DMARCResult:      "pass",
+				DMARCDisposition: "none",
+			},
+			decoded: &ProcessEmail{},
+		},
+		{
+			// As the smtp service enqueues a submission
+			sent: &SendEmail{
+				EmailID:    "0d9e8f7a-6b5c-4d3e-2f1a-0b9c8d7e6f5a",
+				UserID:     "user-1",
+				MailboxID:  "mbx-1",
+				MessageID:  "<def@example.com>",
+				From:       "alice@example.com",
+				Recipients: []string{"dave@example.org"},
+				MinIOPath:  "outbound/2026/10/18/0d9e8f7a-6b5c-4d3e-2f1a-0b9c8d7e6f5a.eml",
+				Size:       4096,
+			},
+			decoded: &SendEmail{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sent.JobType(), func(t *testing.T) {
+			var q recorder
+			if err := Enqueue(context.Background(), &q, tt.sent); err != nil {
+				t.Fatal(err)
+			}
+			if len(q.jobs) != 1 || q.jobs[0].Type != tt.sent.JobType() {
+				t.Fatalf("enqueued %+v", q.jobs)
+			}
+
+			if err := Decode(q.jobs[0], tt.decoded); err != nil {
+				t.Fatal(err)
+			}
+			if tt.decoded.meta().Version != Version {
+				t.Errorf("Version = %d, want %d", tt.decoded.meta().Version, Version)
+			}
+			if !reflect.DeepEqual(tt.decoded, tt.sent) {
+				t.Errorf("decoded %+v, want %+v", tt.decoded, tt.sent)
+			}
+		})
+	}
+}
+
+func TestDecodeUnknownVersion(t *testing.T) {
+	job := &queue.Job{Type: TypeSendEmail, Payload: []byte(`{"version":2,"email_id":"e1","shiny_new_field":true}`)}
+
+	err := Decode(job, &SendEmail{})
+	var versionErr *VersionError
+	if !errors.As(err, &versionErr) {
+		t.Fatalf("Decode() = %v, want a *VersionError", err)
+	}
+	if versionErr.Type != TypeSendEmail || versionErr.Version != 2 {
+		t.Errorf("VersionError = %+v", versionErr)
+	}
+}
+
+// Payloads queued before versioning have no version field.
+func TestDecodeLegacy(t *testing.T) {
+	job := &queue.Job{Type: TypeProcessEmail, Payload: []byte(`{
+		"email_id": "e1",
+		"mailbox_id": "mbx-1",
+		"message_id": "<abc@example.com>",
+		"from": "alice@example.com",
+		"to": ["bob@example.net"],
+		"subject": "Lunch",
+		"minio_path": "user-1/2024/01/02/e1.eml",
+		"size": 512,
+		"folder": "inbox"
+	}`)}
+
+	var p ProcessEmail
+	if err := Decode(job, &p); err != nil {
+		t.Fatal(err)
+	}
+	want := ProcessEmail{
+		Meta:      Meta{Version: 1},
+		EmailID:   "e1",
+		MailboxID: "mbx-1",
+		MessageID: "<abc@example.com>",
+		From:      "alice@example.com",
+		To:        []string{"bob@example.net"},
+		Subject:   "Lunch",
+		MinIOPath: "user-1/2024/01/02/e1.eml",
+		Size:      512,
+		Folder:    "inbox",
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("decoded %+v, want %+v", p, want)
+	}
+}
+
+func TestDecodeWrongType(t *testing.T) {
+	job := &queue.Job{Type: TypeProcessEmail, Payload: []byte(`{"version":1}`)}
+	if err := Decode(job, &SendEmail{}); err == nil {
+		t.Error("Decode() of a process_email job as send_email succeeded")
+	}
+}
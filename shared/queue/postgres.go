@@ -0,0 +1,288 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// JobsChannel is the NOTIFY channel on which new queue jobs are announced.
+const JobsChannel = "queue_jobs"
+
+// Postgres keeps jobs in the queue_jobs table. Claims are leases recorded in
+// locked_by and locked_until; finished jobs stay in the table with their
+// final status.
+type Postgres struct {
+	db  *sqlx.DB
+	url string
+}
+
+// NewPostgres returns a queue on db. url is used to open the dedicated
+// connection that Wake listens on.
+func NewPostgres(db *sqlx.DB, url string) *Postgres {
+	return &Postgres{db: db, url: url}
+}
+
+// jobColumns are the queue_jobs columns scanned into jobRow.
+const jobColumns = `id, type, payload, status, attempts, last_error, locked_by, created_at, processed_at`
+
+type jobRow struct {
+	ID          string     `db:"id"`
+	Type        string     `db:"type"`
+	Payload     string     `db:"payload"`
+	Status      string     `db:"status"`
+	Attempts    int        `db:"attempts"`
+	LastError   *string    `db:"last_error"`
+	LockedBy    *string    `db:"locked_by"`
+	CreatedAt   time.Time  `db:"created_at"`
+	ProcessedAt *time.Time `db:"processed_at"`
+}
+
+func (r *jobRow) job() *Job {
+	job := &Job{
+		ID:        r.ID,
+		Type:      r.Type,
+		Payload:   []byte(r.Payload),
+		Status:    r.Status,
+		Attempts:  r.Attempts,
+		CreatedAt: r.CreatedAt,
+	}
+	if r.LastError != nil {
+		job.LastError = *r.LastError
+	}
+	if r.LockedBy != nil {
+		job.consumer = *r.LockedBy
+	}
+	if r.Status == "dead" {
+		job.FailedAt = r.ProcessedAt
+	}
+	return job
+}
+
+func (p *Postgres) Enqueue(ctx context.Context, jobType string, payload interface{}) error {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	// Wake idle workers straight away rather than at their next poll. The
+	// notification is only delivered once the insert commits.
+	query := `WITH job AS (
+	            INSERT INTO queue_jobs (id, type, payload, status, attempts, created_at)
+	            VALUES (gen_random_uuid(), $1, $2::jsonb, 'pending', 0, NOW())
+	            RETURNING type
+	          )
+	          SELECT pg_notify('` + JobsChannel + `', type) FROM job`
+
+	_, err = p.db.ExecContext(ctx, query, jobType, payloadJSON)
+	return err
+}
+
+func (p *Postgres) EnqueueUnique(ctx context.Context, jobType string) error {
+	query := `INSERT INTO queue_jobs (id, type, payload, status, attempts, created_at)
+	          SELECT gen_random_uuid(), $1, '{}'::jsonb, 'pending', 0, NOW()
+	          WHERE NOT EXISTS (SELECT 1 FROM queue_jobs WHERE type = $1 AND status = 'pending')`
+
+	_, err := p.db.ExecContext(ctx, query, jobType)
+	return err
+}
+
+// Claim marks up to limit of the oldest due pending jobs as processing.
+// Rows locked by a concurrent claim are skipped rather than waited on, so
+// each job goes to exactly one consumer however many replicas are polling.
+func (p *Postgres) Claim(ctx context.Context, consumer string, limit int, lease time.Duration, types []string) ([]*Job, error) {
+	if len(types) == 0 {
+		return nil, nil
+	}
+
+	var rows []jobRow
+	query := `UPDATE queue_jobs
+	          SET status = 'processing', locked_by = $2, locked_until = NOW() + make_interval(secs => $3)
+	          WHERE id IN (
+	            SELECT id FROM queue_jobs
+	            WHERE status = 'pending' AND next_attempt_at <= NOW() AND type = ANY($4)
+	            ORDER BY created_at ASC
+	            LIMIT $1
+	            FOR UPDATE SKIP LOCKED
+	          )
+	          RETURNING ` + jobColumns
+
+	err := p.db.SelectContext(ctx, &rows, query, limit, consumer, lease.Seconds(), pq.Array(types))
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, 0, len(rows))
+	for i := range rows {
+		jobs = append(jobs, rows[i].job())
+	}
+	return jobs, nil
+}
+
+// Extend renews every lease consumer holds; jobs is not needed here.
+func (p *Postgres) Extend(ctx context.Context, consumer string, jobs []*Job, lease time.Duration) error {
+	query := `UPDATE queue_jobs SET locked_until = NOW() + make_interval(secs => $2)
+	          WHERE locked_by = $1 AND status = 'processing'`
+	_, err := p.db.ExecContext(ctx, query, consumer, lease.Seconds())
+	return err
+}
+
+// Ack marks a job completed. If the lease was lost to the reaper the job
+// belongs to someone else now and is left alone, as in Nack and Bury.
+func (p *Postgres) Ack(ctx context.Context, job *Job) error {
+	return ack(ctx, p.db, job)
+}
+
+// AckTx acks a job as part of tx. A later Ack of the same job is a no-op.
+func (p *Postgres) AckTx(ctx context.Context, tx *sqlx.Tx, job *Job) error {
+	return ack(ctx, tx, job)
+}
+
+func ack(ctx context.Context, db sqlx.ExecerContext, job *Job) error {
+	query := `UPDATE queue_jobs SET status = 'completed', processed_at = NOW(), locked_by = NULL, locked_until = NULL
+	          WHERE id = $1 AND locked_by = $2`
+	_, err := db.ExecContext(ctx, query, job.ID, job.consumer)
+	return err
+}
+
+func (p *Postgres) Nack(ctx context.Context, job *Job, delay time.Duration, lastError string) error {
+	query := `UPDATE queue_jobs
+	          SET status = 'pending', attempts = attempts + 1, last_error = $3,
+	              next_attempt_at = NOW() + make_interval(secs => $4), locked_by = NULL, locked_until = NULL
+	          WHERE id = $1 AND locked_by = $2`
+	_, err := p.db.ExecContext(ctx, query, job.ID, job.consumer, lastError, delay.Seconds())
+	return err
+}
+
+func (p *Postgres) Release(ctx context.Context, job *Job, delay time.Duration) error {
+	query := `UPDATE queue_jobs
+	          SET status = 'pending', next_attempt_at = NOW() + make_interval(secs => $3),
+	              locked_by = NULL, locked_until = NULL
+	          WHERE id = $1 AND locked_by = $2`
+	_, err := p.db.ExecContext(ctx, query, job.ID, job.consumer, delay.Seconds())
+	return err
+}
+
+// Bury marks a job dead. Dead jobs stay in the table until replayed or
+// purged.
+func (p *Postgres) Bury(ctx context.Context, job *Job, lastError string) error {
+	query := `UPDATE queue_jobs
+	          SET status = 'dead', attempts = attempts + 1, last_error = $3, processed_at = NOW(),
+	              locked_by = NULL, locked_until = NULL
+	          WHERE id = $1 AND locked_by = $2`
+	_, err := p.db.ExecContext(ctx, query, job.ID, job.consumer, lastError)
+	return err
+}
+
+// Reap uses the locked_until recorded with each lease, so lease is unused.
+func (p *Postgres) Reap(ctx context.Context, lease time.Duration, maxAttempts int, maxByType map[string]int) (int64, error) {
+	query := `UPDATE queue_jobs
+	          SET status = CASE WHEN attempts + 1 >= COALESCE(($2::jsonb ->> type)::int, $1)
+	                            THEN 'dead' ELSE 'pending' END,
+	              processed_at = CASE WHEN attempts + 1 >= COALESCE(($2::jsonb ->> type)::int, $1)
+	                                  THEN NOW() END,
+	              attempts = attempts + 1, next_attempt_at = NOW(),
+	              last_error = 'lease expired on ' || COALESCE(locked_by, 'unknown worker'),
+	              locked_by = NULL, locked_until = NULL
+	          WHERE status = 'processing' AND (locked_until IS NULL OR locked_until < NOW())`
+
+	maxByTypeJSON, _ := json.Marshal(maxByType)
+	res, err := p.db.ExecContext(ctx, query, maxAttempts, maxByTypeJSON)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Wake listens for NOTIFY on JobsChannel over a dedicated connection. It
+// also fires after that connection is re-established, since notifications
+// sent while it was down are lost.
+func (p *Postgres) Wake(ctx context.Context) (<-chan struct{}, error) {
+	listener := pq.NewListener(p.url, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Postgres listener on %s: %v", JobsChannel, err)
+		}
+	})
+	if err := listener.Listen(JobsChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	wake := make(chan struct{}, 1)
+	go func() {
+		defer listener.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-listener.Notify:
+				coalesce(wake)
+			}
+		}
+	}()
+	return wake, nil
+}
+
+func (p *Postgres) ListDead(ctx context.Context, jobType string, limit int) ([]*Job, error) {
+	var rows []jobRow
+	query := `SELECT ` + jobColumns + ` FROM queue_jobs
+	          WHERE status = 'dead' AND ($1 = '' OR type = $1)
+	          ORDER BY processed_at DESC
+	          LIMIT $2`
+
+	if err := p.db.SelectContext(ctx, &rows, query, jobType, limit); err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, 0, len(rows))
+	for i := range rows {
+		jobs = append(jobs, rows[i].job())
+	}
+	return jobs, nil
+}
+
+// GetDead returns a dead job by ID, or nil if there is none.
+func (p *Postgres) GetDead(ctx context.Context, id string) (*Job, error) {
+	var row jobRow
+	err := p.db.GetContext(ctx, &row, `SELECT `+jobColumns+` FROM queue_jobs WHERE id = $1 AND status = 'dead'`, id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return row.job(), nil
+}
+
+// ReplayDead returns dead jobs to pending with their attempts reset.
+func (p *Postgres) ReplayDead(ctx context.Context, id, jobType string) (int64, error) {
+	query := `UPDATE queue_jobs
+	          SET status = 'pending', attempts = 0, next_attempt_at = NOW(), processed_at = NULL
+	          WHERE status = 'dead' AND ($1 = '' OR id = $1) AND ($2 = '' OR type = $2)`
+
+	res, err := p.db.ExecContext(ctx, query, id, jobType)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n > 0 {
+		_, err = p.db.ExecContext(ctx, `SELECT pg_notify($1, '')`, JobsChannel)
+	}
+	return n, err
+}
+
+// PurgeDead deletes dead jobs that failed more than olderThan ago.
+func (p *Postgres) PurgeDead(ctx context.Context, id, jobType string, olderThan time.Duration) (int64, error) {
+	query := `DELETE FROM queue_jobs
+	          WHERE status = 'dead' AND ($1 = '' OR id = $1) AND ($2 = '' OR type = $2)
+	            AND processed_at <= NOW() - make_interval(secs => $3)`
+
+	res, err := p.db.ExecContext(ctx, query, id, jobType, olderThan.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
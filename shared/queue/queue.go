@@ -0,0 +1,121 @@
+// Package queue is the job queue shared by the smtp service, which enqueues
+// work, and the worker, which claims and runs it. Backends are selected with
+// QUEUE_BACKEND; both services must use the same one.
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+// Backend names accepted by Open.
+const (
+	BackendPostgres = "postgres"
+	BackendRedis    = "redis"
+)
+
+// Job is a unit of work claimed from a queue. Attempts counts earlier
+// failed attempts, not including the current one.
+type Job struct {
+	ID        string
+	Type      string
+	Payload   []byte
+	Status    string
+	Attempts  int
+	LastError string
+	CreatedAt time.Time
+	FailedAt  *time.Time
+
+	// consumer holds the lease; ref is the backend's handle for the claim
+	consumer string
+	ref      string
+	unique   bool
+}
+
+// Queue is a job queue with leased claims. A claimed job must be Acked,
+// Nacked or Buried by the consumer that claimed it; if the consumer stops
+// extending its leases instead, Reap eventually returns the job to the
+// queue with the attempt counted.
+type Queue interface {
+	DeadLetters
+
+	// Enqueue adds a job with a JSON-encoded payload.
+	Enqueue(ctx context.Context, jobType string, payload interface{}) error
+	// EnqueueUnique adds a payload-less job unless one of the same type is
+	// already waiting, so periodic jobs don't pile up across replicas.
+	EnqueueUnique(ctx context.Context, jobType string) error
+
+	// Claim leases up to limit jobs of the given types to consumer. Jobs of
+	// other types stay queued for consumers that handle them.
+	Claim(ctx context.Context, consumer string, limit int, lease time.Duration, types []string) ([]*Job, error)
+	// Extend renews the lease on jobs consumer is still working on.
+	Extend(ctx context.Context, consumer string, jobs []*Job, lease time.Duration) error
+	// Ack removes a job that completed.
+	Ack(ctx context.Context, job *Job) error
+	// Nack records a failed attempt and makes the job due again after delay.
+	Nack(ctx context.Context, job *Job, delay time.Duration, lastError string) error
+	// Release returns a job unchanged, without counting an attempt, for
+	// work the consumer claimed but didn't start or can't finish.
+	Release(ctx context.Context, job *Job, delay time.Duration) error
+	// Bury records a final failed attempt and moves the job to the dead
+	// letters.
+	Bury(ctx context.Context, job *Job, lastError string) error
+
+	// Reap returns jobs whose lease expired to the queue with the attempt
+	// counted, burying those that have used their attempts (maxByType, or
+	// else maxAttempts). Every replica may run it concurrently.
+	Reap(ctx context.Context, lease time.Duration, maxAttempts int, maxByType map[string]int) (int64, error)
+
+	// Wake returns a channel that receives a value when jobs may have been
+	// added, so consumers can claim straight away instead of at their next
+	// poll. Wakeups are coalesced and best effort. It stops when ctx is done.
+	Wake(ctx context.Context) (<-chan struct{}, error)
+}
+
+// TxAcker is implemented by queues kept in the database, which can ack a
+// job inside the caller's transaction so that the job completes if, and
+// only if, its work commits.
+type TxAcker interface {
+	AckTx(ctx context.Context, tx *sqlx.Tx, job *Job) error
+}
+
+// DeadLetters manages jobs buried after their final attempt. An empty id
+// in Replay and Purge matches every dead job, and an empty jobType any type.
+type DeadLetters interface {
+	ListDead(ctx context.Context, jobType string, limit int) ([]*Job, error)
+	GetDead(ctx context.Context, id string) (*Job, error)
+	ReplayDead(ctx context.Context, id, jobType string) (int64, error)
+	PurgeDead(ctx context.Context, id, jobType string, olderThan time.Duration) (int64, error)
+}
+
+// Open returns the queue for the named backend. db and dbURL are used by the
+// Postgres backend and rdb by the Redis one.
+func Open(ctx context.Context, backend string, db *sqlx.DB, dbURL string, rdb *redis.Client) (Queue, error) {
+	switch backend {
+	case "", BackendPostgres:
+		return NewPostgres(db, dbURL), nil
+	case BackendRedis:
+		return NewRedis(ctx, rdb)
+	}
+	return nil, fmt.Errorf("unknown queue backend %q", backend)
+}
+
+// maxFor returns the attempts allowed for a job type.
+func maxFor(jobType string, maxAttempts int, maxByType map[string]int) int {
+	if n, ok := maxByType[jobType]; ok {
+		return n
+	}
+	return maxAttempts
+}
+
+// coalesce forwards a wakeup without blocking; one pending value is enough.
+func coalesce(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,531 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Keys used by the Redis backend. Each job type has its own stream, read
+// through one consumer group, so consumers take only the types they handle;
+// types lists the streams. A claim is an entry in the group's pending list,
+// and its lease is the entry's idle time, which Extend resets.
+const (
+	redisStream  = "queue:jobs:"
+	redisTypes   = "queue:types"
+	redisGroup   = "workers"
+	redisDelayed = "queue:delayed"
+	redisDead    = "queue:dead"
+	redisWake    = "queue:wake"
+	redisUnique  = "queue:unique:"
+	redisReaper  = "reaper"
+)
+
+// uniqueTTL bounds how long EnqueueUnique's marker can outlive its job if a
+// worker dies without acking it.
+const uniqueTTL = time.Hour
+
+// promoteScript moves due retries from the delayed set back onto their
+// streams in one step, so a crash can't lose a job between the two. Members
+// are the entry fields as a JSON array, with the type fourth.
+var promoteScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, member in ipairs(due) do
+	local fields = cjson.decode(member)
+	redis.call('ZREM', KEYS[1], member)
+	redis.call('XADD', ARGV[3] .. fields[4], '*', unpack(fields))
+end
+return #due
+`)
+
+// settleScript finishes with a claimed entry only while consumer ARGV[3]
+// still holds it, so a consumer whose lease was reaped can't delete or
+// duplicate the entry the reaper now owns. It acks and deletes entry ARGV[2]
+// of stream KEYS[1] in group ARGV[1], and the unique marker KEYS[2] if
+// ARGV[4] is set. ARGV[5], if set, is the next entry's fields as a JSON
+// array, added to the stream KEYS[3], or to the delayed set KEYS[3] if its
+// due time ARGV[6] is positive. ARGV[7], if set, is a channel to publish the
+// type ARGV[8] on.
+var settleScript = redis.NewScript(`
+if #redis.call('XPENDING', KEYS[1], ARGV[1], ARGV[2], ARGV[2], 1, ARGV[3]) == 0 then
+	return 0
+end
+redis.call('XACK', KEYS[1], ARGV[1], ARGV[2])
+redis.call('XDEL', KEYS[1], ARGV[2])
+if ARGV[4] == '1' then
+	redis.call('DEL', KEYS[2])
+end
+if ARGV[5] ~= '' then
+	if tonumber(ARGV[6]) > 0 then
+		redis.call('ZADD', KEYS[3], ARGV[6], ARGV[5])
+	else
+		redis.call('XADD', KEYS[3], '*', unpack(cjson.decode(ARGV[5])))
+	end
+end
+if ARGV[7] ~= '' then
+	redis.call('PUBLISH', ARGV[7], ARGV[8])
+end
+return 1
+`)
+
+// extendScript resets the idle time of the entries in ARGV after the group
+// and consumer, skipping any the consumer no longer holds. A plain XCLAIM
+// would take them back from the reaper.
+var extendScript = redis.NewScript(`
+local extended = 0
+for i = 3, #ARGV do
+	if #redis.call('XPENDING', KEYS[1], ARGV[1], ARGV[i], ARGV[i], 1, ARGV[2]) > 0 then
+		redis.call('XCLAIM', KEYS[1], ARGV[1], ARGV[2], 0, ARGV[i], 'JUSTID')
+		extended = extended + 1
+	end
+end
+return extended
+`)
+
+// Redis keeps jobs in Redis streams, which takes queue traffic off
+// Postgres. Completed jobs are deleted rather than kept; retries wait in a
+// sorted set and dead jobs in a separate stream.
+type Redis struct {
+	client *redis.Client
+
+	// groups caches the streams whose consumer group is known to exist
+	groups sync.Map
+	// next rotates the type Claim reads first, so a busy type can't starve
+	// the others
+	next atomic.Uint32
+}
+
+// NewRedis returns a queue on client.
+func NewRedis(ctx context.Context, client *redis.Client) (*Redis, error) {
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, err
+	}
+	return &Redis{client: client}, nil
+}
+
+func stream(jobType string) string {
+	return redisStream + jobType
+}
+
+// ensureGroup creates the consumer group on a type's stream if needed.
+func (r *Redis) ensureGroup(ctx context.Context, jobType string) error {
+	if _, ok := r.groups.Load(jobType); ok {
+		return nil
+	}
+	err := r.client.XGroupCreateMkStream(ctx, stream(jobType), redisGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	r.groups.Store(jobType, true)
+	return nil
+}
+
+// fields renders a job as stream entry fields. promoteScript depends on
+// the order of the first four.
+func (j *Job) fields() []string {
+	unique := ""
+	if j.unique {
+		unique = "1"
+	}
+	f := []string{
+		"id", j.ID,
+		"type", j.Type,
+		"payload", string(j.Payload),
+		"attempts", strconv.Itoa(j.Attempts),
+		"created_at", strconv.FormatInt(j.CreatedAt.UnixMilli(), 10),
+		"last_error", j.LastError,
+		"unique", unique,
+	}
+	if j.FailedAt != nil {
+		f = append(f, "failed_at", strconv.FormatInt(j.FailedAt.UnixMilli(), 10))
+	}
+	return f
+}
+
+func values(fields []string) []interface{} {
+	v := make([]interface{}, len(fields))
+	for i, f := range fields {
+		v[i] = f
+	}
+	return v
+}
+
+// redisJob decodes a stream entry.
+func redisJob(msg redis.XMessage, status string) *Job {
+	str := func(key string) string {
+		s, _ := msg.Values[key].(string)
+		return s
+	}
+	millis := func(key string) *time.Time {
+		ms, err := strconv.ParseInt(str(key), 10, 64)
+		if err != nil {
+			return nil
+		}
+		t := time.UnixMilli(ms)
+		return &t
+	}
+
+	job := &Job{
+		ID:        str("id"),
+		Type:      str("type"),
+		Payload:   []byte(str("payload")),
+		Status:    status,
+		LastError: str("last_error"),
+		FailedAt:  millis("failed_at"),
+		ref:       msg.ID,
+		unique:    str("unique") == "1",
+	}
+	job.Attempts, _ = strconv.Atoi(str("attempts"))
+	if created := millis("created_at"); created != nil {
+		job.CreatedAt = *created
+	}
+	return job
+}
+
+func (r *Redis) Enqueue(ctx context.Context, jobType string, payload interface{}) error {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return r.add(ctx, &Job{ID: uuid.New().String(), Type: jobType, Payload: payloadJSON, CreatedAt: time.Now()})
+}
+
+func (r *Redis) EnqueueUnique(ctx context.Context, jobType string) error {
+	ok, err := r.client.SetNX(ctx, redisUnique+jobType, 1, uniqueTTL).Result()
+	if err != nil || !ok {
+		return err
+	}
+	return r.add(ctx, &Job{ID: uuid.New().String(), Type: jobType, Payload: []byte("{}"),
+		CreatedAt: time.Now(), unique: true})
+}
+
+// add appends a job to its stream and wakes consumers.
+func (r *Redis) add(ctx context.Context, job *Job) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		r.push(ctx, pipe, job)
+		return nil
+	})
+	return err
+}
+
+func (r *Redis) push(ctx context.Context, pipe redis.Pipeliner, job *Job) {
+	pipe.SAdd(ctx, redisTypes, job.Type)
+	pipe.XAdd(ctx, &redis.XAddArgs{Stream: stream(job.Type), Values: values(job.fields())})
+	pipe.Publish(ctx, redisWake, job.Type)
+}
+
+// Claim reads new entries for consumer. The lease is the entry's idle time
+// in the pending list, so lease is only enforced by Reap.
+func (r *Redis) Claim(ctx context.Context, consumer string, limit int, lease time.Duration, types []string) ([]*Job, error) {
+	if len(types) == 0 {
+		return nil, nil
+	}
+
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	err := promoteScript.Run(ctx, r.client, []string{redisDelayed}, now, 100, redisStream).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*Job
+	first := int(r.next.Add(1))
+	for i := range types {
+		if len(jobs) >= limit {
+			break
+		}
+		jobType := types[(first+i)%len(types)]
+		if err := r.ensureGroup(ctx, jobType); err != nil {
+			return jobs, err
+		}
+
+		streams, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    redisGroup,
+			Consumer: consumer,
+			Streams:  []string{stream(jobType), ">"},
+			Count:    int64(limit - len(jobs)),
+			Block:    -1,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return jobs, err
+		}
+
+		for _, s := range streams {
+			for _, msg := range s.Messages {
+				job := redisJob(msg, "processing")
+				job.consumer = consumer
+				jobs = append(jobs, job)
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// Extend resets the idle time of consumer's entries by claiming them again.
+// Entries the reaper has taken over are left alone.
+func (r *Redis) Extend(ctx context.Context, consumer string, jobs []*Job, lease time.Duration) error {
+	refs := make(map[string][]interface{})
+	for _, job := range jobs {
+		refs[job.Type] = append(refs[job.Type], job.ref)
+	}
+	for jobType, ids := range refs {
+		args := append([]interface{}{redisGroup, consumer}, ids...)
+		if err := extendScript.Run(ctx, r.client, []string{stream(jobType)}, args...).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ack removes a completed entry. Like Nack, Release and Bury, it does
+// nothing if the lease was lost and the entry now belongs to the reaper.
+func (r *Redis) Ack(ctx context.Context, job *Job) error {
+	return r.settle(ctx, job, job.unique, "", nil, 0)
+}
+
+// Nack re-adds the job with the attempt counted.
+func (r *Redis) Nack(ctx context.Context, job *Job, delay time.Duration, lastError string) error {
+	retry := *job
+	retry.Attempts++
+	retry.LastError = lastError
+	return r.requeue(ctx, job, &retry, delay)
+}
+
+// Release re-adds the job as it was claimed.
+func (r *Redis) Release(ctx context.Context, job *Job, delay time.Duration) error {
+	return r.requeue(ctx, job, job, delay)
+}
+
+// requeue replaces a claimed entry with retry, through the delayed set
+// unless it is due straight away. A unique job keeps its marker until the
+// retry finishes.
+func (r *Redis) requeue(ctx context.Context, job, retry *Job, delay time.Duration) error {
+	if delay <= 0 {
+		return r.settle(ctx, job, false, stream(job.Type), retry, 0)
+	}
+	return r.settle(ctx, job, false, redisDelayed, retry, time.Now().Add(delay).UnixMilli())
+}
+
+func (r *Redis) Bury(ctx context.Context, job *Job, lastError string) error {
+	now := time.Now()
+	dead := *job
+	dead.Attempts++
+	dead.LastError = lastError
+	dead.FailedAt = &now
+	return r.settle(ctx, job, job.unique, redisDead, &dead, 0)
+}
+
+// settle runs settleScript for a claimed entry: it is removed, releasing
+// the unique marker if release is set, and next, if any, is added to dest,
+// which is a stream, or the delayed set when due is set.
+func (r *Redis) settle(ctx context.Context, job *Job, release bool, dest string, next *Job, due int64) error {
+	keys := []string{stream(job.Type), redisUnique + job.Type, dest}
+	if dest == "" {
+		keys[2] = keys[0]
+	}
+	var member []byte
+	if next != nil {
+		member, _ = json.Marshal(next.fields())
+	}
+	unique := ""
+	if release {
+		unique = "1"
+	}
+	wake := ""
+	if dest == stream(job.Type) {
+		wake = redisWake
+	}
+	return settleScript.Run(ctx, r.client, keys,
+		redisGroup, job.ref, job.consumer, unique, string(member), due, wake, job.Type).Err()
+}
+
+// Reap takes over entries idle for longer than lease with XAUTOCLAIM, which
+// hands each to exactly one caller, then retries or buries them. It covers
+// every type ever enqueued, not only those this consumer handles.
+func (r *Redis) Reap(ctx context.Context, lease time.Duration, maxAttempts int, maxByType map[string]int) (int64, error) {
+	types, err := r.client.SMembers(ctx, redisTypes).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var reaped int64
+	for _, jobType := range types {
+		if err := r.ensureGroup(ctx, jobType); err != nil {
+			return reaped, err
+		}
+
+		start := "0-0"
+		for {
+			msgs, next, err := r.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   stream(jobType),
+				Group:    redisGroup,
+				MinIdle:  lease,
+				Start:    start,
+				Count:    100,
+				Consumer: redisReaper,
+			}).Result()
+			if err != nil {
+				return reaped, err
+			}
+
+			for _, msg := range msgs {
+				job := redisJob(msg, "processing")
+				job.consumer = redisReaper
+				lastError := "lease expired"
+				if job.Attempts+1 >= maxFor(job.Type, maxAttempts, maxByType) {
+					err = r.Bury(ctx, job, lastError)
+				} else {
+					err = r.Nack(ctx, job, 0, lastError)
+				}
+				if err != nil {
+					return reaped, err
+				}
+				reaped++
+			}
+
+			if next == "0-0" || next == "" {
+				break
+			}
+			start = next
+		}
+	}
+	return reaped, nil
+}
+
+// Wake subscribes to the channel Enqueue publishes on.
+func (r *Redis) Wake(ctx context.Context) (<-chan struct{}, error) {
+	sub := r.client.Subscribe(ctx, redisWake)
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	wake := make(chan struct{}, 1)
+	go func() {
+		defer sub.Close()
+		messages := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-messages:
+				coalesce(wake)
+			}
+		}
+	}()
+	return wake, nil
+}
+
+// scanDead calls fn for each dead job, oldest first or newest first, until
+// fn returns false.
+func (r *Redis) scanDead(ctx context.Context, newestFirst bool, fn func(job *Job) (bool, error)) error {
+	const page = 100
+	start, end := "-", "+"
+	for {
+		var msgs []redis.XMessage
+		var err error
+		if newestFirst {
+			msgs, err = r.client.XRevRangeN(ctx, redisDead, end, start, page).Result()
+		} else {
+			msgs, err = r.client.XRangeN(ctx, redisDead, start, end, page).Result()
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range msgs {
+			more, err := fn(redisJob(msg, "dead"))
+			if err != nil || !more {
+				return err
+			}
+		}
+		if len(msgs) < page {
+			return nil
+		}
+
+		// Continue after the last entry seen (exclusive ranges, Redis 6.2+)
+		last := "(" + msgs[len(msgs)-1].ID
+		if newestFirst {
+			end = last
+		} else {
+			start = last
+		}
+	}
+}
+
+func matches(job *Job, id, jobType string) bool {
+	return (id == "" || job.ID == id) && (jobType == "" || job.Type == jobType)
+}
+
+func (r *Redis) ListDead(ctx context.Context, jobType string, limit int) ([]*Job, error) {
+	var jobs []*Job
+	err := r.scanDead(ctx, true, func(job *Job) (bool, error) {
+		if matches(job, "", jobType) {
+			jobs = append(jobs, job)
+		}
+		return len(jobs) < limit, nil
+	})
+	return jobs, err
+}
+
+func (r *Redis) GetDead(ctx context.Context, id string) (*Job, error) {
+	var found *Job
+	err := r.scanDead(ctx, true, func(job *Job) (bool, error) {
+		if job.ID == id {
+			found = job
+			return false, nil
+		}
+		return true, nil
+	})
+	return found, err
+}
+
+// ReplayDead moves dead jobs back onto their streams with their attempts reset.
+func (r *Redis) ReplayDead(ctx context.Context, id, jobType string) (int64, error) {
+	var replayed int64
+	err := r.scanDead(ctx, false, func(job *Job) (bool, error) {
+		if !matches(job, id, jobType) {
+			return true, nil
+		}
+		retry := *job
+		retry.Attempts = 0
+		retry.FailedAt = nil
+		retry.unique = false
+
+		_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.XDel(ctx, redisDead, job.ref)
+			r.push(ctx, pipe, &retry)
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+		replayed++
+		return id == "", nil
+	})
+	return replayed, err
+}
+
+func (r *Redis) PurgeDead(ctx context.Context, id, jobType string, olderThan time.Duration) (int64, error) {
+	cutoff := time.Now().Add(-olderThan)
+	var refs []string
+	err := r.scanDead(ctx, false, func(job *Job) (bool, error) {
+		if matches(job, id, jobType) && (job.FailedAt == nil || !job.FailedAt.After(cutoff)) {
+			refs = append(refs, job.ref)
+		}
+		return true, nil
+	})
+	if err != nil || len(refs) == 0 {
+		return 0, err
+	}
+	return r.client.XDel(ctx, redisDead, refs...).Result()
+}
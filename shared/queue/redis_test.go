@@ -0,0 +1,201 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+const testType = "test_job"
+
+func newTestRedis(t *testing.T) (*Redis, *redis.Client) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	q, err := NewRedis(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, client
+}
+
+func claimOne(t *testing.T, q *Redis, consumer string) *Job {
+	t.Helper()
+	jobs, err := q.Claim(context.Background(), consumer, 10, time.Minute, []string{testType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("claimed %d jobs, want 1", len(jobs))
+	}
+	return jobs[0]
+}
+
+// counts returns the number of entries in the stream, its pending list,
+// the delayed set and the dead letters, and whether the unique marker is
+// held.
+func counts(t *testing.T, client *redis.Client) [5]int64 {
+	t.Helper()
+	ctx := context.Background()
+	pending, err := client.XPending(ctx, stream(testType), redisGroup).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [5]int64{
+		client.XLen(ctx, stream(testType)).Val(),
+		pending.Count,
+		client.ZCard(ctx, redisDelayed).Val(),
+		client.XLen(ctx, redisDead).Val(),
+		client.Exists(ctx, redisUnique+testType).Val(),
+	}
+}
+
+func TestRedisSettle(t *testing.T) {
+	tests := []struct {
+		name   string
+		settle func(q *Redis, job *Job) error
+		// stream, pending, delayed, dead, unique marker
+		want [5]int64
+	}{
+		{
+			name:   "ack",
+			settle: func(q *Redis, job *Job) error { return q.Ack(context.Background(), job) },
+			want:   [5]int64{0, 0, 0, 0, 0},
+		},
+		{
+			name: "nack due now",
+			settle: func(q *Redis, job *Job) error {
+				return q.Nack(context.Background(), job, 0, "boom")
+			},
+			want: [5]int64{1, 0, 0, 0, 1},
+		},
+		{
+			name: "nack with a delay",
+			settle: func(q *Redis, job *Job) error {
+				return q.Nack(context.Background(), job, time.Minute, "boom")
+			},
+			want: [5]int64{0, 0, 1, 0, 1},
+		},
+		{
+			name:   "release",
+			settle: func(q *Redis, job *Job) error { return q.Release(context.Background(), job, 0) },
+			want:   [5]int64{1, 0, 0, 0, 1},
+		},
+		{
+			name:   "bury",
+			settle: func(q *Redis, job *Job) error { return q.Bury(context.Background(), job, "boom") },
+			want:   [5]int64{0, 0, 0, 1, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, client := newTestRedis(t)
+			if err := q.EnqueueUnique(context.Background(), testType); err != nil {
+				t.Fatal(err)
+			}
+			job := claimOne(t, q, "worker-1")
+
+			if err := tt.settle(q, job); err != nil {
+				t.Fatal(err)
+			}
+			if got := counts(t, client); got != tt.want {
+				t.Errorf("counts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedisNackCountsAttempt(t *testing.T) {
+	ctx := context.Background()
+	q, _ := newTestRedis(t)
+	if err := q.Enqueue(ctx, testType, map[string]string{"id": "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	job := claimOne(t, q, "worker-1")
+	if err := q.Nack(ctx, job, 0, "boom"); err != nil {
+		t.Fatal(err)
+	}
+
+	retry := claimOne(t, q, "worker-2")
+	if retry.ID != job.ID || retry.Attempts != 1 || retry.LastError != "boom" || string(retry.Payload) != `{"id":"1"}` {
+		t.Errorf("retry = %+v", retry)
+	}
+}
+
+// A consumer whose lease was reaped mustn't touch the entry: the reaper's
+// retry would otherwise run alongside the consumer's result.
+func TestRedisLostLease(t *testing.T) {
+	ctx := context.Background()
+	q, client := newTestRedis(t)
+	if err := q.EnqueueUnique(ctx, testType); err != nil {
+		t.Fatal(err)
+	}
+	job := claimOne(t, q, "worker-1")
+
+	// Take the entry over as Reap does before retrying it
+	err := client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream: stream(testType), Group: redisGroup, Start: "0-0", Count: 10, Consumer: redisReaper,
+	}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Extend(ctx, "worker-1", []*Job{job}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Nack(ctx, job, 0, "boom"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Release(ctx, job, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Bury(ctx, job, "boom"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := counts(t, client), [5]int64{1, 1, 0, 0, 1}; got != want {
+		t.Errorf("counts = %v, want %v", got, want)
+	}
+	pending, err := client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: stream(testType), Group: redisGroup, Start: "-", End: "+", Count: 10,
+	}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Consumer != redisReaper {
+		t.Errorf("pending = %+v, want the entry held by %s", pending, redisReaper)
+	}
+}
+
+func TestRedisReap(t *testing.T) {
+	ctx := context.Background()
+	q, client := newTestRedis(t)
+	if err := q.Enqueue(ctx, testType, map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	claimOne(t, q, "worker-1")
+
+	reaped, err := q.Reap(ctx, 0, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reaped != 1 {
+		t.Fatalf("reaped %d, want 1", reaped)
+	}
+	if got, want := counts(t, client), [5]int64{1, 0, 0, 0, 0}; got != want {
+		t.Errorf("counts = %v, want %v", got, want)
+	}
+	if retry := claimOne(t, q, "worker-2"); retry.Attempts != 1 || retry.LastError != "lease expired" {
+		t.Errorf("retry = %+v", retry)
+	}
+}
@@ -2,16 +2,30 @@ export interface User {
   id: string;
   email: string;
   passwordHash: string;
+  plan: string;
+  quotaBytes?: number;
+  usedBytes: number;
   createdAt: Date;
   updatedAt: Date;
 }
 
+export interface AppPassword {
+  id: string;
+  userId: string;
+  name: string;
+  lastUsedAt?: Date;
+  createdAt: Date;
+}
+
 export interface Mailbox {
   id: string;
   userId: string;
   address: string;
   isAlias: boolean;
   isTemp: boolean;
+  expiresAt?: Date;
+  emailCount: number;
+  sizeBytes: number;
   createdAt: Date;
   updatedAt: Date;
 }
@@ -29,6 +43,24 @@ export interface Email {
   htmlBody?: string;
   minioPath: string;
   size: number;
+  sha256?: string;
+  spfResult?: 'none' | 'neutral' | 'pass' | 'fail' | 'softfail' | 'temperror' | 'permerror';
+  spfDomain?: string;
+  dmarcResult?: 'none' | 'pass' | 'fail' | 'temperror' | 'permerror';
+  dmarcDisposition?: 'none' | 'quarantine' | 'reject';
+  folder: 'inbox' | 'quarantine' | 'sent';
+  replyTo?: string[];
+  inReplyTo?: string;
+  references?: string[];
+  sentAt?: Date;
+  listId?: string;
+  listHelp?: string;
+  listUnsubscribe?: string;
+  listUnsubscribePost?: string;
+  listSubscribe?: string;
+  listPost?: string;
+  listOwner?: string;
+  listArchive?: string;
   receivedAt: Date;
   createdAt: Date;
 }
@@ -36,25 +68,84 @@ export interface Email {
 export interface EmailMetadata {
   id: string;
   emailId: string;
-  headers: Record<string, string>;
+  headers: Record<string, Array<{ value: string; raw?: string }>>;
   attachments?: Array<{
     filename: string;
     contentType: string;
     size: number;
     minioPath: string;
+    sha256: string;
+    contentId?: string;
+    inline?: boolean;
+  }>;
+  dkimResults: Array<{
+    domain: string;
+    selector: string;
+    identity?: string;
+    algorithm?: string;
+    result: 'none' | 'pass' | 'fail' | 'neutral' | 'policy' | 'temperror' | 'permerror';
+    reason?: string;
+    header_b?: string;
   }>;
 }
 
+export interface Domain {
+  id: string;
+  name: string;
+  enabled: boolean;
+  catchAll: boolean;
+  maxMessageSize: number;
+  rejectPolicy: 'reject' | 'tempfail' | 'accept';
+  dmarcOverride: '' | 'none' | 'quarantine' | 'reject';
+  createdAt: Date;
+  updatedAt: Date;
+}
+
+export interface DKIMKey {
+  id: string;
+  domainId: string;
+  selector: string;
+  algorithm: 'rsa' | 'ed25519';
+  publicKey: string;
+  status: 'pending' | 'active' | 'retired';
+  activatedAt?: Date;
+  retireAt?: Date;
+  createdAt: Date;
+  updatedAt: Date;
+}
+
 export interface QueueJob {
   id: string;
   type: 'process_email' | 'send_email' | 'cleanup_temp';
   payload: Record<string, any>;
-  status: 'pending' | 'processing' | 'completed' | 'failed';
+  status: 'pending' | 'processing' | 'completed' | 'failed' | 'dead';
   attempts: number;
+  lockedBy?: string;
+  lockedUntil?: Date;
+  nextAttemptAt: Date;
+  lastError?: string;
   createdAt: Date;
   processedAt?: Date;
 }
 
+export interface OutboundMessage {
+  id: string;
+  emailId: string;
+  userId: string;
+  mailboxId?: string;
+  sender: string;
+  domain: string;
+  recipients: string[];
+  minioPath: string;
+  status: 'queued' | 'sent' | 'failed';
+  attempts: number;
+  lastError?: string;
+  nextAttemptAt: Date;
+  expiresAt: Date;
+  createdAt: Date;
+  updatedAt: Date;
+}
+
 export interface AuthToken {
   userId: string;
   token: string;
@@ -6,15 +6,27 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
+	"github.com/mymail/shared/queue"
+	"github.com/mymail/smtp/src/auth"
+	"github.com/mymail/smtp/src/cli"
 	"github.com/mymail/smtp/src/config"
+	"github.com/mymail/smtp/src/directory"
+	"github.com/mymail/smtp/src/dmarc"
+	"github.com/mymail/smtp/src/dns"
+	"github.com/mymail/smtp/src/domain"
 	"github.com/mymail/smtp/src/handler"
+	"github.com/mymail/smtp/src/keyring"
+	"github.com/mymail/smtp/src/quota"
 	"github.com/mymail/smtp/src/ratelimit"
+	"github.com/mymail/smtp/src/spf"
 	"github.com/mymail/smtp/src/storage"
 )
 
@@ -25,6 +37,10 @@ func main() {
 
 	cfg := config.Load(cfgPath)
 
+	if flag.Arg(0) == "dkim" {
+		os.Exit(cli.RunDKIM(cfg, flag.Args()[1:]))
+	}
+
 	// Initialize storage
 	db, err := storage.NewPostgres(cfg.Database.URL)
 	if err != nil {
@@ -43,11 +59,42 @@ func main() {
 		log.Fatalf("Failed to connect to MinIO: %v", err)
 	}
 
-	// Initialize rate limiter
-	rateLimiter := ratelimit.New(redis)
+	jobs, err := queue.Open(context.Background(), cfg.Queue.Backend, db.GetDB(), cfg.Database.URL, redis.GetClient())
+	if err != nil {
+		log.Fatalf("Failed to open job queue: %v", err)
+	}
+
+	// Initialize rate limiter and storage quotas
+	rateLimiter := ratelimit.New(redis.GetClient(), cfg.RateLimit)
+	quotas := quota.New(db, redis, cfg.Quota)
+
+	// Initialize domain registry and recipient directory
+	domains := domain.NewResolver(db, redis, cfg)
+	mailboxes := directory.New(db, redis, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go mailboxes.Watch(ctx)
+	if cfg.SMTP.RecipientFilter {
+		go mailboxes.RunFilter(ctx, time.Duration(cfg.SMTP.RecipientFilterRefresh)*time.Second)
+	}
+
+	// DKIM signing keys
+	keys := keyring.New(db, cfg)
+	if cfg.DKIM.Enabled {
+		if err := keys.ImportLegacy(); err != nil {
+			log.Printf("Failed to import DKIM_PRIVATE_KEY: %v", err)
+		}
+	}
+
+	// Sender authentication
+	var resolver dns.Resolver = net.DefaultResolver
+	spfChecker := spf.NewChecker(resolver, cfg.SMTP.Domain)
+	dmarcChecker := dmarc.NewChecker(resolver)
 
 	// Create SMTP backend
-	backend := handler.NewBackend(db, redis, minio, rateLimiter, cfg)
+	backend := handler.NewBackend(db, redis, minio, jobs, rateLimiter, quotas, domains, mailboxes, resolver, spfChecker, dmarcChecker, cfg)
 
 	// Create SMTP server
 	s := smtp.NewServer(backend)
@@ -57,19 +104,21 @@ func main() {
 	s.WriteTimeout = 10 * time.Second
 	s.MaxMessageBytes = cfg.SMTP.MaxMessageSize
 	s.MaxRecipients = 50
-	s.AllowInsecureAuth = false
+	s.AuthDisabled = true
 
 	// TLS configuration
+	var tlsConfig *tls.Config
 	if cfg.TLS.Enabled {
 		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
 		if err != nil {
 			log.Fatalf("Failed to load TLS certificate: %v", err)
 		}
-		s.TLSConfig = &tls.Config{
+		tlsConfig = &tls.Config{
 			Certificates: []tls.Certificate{cert},
 			ServerName:   cfg.SMTP.Domain,
 		}
 	}
+	s.TLSConfig = tlsConfig
 
 	// Start server
 	log.Printf("Starting SMTP server on %s", s.Addr)
@@ -79,16 +128,54 @@ func main() {
 		}
 	}()
 
+	// Submission server for authenticated clients; AUTH is only offered
+	// after STARTTLS unless explicitly allowed for development
+	var sub *smtp.Server
+	if cfg.Submission.Enabled && (tlsConfig != nil || cfg.Submission.AllowInsecureAuth) {
+		submission := handler.NewSubmissionBackend(backend, auth.New(db), keys)
+
+		sub = smtp.NewServer(submission)
+		sub.Addr = fmt.Sprintf("%s:%d", cfg.Submission.Host, cfg.Submission.Port)
+		sub.Domain = cfg.SMTP.Domain
+		sub.ReadTimeout = 10 * time.Second
+		sub.WriteTimeout = 10 * time.Second
+		sub.MaxMessageBytes = cfg.SMTP.MaxMessageSize
+		sub.MaxRecipients = cfg.Submission.MaxRecipients
+		sub.AllowInsecureAuth = cfg.Submission.AllowInsecureAuth
+		sub.TLSConfig = tlsConfig
+		sub.EnableAuth(sasl.Login, func(conn *smtp.Conn) sasl.Server {
+			return sasl.NewLoginServer(func(username, password string) error {
+				return conn.Session().AuthPlain(username, password)
+			})
+		})
+
+		log.Printf("Starting submission server on %s", sub.Addr)
+		go func() {
+			if err := sub.ListenAndServe(); err != nil {
+				log.Fatalf("Submission server error: %v", err)
+			}
+		}()
+	} else if cfg.Submission.Enabled {
+		log.Println("Submission server disabled: it requires TLS_ENABLED or SUBMISSION_ALLOW_INSECURE_AUTH")
+	}
+
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
 	log.Println("Shutting down SMTP server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	cancel()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer shutdownCancel()
 
-	if err := s.Shutdown(ctx); err != nil {
+	if err := s.Shutdown(shutdownCtx); err != nil {
 		log.Printf("Error shutting down server: %v", err)
 	}
+	if sub != nil {
+		if err := sub.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down submission server: %v", err)
+		}
+	}
 }
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/mymail/smtp/src/storage"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when the login is unknown, so that unknown
+// and known users take about as long to reject.
+const dummyHash = "$2a$10$7EqJtq98hPqEX7fNZaFWoOhi5BWX4Z5vEfkY0X6hFx8sQ0c6dHnG2"
+
+// Authenticator checks submission credentials against the users table. A
+// user can sign in with their account password or any of their app
+// passwords.
+type Authenticator struct {
+	db *storage.Postgres
+}
+
+func New(db *storage.Postgres) *Authenticator {
+	return &Authenticator{db: db}
+}
+
+// Authenticate returns the user the credentials belong to, or nil if they
+// are wrong. Errors are reserved for lookups that failed.
+func (a *Authenticator) Authenticate(login, password string) (*storage.User, error) {
+	user, err := a.db.FindUserByLogin(strings.ToLower(strings.TrimSpace(login)))
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		CheckPassword(dummyHash, password)
+		return nil, nil
+	}
+
+	// Placeholder users behind temp mailboxes have no password
+	if user.PasswordHash != "" && CheckPassword(user.PasswordHash, password) {
+		return user, nil
+	}
+
+	appPasswords, err := a.db.ListAppPasswords(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	compact := strings.ReplaceAll(password, " ", "")
+	for _, ap := range appPasswords {
+		if CheckPassword(ap.PasswordHash, compact) {
+			a.db.TouchAppPassword(ap.ID)
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+// CheckPassword verifies password against a bcrypt hash (as written by the
+// API) or an Argon2 hash in PHC string format.
+func CheckPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$argon2id$"), strings.HasPrefix(hash, "$argon2i$"):
+		ok, err := checkArgon2(hash, password)
+		return ok && err == nil
+	}
+	return false
+}
+
+// checkArgon2 verifies a hash of the form
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>.
+func checkArgon2(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("malformed argon2 hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version")
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, fmt.Errorf("malformed argon2 parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+
+	var derived []byte
+	if parts[1] == "argon2id" {
+		derived = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	} else {
+		derived = argon2.Key([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	}
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
@@ -0,0 +1,150 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mymail/smtp/src/config"
+	"github.com/mymail/smtp/src/dkim"
+	"github.com/mymail/smtp/src/keyring"
+	"github.com/mymail/smtp/src/storage"
+)
+
+const dkimUsage = `usage: smtp dkim <command> [flags] <domain> [selector]
+
+Rotation: generate a key, publish its record, activate it (previous keys of
+the same type keep signing for the overlap window), then let the old key
+retire. Keys of different types sign side by side.
+
+commands:
+  generate <domain>                 create a pending key and print its DNS record
+  import <domain> <selector> <pem>  store an existing PEM private key as pending
+  list <domain>                     show keys and their status
+  dns <domain>                      print records for pending and signing keys
+  activate <domain> <selector>      start signing with a key
+  retire <domain> <selector>        stop signing with a key now`
+
+// RunDKIM implements the "smtp dkim" subcommand for managing per-domain signing keys.
+func RunDKIM(cfg *config.Config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, dkimUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("dkim "+args[0], flag.ContinueOnError)
+	keyType := fs.String("type", dkim.KeyTypeRSA, "key type for generate: rsa or ed25519")
+	bits := fs.Int("bits", 2048, "RSA key size for generate")
+	selector := fs.String("selector", "", "selector for generate (default: derived from type and month)")
+	overlap := fs.Duration("overlap", time.Duration(cfg.DKIM.RotationOverlap)*time.Second,
+		"how long previous keys of the same type keep signing after activate")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	rest := fs.Args()
+
+	need := map[string]int{"generate": 1, "import": 3, "list": 1, "dns": 1, "activate": 2, "retire": 2}
+	n, ok := need[args[0]]
+	if !ok || len(rest) != n {
+		fmt.Fprintln(os.Stderr, dkimUsage)
+		return 2
+	}
+
+	db, err := storage.NewPostgres(cfg.Database.URL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+	keys := keyring.New(db, cfg)
+	domainName := rest[0]
+
+	switch args[0] {
+	case "generate":
+		key, err := keys.Generate(domainName, *selector, *keyType, *bits)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Generated %s key %s for %s (pending)\n\n", key.Algorithm, key.Selector, domainName)
+		fmt.Println(zoneRecord(key, domainName))
+		fmt.Printf("\nPublish the record, then run: smtp dkim activate %s %s\n", domainName, key.Selector)
+
+	case "import":
+		pem, err := os.ReadFile(rest[2])
+		if err != nil {
+			return fail(err)
+		}
+		key, err := keys.Import(domainName, rest[1], string(pem))
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Println(zoneRecord(key, domainName))
+
+	case "list":
+		list, err := keys.List(domainName)
+		if err != nil {
+			return fail(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SELECTOR\tTYPE\tSTATUS\tACTIVATED\tRETIRES\tCREATED")
+		for _, k := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", k.Selector, k.Algorithm, k.Status,
+				formatTime(k.ActivatedAt), formatTime(k.RetireAt), k.CreatedAt.Format(time.RFC3339))
+		}
+		w.Flush()
+
+	case "dns":
+		list, err := keys.List(domainName)
+		if err != nil {
+			return fail(err)
+		}
+		for _, k := range list {
+			if k.Status != "retired" {
+				fmt.Println(zoneRecord(&k, domainName))
+			}
+		}
+
+	case "activate":
+		if err := keys.Activate(domainName, rest[1], *overlap); err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Signing %s mail with %s; previous keys of its type retire in %s\n", domainName, rest[1], *overlap)
+
+	case "retire":
+		if err := keys.Retire(domainName, rest[1]); err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Retired %s for %s\n", rest[1], domainName)
+	}
+	return 0
+}
+
+func fail(err error) int {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	return 1
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// zoneRecord renders a key's TXT record in zone file syntax, split into
+// strings of at most 255 bytes as DNS requires.
+func zoneRecord(key *storage.DKIMKey, domainName string) string {
+	txt := dkim.TXTRecord(key.Algorithm, key.PublicKey)
+
+	var chunks []string
+	for len(txt) > 255 {
+		chunks = append(chunks, `"`+txt[:255]+`"`)
+		txt = txt[255:]
+	}
+	chunks = append(chunks, `"`+txt+`"`)
+
+	return fmt.Sprintf("%s. IN TXT ( %s )", keyring.RecordName(key.Selector, domainName), strings.Join(chunks, " "))
+}
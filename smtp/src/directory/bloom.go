@@ -0,0 +1,62 @@
+package directory
+
+import (
+	"hash/fnv"
+	"math"
+	"sync/atomic"
+)
+
+// bloomFilter is a fixed-size Bloom filter over mailbox addresses. It never
+// returns a false negative for addresses it was built with, so a miss is a
+// definite "no such mailbox" that doesn't need a cache or database lookup.
+// Bits are set and read atomically so addresses can be added while it is in
+// use.
+type bloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// newBloomFilter sizes the filter for n entries at false positive rate p.
+func newBloomFilter(n int, p float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+func (f *bloomFilter) Add(key string) {
+	h1, h2 := hashes(key)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		atomic.OrUint64(&f.bits[bit/64], 1<<(bit%64))
+	}
+}
+
+func (f *bloomFilter) MayContain(key string) bool {
+	h1, h2 := hashes(key)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if atomic.LoadUint64(&f.bits[bit/64])&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hashes returns the two base hashes used for Kirsch-Mitzenmacher double
+// hashing. The second is forced odd so every probe sequence is distinct.
+func hashes(key string) (uint64, uint64) {
+	a := fnv.New64a()
+	a.Write([]byte(key))
+	b := fnv.New64()
+	b.Write([]byte(key))
+	return a.Sum64(), b.Sum64() | 1
+}
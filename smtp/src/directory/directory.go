@@ -0,0 +1,222 @@
+package directory
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mymail/smtp/src/config"
+	"github.com/mymail/smtp/src/storage"
+	"github.com/redis/go-redis/v9"
+)
+
+// CreatedChannel is the Redis channel the API publishes a mailbox's address
+// on when it creates one, so that it is deliverable before the next filter
+// rebuild or negative cache expiry.
+const CreatedChannel = "mailbox:created"
+
+// Directory answers "does this mailbox exist?" for RCPT TO. Lookups go
+// through a Redis cache (misses are cached too, with a shorter TTL) and can
+// be fronted by an in-memory Bloom filter so that directory-harvest attacks
+// using random local parts never reach Redis or Postgres.
+type Directory struct {
+	db          mailboxStore
+	redis       *storage.Redis
+	ttl         time.Duration
+	negativeTTL time.Duration
+	filter      atomic.Pointer[bloomFilter]
+
+	// While the filter is being rebuilt, added addresses are kept in
+	// pending too, in case the rebuild read the mailboxes before they
+	// were created
+	mu         sync.Mutex
+	refreshing int
+	pending    []string
+}
+
+// mailboxStore is the part of *storage.Postgres the directory reads.
+type mailboxStore interface {
+	FindMailbox(address string) (*storage.Mailbox, error)
+	ListMailboxAddresses() ([]string, error)
+}
+
+// cacheEntry wraps the cached mailbox so that a miss can be cached as well.
+type cacheEntry struct {
+	Mailbox *storage.Mailbox `json:"mailbox"`
+}
+
+func New(db *storage.Postgres, redis *storage.Redis, cfg *config.Config) *Directory {
+	return &Directory{
+		db:          db,
+		redis:       redis,
+		ttl:         time.Duration(cfg.SMTP.MailboxCacheTTL) * time.Second,
+		negativeTTL: time.Duration(cfg.SMTP.MailboxNegativeCacheTTL) * time.Second,
+	}
+}
+
+// Lookup returns the mailbox for address, or nil if none exists. Addresses
+// are matched case-insensitively.
+func (d *Directory) Lookup(ctx context.Context, address string) (*storage.Mailbox, error) {
+	address = strings.ToLower(address)
+	if f := d.filter.Load(); f != nil && !f.MayContain(address) {
+		return nil, nil
+	}
+
+	key := cacheKey(address)
+
+	var entry cacheEntry
+	found, err := d.redis.GetJSON(ctx, key, &entry)
+	if err == nil && found {
+		// A cached temp mailbox may have expired since it was cached
+		if m := entry.Mailbox; m != nil && m.ExpiresAt != nil && m.ExpiresAt.Before(time.Now()) {
+			return nil, nil
+		}
+		return entry.Mailbox, nil
+	}
+
+	mailbox, err := d.db.FindMailbox(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := d.ttl
+	if mailbox == nil {
+		ttl = d.negativeTTL
+	}
+	d.redis.SetJSON(ctx, key, cacheEntry{Mailbox: mailbox}, ttl)
+
+	return mailbox, nil
+}
+
+// Remember adds a mailbox created by this process to the cache and filter
+// so it is visible before the next filter rebuild.
+func (d *Directory) Remember(ctx context.Context, mailbox *storage.Mailbox) {
+	d.add(mailbox.Address)
+	d.redis.SetJSON(ctx, cacheKey(strings.ToLower(mailbox.Address)), cacheEntry{Mailbox: mailbox}, d.ttl)
+}
+
+// Invalidate drops the cached entry for address.
+func (d *Directory) Invalidate(ctx context.Context, address string) error {
+	return d.redis.Del(ctx, cacheKey(strings.ToLower(address)))
+}
+
+// Watch applies mailbox creations published on CreatedChannel until ctx is
+// cancelled: each address is added to the filter and any cached miss for it
+// dropped. Whenever the subscription is (re)established the filter is
+// rebuilt, since creations published while it was down are lost.
+func (d *Directory) Watch(ctx context.Context) {
+	pubsub := d.redis.GetClient().Subscribe(ctx, CreatedChannel)
+	defer pubsub.Close()
+
+	// Receive blocks on the connection regardless of ctx, so closing the
+	// subscription is what ends it
+	stop := context.AfterFunc(ctx, func() { pubsub.Close() })
+	defer stop()
+
+	for {
+		msg, err := pubsub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error receiving mailbox creations: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if d.filter.Load() == nil {
+				continue
+			}
+			if err := d.RefreshFilter(); err != nil {
+				log.Printf("Error rebuilding recipient filter: %v", err)
+			}
+		case *redis.Message:
+			d.add(msg.Payload)
+			if err := d.Invalidate(ctx, msg.Payload); err != nil {
+				log.Printf("Error invalidating cached mailbox %s: %v", msg.Payload, err)
+			}
+		}
+	}
+}
+
+// add puts address in the filter, and in the one being built if a rebuild
+// is under way.
+func (d *Directory) add(address string) {
+	address = strings.ToLower(address)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if f := d.filter.Load(); f != nil {
+		f.Add(address)
+	}
+	if d.refreshing > 0 {
+		d.pending = append(d.pending, address)
+	}
+}
+
+// RefreshFilter rebuilds the Bloom filter from every mailbox address.
+func (d *Directory) RefreshFilter() error {
+	d.mu.Lock()
+	d.refreshing++
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		if d.refreshing--; d.refreshing == 0 {
+			d.pending = nil
+		}
+		d.mu.Unlock()
+	}()
+
+	addresses, err := d.db.ListMailboxAddresses()
+	if err != nil {
+		return err
+	}
+
+	// Leave headroom so mailboxes added between rebuilds don't push the
+	// false positive rate up too quickly
+	f := newBloomFilter(len(addresses)*2, 0.001)
+	for _, address := range addresses {
+		f.Add(strings.ToLower(address))
+	}
+
+	d.mu.Lock()
+	for _, address := range d.pending {
+		f.Add(address)
+	}
+	d.filter.Store(f)
+	d.mu.Unlock()
+	return nil
+}
+
+// RunFilter keeps the Bloom filter fresh until ctx is cancelled. Until the
+// first successful build, lookups fall through to the cache.
+func (d *Directory) RunFilter(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.RefreshFilter(); err != nil {
+			log.Printf("Error rebuilding recipient filter: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func cacheKey(address string) string {
+	return fmt.Sprintf("mailbox:%s", address)
+}
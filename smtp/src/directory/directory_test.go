@@ -0,0 +1,212 @@
+package directory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mymail/smtp/src/storage"
+)
+
+// fakeStore serves mailboxes from a map. If block is set, ListMailboxAddresses
+// signals listing and then waits for block to be closed before answering.
+type fakeStore struct {
+	mu        sync.Mutex
+	mailboxes map[string]*storage.Mailbox
+	lists     int
+
+	listing chan struct{}
+	block   chan struct{}
+}
+
+func (s *fakeStore) FindMailbox(address string) (*storage.Mailbox, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mailboxes[address], nil
+}
+
+func (s *fakeStore) ListMailboxAddresses() ([]string, error) {
+	s.mu.Lock()
+	var addresses []string
+	for address := range s.mailboxes {
+		addresses = append(addresses, address)
+	}
+	s.lists++
+	s.mu.Unlock()
+
+	if s.block != nil {
+		s.listing <- struct{}{}
+		<-s.block
+	}
+	return addresses, nil
+}
+
+func (s *fakeStore) create(address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mailboxes[address] = &storage.Mailbox{ID: "mbx-" + address, Address: address}
+}
+
+func (s *fakeStore) listCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lists
+}
+
+func newTestDirectory(t *testing.T, addresses ...string) (*Directory, *fakeStore, *miniredis.Miniredis) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	r, err := storage.NewRedis("redis://" + m.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	store := &fakeStore{mailboxes: make(map[string]*storage.Mailbox)}
+	for _, address := range addresses {
+		store.create(address)
+	}
+	d := &Directory{db: store, redis: r, ttl: time.Hour, negativeTTL: time.Minute}
+	return d, store, m
+}
+
+func TestBloomFilterNoFalseNegatives(t *testing.T) {
+	const n = 10000
+	f := newBloomFilter(n, 0.001)
+	for i := 0; i < n; i++ {
+		f.Add(fmt.Sprintf("user%d@example.com", i))
+	}
+
+	for i := 0; i < n; i++ {
+		if address := fmt.Sprintf("user%d@example.com", i); !f.MayContain(address) {
+			t.Fatalf("MayContain(%s) = false for an added address", address)
+		}
+	}
+
+	// Sized for n, the false positive rate should stay near 0.1%
+	positives := 0
+	for i := 0; i < n; i++ {
+		if f.MayContain(fmt.Sprintf("other%d@example.com", i)) {
+			positives++
+		}
+	}
+	if positives > n/100 {
+		t.Errorf("%d false positives in %d lookups", positives, n)
+	}
+}
+
+func TestLookupThroughFilter(t *testing.T) {
+	ctx := context.Background()
+	d, _, m := newTestDirectory(t, "bob@example.com")
+	if err := d.RefreshFilter(); err != nil {
+		t.Fatal(err)
+	}
+
+	mailbox, err := d.Lookup(ctx, "Bob@Example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mailbox == nil || mailbox.Address != "bob@example.com" {
+		t.Errorf("Lookup(Bob@Example.com) = %+v", mailbox)
+	}
+
+	// A filter miss is answered without caching anything
+	mailbox, err = d.Lookup(ctx, "nobody@example.com")
+	if err != nil || mailbox != nil {
+		t.Errorf("Lookup(nobody@example.com) = %+v, %v", mailbox, err)
+	}
+	if m.Exists(cacheKey("nobody@example.com")) {
+		t.Error("a filter miss was cached")
+	}
+}
+
+// A mailbox created while the filter is rebuilt mustn't be lost when the
+// rebuilt filter, listed before it existed, replaces the old one.
+func TestAddDuringRefresh(t *testing.T) {
+	d, store, _ := newTestDirectory(t, "bob@example.com")
+	if err := d.RefreshFilter(); err != nil {
+		t.Fatal(err)
+	}
+
+	store.listing = make(chan struct{})
+	store.block = make(chan struct{})
+	done := make(chan error)
+	go func() { done <- d.RefreshFilter() }()
+
+	<-store.listing
+	store.create("carol@example.com")
+	d.Remember(context.Background(), store.mailboxes["carol@example.com"])
+	close(store.block)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	f := d.filter.Load()
+	for _, address := range []string{"bob@example.com", "carol@example.com"} {
+		if !f.MayContain(address) {
+			t.Errorf("%s missing from the rebuilt filter", address)
+		}
+	}
+	if len(d.pending) != 0 {
+		t.Errorf("pending = %v after the rebuild", d.pending)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, store, m := newTestDirectory(t, "bob@example.com")
+	if err := d.RefreshFilter(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache a miss for the address about to be created
+	if mailbox, err := d.Lookup(ctx, "carol@example.com"); err != nil || mailbox != nil {
+		t.Fatalf("Lookup(carol@example.com) = %+v, %v", mailbox, err)
+	}
+	store.create("carol@example.com")
+
+	done := make(chan struct{})
+	go func() {
+		d.Watch(ctx)
+		close(done)
+	}()
+
+	// Subscribing rebuilds the filter, as creations may have been missed
+	waitFor(t, "the subscription", func() bool {
+		return m.PubSubNumSub(CreatedChannel)[CreatedChannel] == 1 && store.listCount() == 2
+	})
+
+	store.create("dave@example.com")
+	m.Publish(CreatedChannel, "Dave@Example.com")
+	m.Publish(CreatedChannel, "carol@example.com")
+	waitFor(t, "the creations", func() bool {
+		return d.filter.Load().MayContain("dave@example.com") && !m.Exists(cacheKey("carol@example.com"))
+	})
+
+	mailbox, err := d.Lookup(ctx, "carol@example.com")
+	if err != nil || mailbox == nil {
+		t.Errorf("Lookup(carol@example.com) = %+v, %v after its creation", mailbox, err)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch didn't return after cancellation")
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
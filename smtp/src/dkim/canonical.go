@@ -0,0 +1,135 @@
+package dkim
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Canonicalization algorithms (RFC 6376 section 3.4).
+const (
+	Simple  = "simple"
+	Relaxed = "relaxed"
+)
+
+// canonicalizeHeader returns one header field in the given canonical form.
+// raw is the field exactly as received, folding and trailing CRLF included.
+func canonicalizeHeader(raw, algorithm string) string {
+	if algorithm != Relaxed {
+		return raw
+	}
+
+	i := strings.IndexByte(raw, ':')
+	if i < 0 {
+		return raw
+	}
+	name := strings.ToLower(strings.TrimRight(raw[:i], " \t"))
+
+	value := strings.NewReplacer("\r\n", "", "\n", "").Replace(raw[i+1:])
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+
+	return name + ":" + value + "\r\n"
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// bodyHasher canonicalizes a message body as it is written and feeds the
+// result to w, so the body never has to be held in memory. Trailing empty
+// lines are held back until non-empty content shows up, since both
+// algorithms drop them at the end of the body.
+type bodyHasher struct {
+	w       io.Writer
+	relaxed bool
+	limit   int64 // -1 for no l= tag
+	written int64
+	partial []byte
+	empty   int
+	nonZero bool
+}
+
+func newBodyHasher(w io.Writer, algorithm string, limit int64) *bodyHasher {
+	return &bodyHasher{w: w, relaxed: algorithm == Relaxed, limit: limit}
+}
+
+func (b *bodyHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			b.partial = append(b.partial, p...)
+			break
+		}
+		line := append(b.partial, p[:i]...)
+		b.partial = b.partial[:0]
+		b.line(bytes.TrimSuffix(line, []byte("\r")))
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Close flushes the final unterminated line, if any. Held-back empty lines
+// are discarded.
+func (b *bodyHasher) Close() error {
+	if len(b.partial) > 0 {
+		b.line(bytes.TrimSuffix(b.partial, []byte("\r")))
+		b.partial = nil
+	}
+
+	// An empty body is a single CRLF under simple canonicalization
+	if !b.relaxed && !b.nonZero {
+		b.emit([]byte("\r\n"))
+	}
+	return nil
+}
+
+func (b *bodyHasher) line(line []byte) {
+	if b.relaxed {
+		line = relaxLine(line)
+	}
+	if len(line) == 0 {
+		b.empty++
+		return
+	}
+
+	for ; b.empty > 0; b.empty-- {
+		b.emit([]byte("\r\n"))
+	}
+	b.emit(line)
+	b.emit([]byte("\r\n"))
+	b.nonZero = true
+}
+
+func (b *bodyHasher) emit(p []byte) {
+	if b.limit >= 0 {
+		remaining := b.limit - b.written
+		if remaining <= 0 {
+			return
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	b.w.Write(p)
+	b.written += int64(len(p))
+}
+
+// relaxLine reduces runs of whitespace to one space and strips trailing
+// whitespace (RFC 6376 section 3.4.4).
+func relaxLine(line []byte) []byte {
+	out := make([]byte, 0, len(line))
+	inWSP := false
+	for _, c := range line {
+		if c == ' ' || c == '\t' {
+			inWSP = true
+			continue
+		}
+		if inWSP {
+			out = append(out, ' ')
+			inWSP = false
+		}
+		out = append(out, c)
+	}
+	return out
+}
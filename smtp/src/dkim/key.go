@@ -0,0 +1,134 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/mymail/smtp/src/dns"
+)
+
+// minRSABits is the smallest RSA key accepted for verification (RFC 8301).
+const minRSABits = 1024
+
+// publicKey is a key record published at <selector>._domainkey.<domain>.
+type publicKey struct {
+	keyType  string
+	key      crypto.PublicKey
+	hashes   []string
+	testing  bool
+	strictID bool
+}
+
+// lookupKey fetches and parses the key record for a signature. Errors are
+// classified into temperror (DNS trouble) and permerror (bad or missing key).
+func lookupKey(ctx context.Context, resolver dns.Resolver, selector, domain string) (*publicKey, error) {
+	name := selector + "._domainkey." + domain
+	txts, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, permErrorf("no key record at %s", name)
+		}
+		return nil, tempErrorf("key lookup for %s: %v", name, err)
+	}
+	if len(txts) == 0 {
+		return nil, permErrorf("no key record at %s", name)
+	}
+
+	return parseKeyRecord(txts[0])
+}
+
+func parseKeyRecord(record string) (*publicKey, error) {
+	tags, err := parseTagList(record)
+	if err != nil {
+		return nil, permErrorf("malformed key record: %v", err)
+	}
+
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, permErrorf("unsupported key version %q", v)
+	}
+
+	pk := &publicKey{keyType: "rsa"}
+	if k, ok := tags["k"]; ok {
+		pk.keyType = strings.ToLower(k)
+	}
+	if h, ok := tags["h"]; ok {
+		for _, hash := range strings.Split(h, ":") {
+			pk.hashes = append(pk.hashes, strings.ToLower(strings.TrimSpace(hash)))
+		}
+	}
+	for _, flag := range strings.Split(tags["t"], ":") {
+		switch strings.TrimSpace(flag) {
+		case "y":
+			pk.testing = true
+		case "s":
+			pk.strictID = true
+		}
+	}
+
+	p, ok := tags["p"]
+	if !ok {
+		return nil, permErrorf("key record has no p= tag")
+	}
+	p = stripWSP(p)
+	if p == "" {
+		return nil, permErrorf("key revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, permErrorf("malformed p= tag")
+	}
+
+	switch pk.keyType {
+	case "rsa":
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			// Some publishers put a bare PKCS#1 key in p=
+			rsaKey, err2 := x509.ParsePKCS1PublicKey(der)
+			if err2 != nil {
+				return nil, permErrorf("malformed RSA key: %v", err)
+			}
+			key = rsaKey
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, permErrorf("key is not RSA")
+		}
+		if rsaKey.N.BitLen() < minRSABits {
+			return nil, permErrorf("RSA key too short (%d bits)", rsaKey.N.BitLen())
+		}
+		pk.key = rsaKey
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, permErrorf("malformed Ed25519 key")
+		}
+		pk.key = ed25519.PublicKey(der)
+	default:
+		return nil, permErrorf("unsupported key type %q", pk.keyType)
+	}
+
+	return pk, nil
+}
+
+// keyError carries a verification failure classified as temperror or permerror.
+type keyError struct {
+	result Result
+	reason string
+}
+
+func (e *keyError) Error() string {
+	return e.reason
+}
+
+func permErrorf(format string, args ...interface{}) error {
+	return &keyError{result: PermError, reason: fmt.Sprintf(format, args...)}
+}
+
+func tempErrorf(format string, args ...interface{}) error {
+	return &keyError{result: TempError, reason: fmt.Sprintf(format, args...)}
+}
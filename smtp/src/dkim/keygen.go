@@ -0,0 +1,97 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+)
+
+// Key types accepted by GenerateKey, named as in the k= tag of key records.
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// GenerateKey creates a signing key of the given type. bits is only used for
+// RSA and must be at least 2048, as RFC 8301 recommends for signers.
+func GenerateKey(keyType string, bits int) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case KeyTypeRSA:
+		if bits < 2048 {
+			return nil, fmt.Errorf("RSA keys must be at least 2048 bits")
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", keyType)
+}
+
+// MarshalPrivateKey encodes a signing key as a PKCS#8 PEM block.
+func MarshalPrivateKey(key crypto.Signer) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// ParsePrivateKey decodes a PEM private key in PKCS#8 or, for RSA keys made
+// with older tools, PKCS#1 form.
+func ParsePrivateKey(data string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("malformed private key: %w", err)
+	}
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", parsed)
+}
+
+// KeyType returns the k= tag value for a signing key.
+func KeyType(key crypto.Signer) string {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return KeyTypeEd25519
+	}
+	return KeyTypeRSA
+}
+
+// PublicKeyData returns the p= tag value for a signing key: the raw 32-byte
+// key for Ed25519 (RFC 8463) and SubjectPublicKeyInfo for RSA.
+func PublicKeyData(key crypto.Signer) (string, error) {
+	switch pub := key.Public().(type) {
+	case ed25519.PublicKey:
+		return base64.StdEncoding.EncodeToString(pub), nil
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(der), nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
+
+// TXTRecord returns the key record to publish at
+// <selector>._domainkey.<domain> for a key of the given type.
+func TXTRecord(keyType, publicKey string) string {
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", keyType, publicKey)
+}
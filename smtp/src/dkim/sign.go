@@ -0,0 +1,192 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// SignedHeaders are the fields signed when present. From is listed twice so
+// a second From can't be added without breaking the signature.
+var SignedHeaders = []string{
+	"From", "From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Message-ID", "In-Reply-To", "References", "MIME-Version",
+	"Content-Type", "Content-Transfer-Encoding", "List-Unsubscribe",
+}
+
+// SigningKey is a private key published under Selector for Domain.
+type SigningKey struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+}
+
+// Algorithm returns the DKIM algorithm name for the key.
+func (k *SigningKey) Algorithm() string {
+	if _, ok := k.Key.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+// Signer produces DKIM-Signature fields for a message with one or more keys,
+// for example an RSA and an Ed25519 key, or an old and a new key while a
+// rotation is in progress. Like Verifier, the message is written to it as it
+// streams past and only the header block is buffered.
+type Signer struct {
+	keys []*SigningKey
+
+	header   []byte
+	inBody   bool
+	overflow bool
+	fields   []string
+	bodyHash hash.Hash
+	body     *bodyHasher
+}
+
+func NewSigner(keys []*SigningKey) *Signer {
+	s := &Signer{keys: keys, bodyHash: sha256.New()}
+	s.body = newBodyHasher(s.bodyHash, Relaxed, -1)
+	return s
+}
+
+func (s *Signer) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if !s.inBody {
+		if s.overflow {
+			return n, nil
+		}
+
+		s.header = append(s.header, p...)
+		end, bodyStart := headerEnd(s.header)
+		if end < 0 {
+			if len(s.header) > maxHeaderBytes {
+				s.overflow = true
+				s.header = nil
+			}
+			return n, nil
+		}
+
+		body := s.header[bodyStart:]
+		s.header = s.header[:end]
+		s.startBody()
+		p = body
+	}
+
+	s.body.Write(p)
+	return n, nil
+}
+
+func (s *Signer) startBody() {
+	s.inBody = true
+	s.fields = splitFields(s.header)
+	s.header = nil
+}
+
+// Sign finishes hashing and returns one DKIM-Signature field per key, each
+// ending in CRLF, ready to be prepended to the message.
+func (s *Signer) Sign() (string, error) {
+	if !s.inBody && !s.overflow {
+		s.startBody()
+	}
+	if s.overflow {
+		return "", fmt.Errorf("header block too large to sign")
+	}
+	s.body.Close()
+
+	bodyHash := base64.StdEncoding.EncodeToString(s.bodyHash.Sum(nil))
+	headers := s.presentHeaders()
+	now := time.Now().Unix()
+
+	var out strings.Builder
+	for _, key := range s.keys {
+		field := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n"+
+			"\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+			key.Algorithm(), key.Domain, key.Selector, now, strings.Join(headers, ":"), bodyHash)
+
+		sig, err := s.signOne(key, headers, field)
+		if err != nil {
+			return "", fmt.Errorf("signing with %s._domainkey.%s: %w", key.Selector, key.Domain, err)
+		}
+		out.WriteString(field)
+		out.WriteString(fold(base64.StdEncoding.EncodeToString(sig)))
+		out.WriteString("\r\n")
+	}
+	return out.String(), nil
+}
+
+// presentHeaders lists SignedHeaders as they apply to this message: each
+// name once per instance present, plus the extra From for oversigning.
+func (s *Signer) presentHeaders() []string {
+	counts := make(map[string]int)
+	for _, field := range s.fields {
+		if i := strings.IndexByte(field, ':'); i > 0 {
+			counts[strings.ToLower(strings.TrimSpace(field[:i]))]++
+		}
+	}
+
+	var headers []string
+	seen := make(map[string]bool)
+	for _, name := range SignedHeaders {
+		lower := strings.ToLower(name)
+		if seen[lower] {
+			headers = append(headers, lower)
+			continue
+		}
+		seen[lower] = true
+		for i := 0; i < counts[lower]; i++ {
+			headers = append(headers, lower)
+		}
+	}
+	return headers
+}
+
+func (s *Signer) signOne(key *SigningKey, headers []string, field string) ([]byte, error) {
+	h := sha256.New()
+
+	used := make(map[int]bool)
+	for _, name := range headers {
+		for i := len(s.fields) - 1; i >= 0; i-- {
+			if used[i] || !isField(s.fields[i], name) {
+				continue
+			}
+			used[i] = true
+			h.Write([]byte(canonicalizeHeader(s.fields[i], Relaxed)))
+			break
+		}
+	}
+	self := canonicalizeHeader(field, Relaxed)
+	h.Write([]byte(strings.TrimSuffix(self, "\r\n")))
+	digest := h.Sum(nil)
+
+	switch k := key.Key.(type) {
+	case ed25519.PrivateKey:
+		// RFC 8463 signs the SHA-256 digest with PureEdDSA
+		return ed25519.Sign(k, digest), nil
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest)
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key.Key)
+}
+
+// fold breaks a long base64 value into continuation lines.
+func fold(value string) string {
+	const width = 72
+
+	var b strings.Builder
+	for len(value) > width {
+		b.WriteString(value[:width])
+		b.WriteString("\r\n\t ")
+		value = value[width:]
+	}
+	b.WriteString(value)
+	return b.String()
+}
@@ -0,0 +1,149 @@
+package dkim
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mymail/smtp/src/dns"
+)
+
+// testSigningKeys returns an RSA and an Ed25519 key for example.com and a
+// resolver publishing both.
+func testSigningKeys(t *testing.T) ([]*SigningKey, *dns.Static) {
+	t.Helper()
+	resolver := &dns.Static{TXT: make(map[string][]string)}
+
+	var keys []*SigningKey
+	for _, keyType := range []string{KeyTypeRSA, KeyTypeEd25519} {
+		key, err := GenerateKey(keyType, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := PublicKeyData(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolver.TXT[keyType+"._domainkey.example.com"] = []string{TXTRecord(keyType, pub)}
+		keys = append(keys, &SigningKey{Domain: "example.com", Selector: keyType, Key: key})
+	}
+	return keys, resolver
+}
+
+func signMessage(t *testing.T, keys []*SigningKey, message string) string {
+	t.Helper()
+	s := NewSigner(keys)
+	// Split the header across writes to exercise buffering
+	s.Write([]byte(message[:10]))
+	s.Write([]byte(message[10:]))
+	fields, err := s.Sign()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+// verifyAll returns each signature's result by selector.
+func verifyAll(resolver dns.Resolver, message string) map[string]SignatureResult {
+	v := NewVerifier(resolver)
+	v.Write([]byte(message))
+	results := make(map[string]SignatureResult)
+	for _, r := range v.Verify(context.Background()) {
+		results[r.Selector] = r
+	}
+	return results
+}
+
+func TestSignerRoundTrip(t *testing.T) {
+	keys, resolver := testSigningKeys(t)
+	message := testHeader + "\r\n" + testBody
+
+	for _, key := range keys {
+		t.Run(key.Selector, func(t *testing.T) {
+			fields := signMessage(t, []*SigningKey{key}, message)
+
+			got := verifyAll(resolver, fields+message)
+			if r := got[key.Selector]; len(got) != 1 || r.Result != Pass || r.Algorithm != key.Algorithm() {
+				t.Errorf("Verify() = %+v, want one %s pass", got, key.Algorithm())
+			}
+		})
+	}
+}
+
+// Both keys sign in one pass, as a domain with an RSA and an Ed25519 key
+// does.
+func TestSignerDualSignature(t *testing.T) {
+	keys, resolver := testSigningKeys(t)
+	message := testHeader + "\r\n" + testBody
+
+	fields := signMessage(t, keys, message)
+	if n := strings.Count(fields, "DKIM-Signature:"); n != 2 {
+		t.Fatalf("Sign() returned %d fields, want 2", n)
+	}
+
+	got := verifyAll(resolver, fields+message)
+	for _, key := range keys {
+		if r := got[key.Selector]; r.Result != Pass {
+			t.Errorf("%s: Verify() = %s (%s), want %s", key.Selector, r.Result, r.Reason, Pass)
+		}
+	}
+}
+
+func TestSignerOversignsFrom(t *testing.T) {
+	keys, resolver := testSigningKeys(t)
+	message := testHeader + "\r\n" + testBody
+
+	for _, key := range keys {
+		t.Run(key.Selector, func(t *testing.T) {
+			fields := signMessage(t, []*SigningKey{key}, message)
+			sig, err := parseSignature(strings.TrimSuffix(fields, "\r\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(sig.Headers, ":"); got != "from:from:subject:to" {
+				t.Errorf("h= %s, want from:from:subject:to", got)
+			}
+
+			// A From added after signing takes the place of the null one
+			// signed in its stead
+			forged := fields + "From: mallory@example.org\r\n" + message
+			if r := verifyAll(resolver, forged)[key.Selector]; r.Result != Fail {
+				t.Errorf("Verify() with a second From = %s (%s), want %s", r.Result, r.Reason, Fail)
+			}
+		})
+	}
+}
+
+func TestSignerFoldsSignature(t *testing.T) {
+	keys, resolver := testSigningKeys(t)
+	message := testHeader + "\r\n" + testBody
+	sizes := map[string]int{KeyTypeRSA: 256, KeyTypeEd25519: 64}
+
+	for _, key := range keys {
+		t.Run(key.Selector, func(t *testing.T) {
+			fields := signMessage(t, []*SigningKey{key}, message)
+
+			_, b, _ := strings.Cut(fields, "\tb=")
+			lines := strings.Split(strings.TrimSuffix(b, "\r\n"), "\r\n")
+			if len(lines) < 2 {
+				t.Fatalf("b= not folded: %q", b)
+			}
+			for _, line := range lines {
+				if len(line) > 78 {
+					t.Errorf("line of %d bytes in b=: %q", len(line), line)
+				}
+			}
+
+			sig, err := parseSignature(strings.TrimSuffix(fields, "\r\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sig.Signature) != sizes[key.Selector] {
+				t.Errorf("b= decodes to %d bytes, want %d", len(sig.Signature), sizes[key.Selector])
+			}
+			if r := verifyAll(resolver, fields+message)[key.Selector]; r.Result != Pass {
+				t.Errorf("Verify() = %s (%s), want %s", r.Result, r.Reason, Pass)
+			}
+		})
+	}
+}
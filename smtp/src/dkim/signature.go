@@ -0,0 +1,187 @@
+package dkim
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signature is a parsed DKIM-Signature header field (RFC 6376 section 3.5).
+type Signature struct {
+	Algorithm       string
+	Signature       []byte
+	BodyHash        []byte
+	HeaderCanon     string
+	BodyCanon       string
+	Domain          string
+	Headers         []string
+	Identity        string
+	BodyLength      int64 // -1 when l= is absent
+	Selector        string
+	Timestamp       time.Time
+	Expiration      time.Time
+	raw             string
+	rawWithoutValue string
+}
+
+// parseTagList splits a "tag=value; tag=value" list. Whitespace around tags
+// and values is dropped; duplicate tags are an error.
+func parseTagList(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.IndexByte(part, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed tag %q", part)
+		}
+		name := strings.TrimSpace(part[:i])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(part[i+1:])
+	}
+	return tags, nil
+}
+
+// stripWSP removes all folding whitespace, for base64 tag values.
+func stripWSP(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// parseSignature parses the raw DKIM-Signature field (name included).
+func parseSignature(raw string) (*Signature, error) {
+	i := strings.IndexByte(raw, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("malformed header")
+	}
+
+	tags, err := parseTagList(raw[i+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[required]; !ok {
+			return nil, fmt.Errorf("missing required tag %s=", required)
+		}
+	}
+	if tags["v"] != "1" {
+		return nil, fmt.Errorf("unsupported version %q", tags["v"])
+	}
+
+	sig := &Signature{
+		Algorithm:  strings.ToLower(tags["a"]),
+		Domain:     strings.ToLower(stripWSP(tags["d"])),
+		Selector:   stripWSP(tags["s"]),
+		BodyLength: -1,
+		raw:        raw,
+	}
+
+	if sig.Signature, err = base64.StdEncoding.DecodeString(stripWSP(tags["b"])); err != nil {
+		return nil, fmt.Errorf("malformed b= tag")
+	}
+	if sig.BodyHash, err = base64.StdEncoding.DecodeString(stripWSP(tags["bh"])); err != nil {
+		return nil, fmt.Errorf("malformed bh= tag")
+	}
+
+	sig.HeaderCanon, sig.BodyCanon = Simple, Simple
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(strings.ToLower(c), "/", 2)
+		sig.HeaderCanon = parts[0]
+		if len(parts) == 2 {
+			sig.BodyCanon = parts[1]
+		}
+		for _, canon := range []string{sig.HeaderCanon, sig.BodyCanon} {
+			if canon != Simple && canon != Relaxed {
+				return nil, fmt.Errorf("unknown canonicalization %q", c)
+			}
+		}
+	}
+
+	hasFrom := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(stripWSP(name))
+		if name == "" {
+			continue
+		}
+		if strings.EqualFold(name, "From") {
+			hasFrom = true
+		}
+		sig.Headers = append(sig.Headers, name)
+	}
+	if !hasFrom {
+		return nil, fmt.Errorf("h= does not include From")
+	}
+
+	sig.Identity = "@" + sig.Domain
+	if id, ok := tags["i"]; ok {
+		sig.Identity = stripWSP(id)
+		at := strings.LastIndexByte(sig.Identity, '@')
+		if at < 0 {
+			return nil, fmt.Errorf("malformed i= tag")
+		}
+		idDomain := strings.ToLower(sig.Identity[at+1:])
+		if idDomain != sig.Domain && !strings.HasSuffix(idDomain, "."+sig.Domain) {
+			return nil, fmt.Errorf("i= domain is not within d=")
+		}
+	}
+
+	if l, ok := tags["l"]; ok {
+		if sig.BodyLength, err = strconv.ParseInt(stripWSP(l), 10, 64); err != nil || sig.BodyLength < 0 {
+			return nil, fmt.Errorf("malformed l= tag")
+		}
+	}
+	if t, ok := tags["t"]; ok {
+		n, err := strconv.ParseInt(stripWSP(t), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed t= tag")
+		}
+		sig.Timestamp = time.Unix(n, 0)
+	}
+	if x, ok := tags["x"]; ok {
+		n, err := strconv.ParseInt(stripWSP(x), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed x= tag")
+		}
+		sig.Expiration = time.Unix(n, 0)
+	}
+
+	sig.rawWithoutValue = removeSignatureValue(raw)
+	return sig, nil
+}
+
+// removeSignatureValue blanks the b= tag value, which is how the signature
+// header itself is fed into the header hash (RFC 6376 section 3.7).
+func removeSignatureValue(raw string) string {
+	i := strings.IndexByte(raw, ':')
+	rest := raw[i+1:]
+
+	offset := 0
+	for {
+		semi := strings.IndexByte(rest[offset:], ';')
+		end := len(rest)
+		if semi >= 0 {
+			end = offset + semi
+		}
+
+		tag := rest[offset:end]
+		if eq := strings.IndexByte(tag, '='); eq >= 0 && strings.TrimSpace(tag[:eq]) == "b" {
+			return raw[:i+1] + rest[:offset+eq+1] + rest[end:]
+		}
+
+		if semi < 0 {
+			return raw
+		}
+		offset = end + 1
+	}
+}
@@ -0,0 +1,348 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+
+	"github.com/mymail/smtp/src/dns"
+)
+
+// Result is the outcome for one signature, using the RFC 8601 vocabulary.
+type Result string
+
+const (
+	None      Result = "none"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	Neutral   Result = "neutral"
+	Policy    Result = "policy"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+const (
+	// maxHeaderBytes caps how much of the message is buffered while looking
+	// for the end of the header block.
+	maxHeaderBytes = 1 << 20
+
+	// maxSignatures caps how many signatures are verified per message, so a
+	// message can't make us do unbounded DNS and crypto work.
+	maxSignatures = 10
+)
+
+// SignatureResult is the verification outcome for one DKIM-Signature.
+type SignatureResult struct {
+	Domain    string `json:"domain"`
+	Selector  string `json:"selector"`
+	Identity  string `json:"identity,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Result    Result `json:"result"`
+	Reason    string `json:"reason,omitempty"`
+	// HeaderB is the start of the b= value, used to tell signatures apart
+	// in Authentication-Results (RFC 6008).
+	HeaderB string `json:"header_b,omitempty"`
+}
+
+// Verifier checks every DKIM signature on a message while it streams past.
+// Write the whole message to it (for example through an io.TeeReader on the
+// upload stream), then call Verify. Only the header block is buffered; the
+// body is canonicalized and hashed on the fly for each signature.
+type Verifier struct {
+	resolver dns.Resolver
+
+	header   []byte
+	inBody   bool
+	overflow bool
+	fields   []string
+	sigs     []*pending
+}
+
+type pending struct {
+	sig       *Signature
+	err       error
+	bodyHash  hash.Hash
+	canonBody *bodyHasher
+}
+
+func NewVerifier(resolver dns.Resolver) *Verifier {
+	return &Verifier{resolver: resolver}
+}
+
+func (v *Verifier) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if !v.inBody {
+		if v.overflow {
+			return n, nil
+		}
+
+		v.header = append(v.header, p...)
+		end, bodyStart := headerEnd(v.header)
+		if end < 0 {
+			if len(v.header) > maxHeaderBytes {
+				v.overflow = true
+				v.header = nil
+			}
+			return n, nil
+		}
+
+		body := v.header[bodyStart:]
+		v.header = v.header[:end]
+		v.startBody()
+		p = body
+	}
+
+	for _, s := range v.sigs {
+		if s.canonBody != nil {
+			s.canonBody.Write(p)
+		}
+	}
+	return n, nil
+}
+
+// headerEnd finds the blank line ending the header block. It returns the
+// length of the header (including the last field's line ending) and the
+// offset of the body, or -1 if the blank line hasn't arrived yet.
+func headerEnd(b []byte) (int, int) {
+	if bytes.HasPrefix(b, []byte("\r\n")) {
+		return 0, 2
+	}
+	if bytes.HasPrefix(b, []byte("\n")) {
+		return 0, 1
+	}
+	if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+		return i + 2, i + 4
+	}
+	if i := bytes.Index(b, []byte("\n\n")); i >= 0 {
+		return i + 1, i + 2
+	}
+	return -1, -1
+}
+
+// startBody splits the buffered header into fields and prepares a body
+// hasher for each DKIM-Signature found.
+func (v *Verifier) startBody() {
+	v.inBody = true
+	v.fields = splitFields(v.header)
+	v.header = nil
+
+	for _, field := range v.fields {
+		if !isField(field, "DKIM-Signature") {
+			continue
+		}
+		if len(v.sigs) >= maxSignatures {
+			break
+		}
+
+		s := &pending{}
+		s.sig, s.err = parseSignature(field)
+		if s.err == nil {
+			switch s.sig.Algorithm {
+			case "rsa-sha256", "ed25519-sha256":
+				s.bodyHash = sha256.New()
+				s.canonBody = newBodyHasher(s.bodyHash, s.sig.BodyCanon, s.sig.BodyLength)
+			default:
+				// rsa-sha1 must not be considered valid (RFC 8301)
+				s.err = fmt.Errorf("unsupported algorithm %q", s.sig.Algorithm)
+			}
+		}
+		v.sigs = append(v.sigs, s)
+	}
+}
+
+// splitFields splits a header block into raw fields, keeping folded
+// continuation lines with their field and normalizing line endings to CRLF.
+func splitFields(header []byte) []string {
+	var fields []string
+	var current strings.Builder
+
+	for _, line := range strings.SplitAfter(string(header), "\n") {
+		if line == "" {
+			continue
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r") + "\r\n"
+
+		if (line[0] == ' ' || line[0] == '\t') && current.Len() > 0 {
+			current.WriteString(line)
+			continue
+		}
+		if current.Len() > 0 {
+			fields = append(fields, current.String())
+			current.Reset()
+		}
+		current.WriteString(line)
+	}
+	if current.Len() > 0 {
+		fields = append(fields, current.String())
+	}
+	return fields
+}
+
+func isField(field, name string) bool {
+	i := strings.IndexByte(field, ':')
+	return i > 0 && strings.EqualFold(strings.TrimSpace(field[:i]), name)
+}
+
+// Verify finishes body hashing and checks each signature. It returns one
+// result per DKIM-Signature field, in header order; a message with no
+// signatures yields no results.
+func (v *Verifier) Verify(ctx context.Context) []SignatureResult {
+	if !v.inBody && !v.overflow {
+		// Message without a body: whatever we have is the header
+		v.startBody()
+	}
+
+	if v.overflow {
+		return []SignatureResult{{Result: PermError, Reason: "header block too large"}}
+	}
+
+	results := make([]SignatureResult, 0, len(v.sigs))
+	for _, s := range v.sigs {
+		if s.canonBody != nil {
+			s.canonBody.Close()
+		}
+		results = append(results, v.verifyOne(ctx, s))
+	}
+	return results
+}
+
+func (v *Verifier) verifyOne(ctx context.Context, s *pending) SignatureResult {
+	if s.err != nil {
+		r := SignatureResult{Result: PermError, Reason: s.err.Error()}
+		if s.sig != nil {
+			r.Domain, r.Selector, r.Algorithm = s.sig.Domain, s.sig.Selector, s.sig.Algorithm
+		}
+		return r
+	}
+
+	sig := s.sig
+	r := SignatureResult{
+		Domain:    sig.Domain,
+		Selector:  sig.Selector,
+		Identity:  sig.Identity,
+		Algorithm: sig.Algorithm,
+		HeaderB:   headerB(sig.Signature),
+	}
+
+	if !sig.Expiration.IsZero() && sig.Expiration.Before(time.Now()) {
+		r.Result, r.Reason = PermError, "signature expired"
+		return r
+	}
+
+	key, err := lookupKey(ctx, v.resolver, sig.Selector, sig.Domain)
+	if err != nil {
+		r.Result, r.Reason = classify(err)
+		return r
+	}
+	if err := checkKeyFits(key, sig); err != nil {
+		r.Result, r.Reason = classify(err)
+		return r
+	}
+
+	if subtle.ConstantTimeCompare(s.bodyHash.Sum(nil), sig.BodyHash) != 1 {
+		r.Result, r.Reason = Fail, "body hash did not verify"
+		return r
+	}
+
+	digest := v.headerHash(sig)
+	switch pub := key.key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig.Signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, digest, sig.Signature) {
+			err = fmt.Errorf("bad signature")
+		}
+	}
+	if err != nil {
+		r.Result, r.Reason = Fail, "signature did not verify"
+		return r
+	}
+
+	r.Result = Pass
+	if key.testing {
+		r.Reason = "key is in testing mode"
+	}
+	return r
+}
+
+// checkKeyFits rejects keys that don't match the signature's algorithm or
+// that restrict the hash or identity in ways the signature violates.
+func checkKeyFits(key *publicKey, sig *Signature) error {
+	keyType, hashAlg, _ := strings.Cut(sig.Algorithm, "-")
+	if keyType != key.keyType {
+		return permErrorf("key type %s does not match algorithm %s", key.keyType, sig.Algorithm)
+	}
+	if len(key.hashes) > 0 {
+		allowed := false
+		for _, h := range key.hashes {
+			if h == hashAlg {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return permErrorf("key does not allow %s", hashAlg)
+		}
+	}
+	if key.strictID {
+		at := strings.LastIndexByte(sig.Identity, '@')
+		if !strings.EqualFold(sig.Identity[at+1:], sig.Domain) {
+			return permErrorf("key forbids subdomain identities")
+		}
+	}
+	return nil
+}
+
+// headerHash computes the SHA-256 over the signed header fields followed by
+// the DKIM-Signature itself with an empty b= value.
+func (v *Verifier) headerHash(sig *Signature) []byte {
+	h := sha256.New()
+
+	// Each listed name consumes the bottom-most unused instance
+	used := make(map[int]bool)
+	for _, name := range sig.Headers {
+		for i := len(v.fields) - 1; i >= 0; i-- {
+			if used[i] || !isField(v.fields[i], name) {
+				continue
+			}
+			used[i] = true
+			h.Write([]byte(canonicalizeHeader(v.fields[i], sig.HeaderCanon)))
+			break
+		}
+	}
+
+	self := canonicalizeHeader(sig.rawWithoutValue, sig.HeaderCanon)
+	h.Write([]byte(strings.TrimSuffix(self, "\r\n")))
+
+	return h.Sum(nil)
+}
+
+// Fields returns the raw header fields of the message, in order, once the
+// header block has been seen.
+func (v *Verifier) Fields() []string {
+	return v.fields
+}
+
+func classify(err error) (Result, string) {
+	if ke, ok := err.(*keyError); ok {
+		return ke.result, ke.reason
+	}
+	return TempError, err.Error()
+}
+
+func headerB(sig []byte) string {
+	b := base64.StdEncoding.EncodeToString(sig)
+	if len(b) > 8 {
+		b = b[:8]
+	}
+	return b
+}
@@ -0,0 +1,230 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mymail/smtp/src/dns"
+)
+
+const (
+	testHeader = "From: Alice <alice@example.com>\r\n" +
+		"To: bob@example.net\r\n" +
+		"Subject: Lunch  on\r\n\tFriday\r\n"
+	testBody = "Are we still on for Friday?\r\n\r\nAlice\r\n"
+)
+
+// testKey returns a signing key and a resolver publishing it as
+// sel._domainkey.example.com.
+func testKey(t *testing.T) (ed25519.PrivateKey, *dns.Static) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := PublicKeyData(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &dns.Static{TXT: map[string][]string{
+		"sel._domainkey.example.com": {TXTRecord("ed25519", pub)},
+	}}
+	return key, resolver
+}
+
+// sign returns a DKIM-Signature field over header and body using the given
+// canonicalization ("header/body") and extra tags, such as l= or x=. A
+// negative limit signs the whole body.
+func sign(t *testing.T, key ed25519.PrivateKey, header, body, canon string, limit int64, extra string) string {
+	t.Helper()
+	headerCanon, bodyCanon, _ := strings.Cut(canon, "/")
+
+	bh := sha256.New()
+	hasher := newBodyHasher(bh, bodyCanon, limit)
+	hasher.Write([]byte(body))
+	hasher.Close()
+
+	field := fmt.Sprintf("DKIM-Signature: v=1; a=ed25519-sha256; c=%s; d=example.com; s=sel;\r\n"+
+		"\th=from:to:subject;%s bh=%s;\r\n\tb=",
+		canon, extra, base64.StdEncoding.EncodeToString(bh.Sum(nil)))
+
+	h := sha256.New()
+	fields := splitFields([]byte(header))
+	for _, name := range []string{"from", "to", "subject"} {
+		for _, f := range fields {
+			if isField(f, name) {
+				h.Write([]byte(canonicalizeHeader(f, headerCanon)))
+			}
+		}
+	}
+	h.Write([]byte(strings.TrimSuffix(canonicalizeHeader(field, headerCanon), "\r\n")))
+
+	return field + base64.StdEncoding.EncodeToString(ed25519.Sign(key, h.Sum(nil))) + "\r\n"
+}
+
+func verify(resolver dns.Resolver, message string) SignatureResult {
+	v := NewVerifier(resolver)
+	v.Write([]byte(message))
+	results := v.Verify(context.Background())
+	if len(results) != 1 {
+		return SignatureResult{Reason: fmt.Sprintf("%d results", len(results))}
+	}
+	return results[0]
+}
+
+func TestVerify(t *testing.T) {
+	key, resolver := testKey(t)
+	expired := fmt.Sprintf(" x=%d;", time.Now().Add(-time.Hour).Unix())
+	unexpired := fmt.Sprintf(" x=%d;", time.Now().Add(time.Hour).Unix())
+	// Sign the first line of the body only
+	limit := int64(len("Are we still on for Friday?\r\n"))
+
+	tests := []struct {
+		name   string
+		canon  string
+		limit  int64
+		extra  string
+		header func(string) string
+		body   func(string) string
+		want   Result
+	}{
+		{name: "relaxed", canon: "relaxed/relaxed", want: Pass},
+		{name: "simple", canon: "simple/simple", want: Pass},
+		{
+			name:  "relaxed header survives refolding",
+			canon: "relaxed/simple",
+			header: func(h string) string {
+				return strings.Replace(h, "Subject: Lunch  on\r\n\tFriday", "subject:   Lunch on Friday", 1)
+			},
+			want: Pass,
+		},
+		{
+			name:  "simple header breaks on refolding",
+			canon: "simple/simple",
+			header: func(h string) string {
+				return strings.Replace(h, "Subject: Lunch  on\r\n\tFriday", "Subject: Lunch on Friday", 1)
+			},
+			want: Fail,
+		},
+		{
+			name:  "relaxed body survives whitespace changes",
+			canon: "relaxed/relaxed",
+			body:  func(b string) string { return strings.Replace(b, "still on", "still \t on", 1) + "\r\n\r\n" },
+			want:  Pass,
+		},
+		{
+			name:  "simple body breaks on whitespace changes",
+			canon: "relaxed/simple",
+			body:  func(b string) string { return strings.Replace(b, "still on", "still \t on", 1) },
+			want:  Fail,
+		},
+		{
+			name:  "body hash mismatch",
+			canon: "relaxed/relaxed",
+			body:  func(b string) string { return strings.Replace(b, "Friday", "Monday", 1) },
+			want:  Fail,
+		},
+		{
+			name:  "l= ignores appended content",
+			canon: "relaxed/relaxed",
+			limit: limit,
+			extra: fmt.Sprintf(" l=%d;", limit),
+			body:  func(b string) string { return b + "Unsubscribe: https://example.org/\r\n" },
+			want:  Pass,
+		},
+		{
+			name:  "l= still covers the signed part",
+			canon: "relaxed/relaxed",
+			limit: limit,
+			extra: fmt.Sprintf(" l=%d;", limit),
+			body:  func(b string) string { return strings.Replace(b, "Friday?", "Monday?", 1) },
+			want:  Fail,
+		},
+		{name: "expired x=", canon: "relaxed/relaxed", extra: expired, want: PermError},
+		{name: "unexpired x=", canon: "relaxed/relaxed", extra: unexpired, want: Pass},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit := tt.limit
+			if limit == 0 {
+				limit = -1
+			}
+			field := sign(t, key, testHeader, testBody, tt.canon, limit, tt.extra)
+
+			header, body := testHeader, testBody
+			if tt.header != nil {
+				header = tt.header(header)
+			}
+			if tt.body != nil {
+				body = tt.body(body)
+			}
+
+			got := verify(resolver, field+header+"\r\n"+body)
+			if got.Result != tt.want {
+				t.Errorf("Verify() = %s (%s), want %s", got.Result, got.Reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyMissingKey(t *testing.T) {
+	key, _ := testKey(t)
+	field := sign(t, key, testHeader, testBody, "relaxed/relaxed", -1, "")
+
+	got := verify(&dns.Static{}, field+testHeader+"\r\n"+testBody)
+	if got.Result != PermError {
+		t.Errorf("Verify() = %s (%s), want %s", got.Result, got.Reason, PermError)
+	}
+
+	failing := &dns.Static{Fail: map[string]bool{"sel._domainkey.example.com": true}}
+	got = verify(failing, field+testHeader+"\r\n"+testBody)
+	if got.Result != TempError {
+		t.Errorf("Verify() = %s (%s), want %s", got.Result, got.Reason, TempError)
+	}
+}
+
+// The example from RFC 6376 section 3.4.6.
+func TestCanonicalization(t *testing.T) {
+	header := "A: X\r\nB : Y\t\r\n\tZ  \r\n"
+	body := " C \r\nD \t E\r\n\r\n\r\n"
+
+	tests := []struct {
+		canon      string
+		wantHeader string
+		wantBody   string
+	}{
+		{Relaxed, "a:X\r\nb:Y Z\r\n", " C\r\nD E\r\n"},
+		{Simple, header, " C \r\nD \t E\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.canon, func(t *testing.T) {
+			var gotHeader strings.Builder
+			for _, f := range splitFields([]byte(header)) {
+				gotHeader.WriteString(canonicalizeHeader(f, tt.canon))
+			}
+			if gotHeader.String() != tt.wantHeader {
+				t.Errorf("header = %q, want %q", gotHeader.String(), tt.wantHeader)
+			}
+
+			var gotBody bytes.Buffer
+			hasher := newBodyHasher(&gotBody, tt.canon, -1)
+			// Split mid-line to exercise buffering across writes
+			hasher.Write([]byte(body[:5]))
+			hasher.Write([]byte(body[5:]))
+			hasher.Close()
+			if gotBody.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", gotBody.String(), tt.wantBody)
+			}
+		})
+	}
+}
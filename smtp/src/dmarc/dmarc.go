@@ -0,0 +1,250 @@
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mymail/smtp/src/dkim"
+	"github.com/mymail/smtp/src/dns"
+	"github.com/mymail/smtp/src/spf"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Result is the DMARC evaluation outcome (RFC 7489 section 11.2).
+type Result string
+
+const (
+	None      Result = "none"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Policy is a requested handling for failing mail, and also the disposition
+// we actually applied.
+type Policy string
+
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+// Record is a parsed DMARC policy record.
+type Record struct {
+	Policy          Policy
+	SubdomainPolicy Policy
+	StrictDKIM      bool
+	StrictSPF       bool
+	Percent         int
+}
+
+// Evaluation is the outcome of checking one message's RFC5322.From domain.
+type Evaluation struct {
+	Result      Result
+	Domain      string
+	Policy      Policy
+	Disposition Policy
+	SPFAligned  bool
+	DKIMAligned bool
+	Reason      string
+}
+
+// DispositionFor returns how the message should be handled for a recipient
+// domain with the given override. An empty override honors the published
+// policy; otherwise it replaces it for failing mail.
+func (e Evaluation) DispositionFor(override string) Policy {
+	if e.Result != Fail {
+		return PolicyNone
+	}
+	switch Policy(override) {
+	case PolicyNone, PolicyQuarantine, PolicyReject:
+		return Policy(override)
+	}
+	return e.Disposition
+}
+
+// Checker evaluates DMARC policies using the given DNS resolver.
+type Checker struct {
+	resolver dns.Resolver
+}
+
+func NewChecker(resolver dns.Resolver) *Checker {
+	return &Checker{resolver: resolver}
+}
+
+// Evaluate checks SPF and DKIM results for alignment with fromDomain and
+// applies the domain's published policy.
+func (c *Checker) Evaluate(ctx context.Context, fromDomain string, spfEval spf.Evaluation,
+	dkimResults []dkim.SignatureResult) Evaluation {
+	fromDomain = strings.ToLower(strings.TrimSuffix(fromDomain, "."))
+	e := Evaluation{Domain: fromDomain, Disposition: PolicyNone}
+
+	if fromDomain == "" {
+		e.Result, e.Reason = PermError, "no usable RFC5322.From domain"
+		return e
+	}
+
+	orgDomain := OrganizationalDomain(fromDomain)
+	record, err := c.lookup(ctx, fromDomain)
+	if err == nil && record == nil && orgDomain != fromDomain {
+		record, err = c.lookup(ctx, orgDomain)
+		if record != nil && record.SubdomainPolicy != "" {
+			record.Policy = record.SubdomainPolicy
+		}
+	}
+	if err != nil {
+		// DNS failures may clear up; a malformed record won't
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			e.Result, e.Reason = TempError, err.Error()
+		} else {
+			e.Result, e.Reason = PermError, err.Error()
+		}
+		return e
+	}
+	if record == nil {
+		e.Result, e.Reason = None, "no DMARC record"
+		return e
+	}
+
+	e.Policy = record.Policy
+
+	if spfEval.Result == spf.Pass && spfEval.Identity == spf.IdentityMailFrom {
+		e.SPFAligned = aligned(spfEval.Domain, fromDomain, record.StrictSPF)
+	}
+	for _, r := range dkimResults {
+		if r.Result == dkim.Pass && aligned(r.Domain, fromDomain, record.StrictDKIM) {
+			e.DKIMAligned = true
+			break
+		}
+	}
+
+	if e.SPFAligned || e.DKIMAligned {
+		e.Result = Pass
+		return e
+	}
+
+	e.Result = Fail
+	e.Reason = "neither SPF nor DKIM aligned with " + fromDomain
+	e.Disposition = sample(record.Policy, record.Percent)
+	return e
+}
+
+// lookup fetches the record at _dmarc.<domain>. It returns nil, nil when the
+// domain publishes no record.
+func (c *Checker) lookup(ctx context.Context, domain string) (*Record, error) {
+	txts, err := c.resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if dns.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, txt := range txts {
+		if !strings.HasPrefix(strings.TrimSpace(txt), "v=DMARC1") {
+			continue
+		}
+		return ParseRecord(txt)
+	}
+	return nil, nil
+}
+
+// ParseRecord parses a DMARC TXT record.
+func ParseRecord(txt string) (*Record, error) {
+	r := &Record{Percent: 100}
+
+	for i, part := range strings.Split(txt, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed DMARC tag %q", part)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+
+		if i == 0 {
+			if name != "v" || value != "DMARC1" {
+				return nil, fmt.Errorf("DMARC record must start with v=DMARC1")
+			}
+			continue
+		}
+
+		switch name {
+		case "p":
+			r.Policy = Policy(strings.ToLower(value))
+		case "sp":
+			r.SubdomainPolicy = Policy(strings.ToLower(value))
+		case "adkim":
+			r.StrictDKIM = strings.EqualFold(value, "s")
+		case "aspf":
+			r.StrictSPF = strings.EqualFold(value, "s")
+		case "pct":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > 100 {
+				return nil, fmt.Errorf("invalid pct %q", value)
+			}
+			r.Percent = n
+		}
+	}
+
+	if !validPolicy(r.Policy) {
+		return nil, fmt.Errorf("invalid or missing p= tag")
+	}
+	if r.SubdomainPolicy != "" && !validPolicy(r.SubdomainPolicy) {
+		r.SubdomainPolicy = ""
+	}
+	return r, nil
+}
+
+func validPolicy(p Policy) bool {
+	return p == PolicyNone || p == PolicyQuarantine || p == PolicyReject
+}
+
+// sample applies pct=: messages outside the sampled percentage get the next
+// less strict policy (RFC 7489 section 6.6.4).
+func sample(policy Policy, percent int) Policy {
+	if percent >= 100 || rand.Intn(100) < percent {
+		return policy
+	}
+	switch policy {
+	case PolicyReject:
+		return PolicyQuarantine
+	case PolicyQuarantine:
+		return PolicyNone
+	}
+	return policy
+}
+
+// aligned reports whether an authenticated domain aligns with the From
+// domain: equal in strict mode, sharing an organizational domain in relaxed.
+func aligned(authDomain, fromDomain string, strict bool) bool {
+	authDomain = strings.ToLower(strings.TrimSuffix(authDomain, "."))
+	if authDomain == fromDomain {
+		return true
+	}
+	if strict || authDomain == "" {
+		return false
+	}
+	return OrganizationalDomain(authDomain) == OrganizationalDomain(fromDomain)
+}
+
+// OrganizationalDomain returns the registrable domain (public suffix plus one
+// label) for domain, or domain itself if it can't be determined.
+func OrganizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
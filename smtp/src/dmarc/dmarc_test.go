@@ -0,0 +1,181 @@
+package dmarc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mymail/smtp/src/dkim"
+	"github.com/mymail/smtp/src/dns"
+	"github.com/mymail/smtp/src/spf"
+)
+
+func spfPass(domain string) spf.Evaluation {
+	return spf.Evaluation{Result: spf.Pass, Identity: spf.IdentityMailFrom, Domain: domain}
+}
+
+func dkimPass(domain string) []dkim.SignatureResult {
+	return []dkim.SignatureResult{{Domain: domain, Result: dkim.Pass}}
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name            string
+		records         map[string][]string
+		from            string
+		spf             spf.Evaluation
+		dkim            []dkim.SignatureResult
+		wantResult      Result
+		wantPolicy      Policy
+		wantDisposition Policy
+	}{
+		{
+			name:       "relaxed SPF alignment with a subdomain",
+			records:    map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			from:       "example.com",
+			spf:        spfPass("bounces.example.com"),
+			wantResult: Pass, wantPolicy: PolicyReject, wantDisposition: PolicyNone,
+		},
+		{
+			name:       "strict SPF alignment with a subdomain",
+			records:    map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; aspf=s"}},
+			from:       "example.com",
+			spf:        spfPass("bounces.example.com"),
+			wantResult: Fail, wantPolicy: PolicyReject, wantDisposition: PolicyReject,
+		},
+		{
+			name:       "relaxed DKIM alignment with a subdomain",
+			records:    map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=quarantine"}},
+			from:       "example.com",
+			dkim:       dkimPass("mail.example.com"),
+			wantResult: Pass, wantPolicy: PolicyQuarantine, wantDisposition: PolicyNone,
+		},
+		{
+			name:       "strict DKIM alignment with a subdomain",
+			records:    map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=quarantine; adkim=s"}},
+			from:       "example.com",
+			dkim:       dkimPass("mail.example.com"),
+			wantResult: Fail, wantPolicy: PolicyQuarantine, wantDisposition: PolicyQuarantine,
+		},
+		{
+			name:       "strict DKIM alignment with the same domain",
+			records:    map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=quarantine; adkim=s"}},
+			from:       "example.com",
+			dkim:       dkimPass("example.com"),
+			wantResult: Pass, wantPolicy: PolicyQuarantine, wantDisposition: PolicyNone,
+		},
+		{
+			name:       "unrelated domains don't align",
+			records:    map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			from:       "example.com",
+			spf:        spfPass("example.net"),
+			dkim:       dkimPass("example.net"),
+			wantResult: Fail, wantPolicy: PolicyReject, wantDisposition: PolicyReject,
+		},
+		{
+			name:       "HELO SPF doesn't count",
+			records:    map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			from:       "example.com",
+			spf:        spf.Evaluation{Result: spf.Pass, Identity: spf.IdentityHelo, Domain: "example.com"},
+			wantResult: Fail, wantPolicy: PolicyReject, wantDisposition: PolicyReject,
+		},
+		{
+			name:       "failed DKIM doesn't count",
+			records:    map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			from:       "example.com",
+			dkim:       []dkim.SignatureResult{{Domain: "example.com", Result: dkim.Fail}},
+			wantResult: Fail, wantPolicy: PolicyReject, wantDisposition: PolicyReject,
+		},
+		{
+			name:       "subdomain uses the organizational domain's sp=",
+			records:    map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine"}},
+			from:       "news.example.com",
+			wantResult: Fail, wantPolicy: PolicyQuarantine, wantDisposition: PolicyQuarantine,
+		},
+		{
+			name:       "subdomain without sp= uses p=",
+			records:    map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			from:       "news.example.com",
+			wantResult: Fail, wantPolicy: PolicyReject, wantDisposition: PolicyReject,
+		},
+		{
+			name: "subdomain's own record wins over sp=",
+			records: map[string][]string{
+				"_dmarc.example.com":      {"v=DMARC1; p=reject; sp=quarantine"},
+				"_dmarc.news.example.com": {"v=DMARC1; p=none"},
+			},
+			from:       "news.example.com",
+			wantResult: Fail, wantPolicy: PolicyNone, wantDisposition: PolicyNone,
+		},
+		{
+			name:       "pct=0 applies the next less strict policy",
+			records:    map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; pct=0"}},
+			from:       "example.com",
+			wantResult: Fail, wantPolicy: PolicyReject, wantDisposition: PolicyQuarantine,
+		},
+		{
+			name:       "pct=0 quarantine becomes none",
+			records:    map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=quarantine; pct=0"}},
+			from:       "example.com",
+			wantResult: Fail, wantPolicy: PolicyQuarantine, wantDisposition: PolicyNone,
+		},
+		{
+			name:       "pct=100 applies the policy",
+			records:    map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; pct=100"}},
+			from:       "example.com",
+			wantResult: Fail, wantPolicy: PolicyReject, wantDisposition: PolicyReject,
+		},
+		{
+			name:       "no record",
+			records:    map[string][]string{},
+			from:       "example.com",
+			wantResult: None, wantDisposition: PolicyNone,
+		},
+		{
+			name:       "malformed record",
+			records:    map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=bogus"}},
+			from:       "example.com",
+			wantResult: PermError, wantDisposition: PolicyNone,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewChecker(&dns.Static{TXT: tt.records})
+			got := c.Evaluate(context.Background(), tt.from, tt.spf, tt.dkim)
+			if got.Result != tt.wantResult || got.Policy != tt.wantPolicy || got.Disposition != tt.wantDisposition {
+				t.Errorf("Evaluate() = %s/%s/%s (%s), want %s/%s/%s",
+					got.Result, got.Policy, got.Disposition, got.Reason,
+					tt.wantResult, tt.wantPolicy, tt.wantDisposition)
+			}
+		})
+	}
+}
+
+func TestEvaluateTempError(t *testing.T) {
+	c := NewChecker(&dns.Static{Fail: map[string]bool{"_dmarc.example.com": true}})
+	if got := c.Evaluate(context.Background(), "example.com", spf.Evaluation{}, nil); got.Result != TempError {
+		t.Errorf("Evaluate() = %s (%s), want %s", got.Result, got.Reason, TempError)
+	}
+}
+
+func TestDispositionFor(t *testing.T) {
+	fail := Evaluation{Result: Fail, Disposition: PolicyQuarantine}
+	pass := Evaluation{Result: Pass, Disposition: PolicyNone}
+
+	tests := []struct {
+		eval     Evaluation
+		override string
+		want     Policy
+	}{
+		{fail, "", PolicyQuarantine},
+		{fail, "reject", PolicyReject},
+		{fail, "none", PolicyNone},
+		{fail, "bogus", PolicyQuarantine},
+		{pass, "reject", PolicyNone},
+	}
+	for _, tt := range tests {
+		if got := tt.eval.DispositionFor(tt.override); got != tt.want {
+			t.Errorf("%s.DispositionFor(%q) = %s, want %s", tt.eval.Result, tt.override, got, tt.want)
+		}
+	}
+}
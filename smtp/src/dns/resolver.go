@@ -0,0 +1,31 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Resolver is the subset of *net.Resolver used by the mail authentication
+// checks. It exists so those checks can run against Static (or any other
+// in-process resolver) instead of real DNS.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+var _ Resolver = net.DefaultResolver
+
+// IsNotFound reports whether err means the name or record doesn't exist, as
+// opposed to a lookup that failed and may succeed if retried.
+func IsNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// IsTemporary reports whether err is a lookup failure worth retrying.
+func IsTemporary(err error) bool {
+	return err != nil && !IsNotFound(err)
+}
@@ -0,0 +1,53 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Static is an in-process Resolver backed by fixed record sets. Names are
+// matched case-insensitively and without the trailing dot. Names listed in
+// Fail return a temporary error, which lets callers exercise temperror paths.
+type Static struct {
+	TXT  map[string][]string
+	IP   map[string][]net.IP
+	MX   map[string][]*net.MX
+	PTR  map[string][]string
+	Fail map[string]bool
+}
+
+func (s *Static) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return lookup(s, s.TXT, name)
+}
+
+func (s *Static) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, err := lookup(s, s.IP, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, nil
+}
+
+func (s *Static) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return lookup(s, s.MX, name)
+}
+
+func (s *Static) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return lookup(s, s.PTR, addr)
+}
+
+func lookup[T any](s *Static, records map[string][]T, name string) ([]T, error) {
+	key := strings.ToLower(strings.TrimSuffix(name, "."))
+	if s.Fail[key] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if values, ok := records[key]; ok && len(values) > 0 {
+		return values, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
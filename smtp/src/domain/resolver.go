@@ -0,0 +1,81 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mymail/smtp/src/config"
+	"github.com/mymail/smtp/src/storage"
+)
+
+// Reject policies control how a domain refuses mail for unknown recipients.
+const (
+	PolicyReject   = "reject"   // permanent 550 at RCPT
+	PolicyTempfail = "tempfail" // transient 450 at RCPT
+	PolicyAccept   = "accept"   // accept at RCPT and drop in DATA
+)
+
+// Resolver decides which domains this server accepts mail for. Domains live in
+// the domains table so new MX mappings don't need a redeploy; lookups are
+// cached in Redis, including misses, to keep Postgres off the RCPT hot path.
+// Nothing invalidates the cache, so a change to a domain's row reaches SMTP
+// once its cached entry expires.
+type Resolver struct {
+	db    *storage.Postgres
+	redis *storage.Redis
+	cfg   *config.Config
+	ttl   time.Duration
+}
+
+// cacheEntry wraps the cached domain so that a miss can be cached as well.
+type cacheEntry struct {
+	Domain *storage.Domain `json:"domain"`
+}
+
+func NewResolver(db *storage.Postgres, redis *storage.Redis, cfg *config.Config) *Resolver {
+	return &Resolver{
+		db:    db,
+		redis: redis,
+		cfg:   cfg,
+		ttl:   time.Duration(cfg.SMTP.DomainCacheTTL) * time.Second,
+	}
+}
+
+// Lookup returns the domain settings for name, or nil if the domain is not
+// served here. Disabled domains are returned so callers can tell them apart
+// from unknown ones.
+func (r *Resolver) Lookup(ctx context.Context, name string) (*storage.Domain, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	key := cacheKey(name)
+
+	var entry cacheEntry
+	found, err := r.redis.GetJSON(ctx, key, &entry)
+	if err == nil && found {
+		return entry.Domain, nil
+	}
+
+	d, err := r.db.FindDomain(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The primary domain is always served, even before it has a row.
+	if d == nil && name == strings.ToLower(r.cfg.SMTP.Domain) {
+		d = &storage.Domain{
+			Name:         name,
+			Enabled:      true,
+			RejectPolicy: PolicyReject,
+		}
+	}
+
+	// Cache failures only cost us a database round trip next time
+	r.redis.SetJSON(ctx, key, cacheEntry{Domain: d}, r.ttl)
+
+	return d, nil
+}
+
+func cacheKey(name string) string {
+	return fmt.Sprintf("domain:%s", name)
+}
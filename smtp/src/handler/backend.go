@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"strings"
 	"time"
 
@@ -12,33 +13,84 @@ import (
 	"github.com/emersion/go-message/mail"
 	"github.com/emersion/go-smtp"
 	"github.com/google/uuid"
+	"github.com/mymail/shared/jobs"
+	"github.com/mymail/shared/queue"
 	"github.com/mymail/smtp/src/config"
+	"github.com/mymail/smtp/src/directory"
+	"github.com/mymail/smtp/src/dkim"
+	"github.com/mymail/smtp/src/dmarc"
+	"github.com/mymail/smtp/src/dns"
+	"github.com/mymail/smtp/src/domain"
+	"github.com/mymail/smtp/src/quota"
 	"github.com/mymail/smtp/src/ratelimit"
+	"github.com/mymail/smtp/src/spf"
 	"github.com/mymail/smtp/src/storage"
 )
 
+const (
+	// spfTimeout bounds the DNS work of one SPF evaluation (RFC 7208
+	// section 4.6.4 suggests at least 20 seconds).
+	spfTimeout = 20 * time.Second
+
+	// dkimTimeout bounds the key lookups for all signatures on a message.
+	dkimTimeout = 20 * time.Second
+
+	// dmarcTimeout bounds the policy record lookups for a message.
+	dmarcTimeout = 10 * time.Second
+)
+
 type Backend struct {
 	db          *storage.Postgres
 	redis       *storage.Redis
 	minio       *storage.MinIO
+	queue       queue.Queue
 	rateLimiter *ratelimit.RateLimiter
+	quota       *quota.Checker
+	domains     *domain.Resolver
+	directory   *directory.Directory
+	resolver    dns.Resolver
+	spf         *spf.Checker
+	dmarc       *dmarc.Checker
 	cfg         *config.Config
 }
 
-func NewBackend(db *storage.Postgres, redis *storage.Redis, minio *storage.MinIO,
-	rateLimiter *ratelimit.RateLimiter, cfg *config.Config) *Backend {
+func NewBackend(db *storage.Postgres, redis *storage.Redis, minio *storage.MinIO, queue queue.Queue,
+	rateLimiter *ratelimit.RateLimiter, quota *quota.Checker, domains *domain.Resolver, directory *directory.Directory,
+	resolver dns.Resolver, spfChecker *spf.Checker, dmarcChecker *dmarc.Checker, cfg *config.Config) *Backend {
 	return &Backend{
 		db:          db,
 		redis:       redis,
 		minio:       minio,
+		queue:       queue,
 		rateLimiter: rateLimiter,
+		quota:       quota,
+		domains:     domains,
+		directory:   directory,
+		resolver:    resolver,
+		spf:         spfChecker,
+		dmarc:       dmarcChecker,
 		cfg:         cfg,
 	}
 }
 
+func (b *Backend) isTempDomain(name string) bool {
+	if !b.cfg.TempMail.Enabled {
+		return false
+	}
+	for _, d := range b.cfg.TempMail.Domains {
+		if strings.EqualFold(d, name) {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 	remoteAddr := c.Conn().RemoteAddr().String()
-	ip := strings.Split(remoteAddr, ":")[0]
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
 
 	// Rate limit by IP
 	ctx := context.Background()
@@ -52,28 +104,65 @@ func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 
 	return &Session{
 		backend:    b,
+		conn:       c,
 		remoteAddr: ip,
+		helo:       c.Hostname(),
 	}, nil
 }
 
 type Session struct {
 	backend    *Backend
+	conn       *smtp.Conn
 	remoteAddr string
+	helo       string
 	from       string
-	to         []string
+	spf        spf.Evaluation
+	size       int64
+	recipients []recipient
 }
 
-func (s *Session) AuthMechanism() []string {
-	return []string{}
+// recipient is an accepted RCPT TO. mailbox is nil for unknown addresses
+// accepted under a domain's accept policy.
+type recipient struct {
+	address string
+	mailbox *storage.Mailbox
+	domain  *storage.Domain
 }
 
+// AuthPlain refuses authentication: this listener only receives mail, and
+// clients send through the submission listener.
 func (s *Session) AuthPlain(username, password string) error {
-	// No authentication required for receiving emails
-	return nil
+	return smtp.ErrAuthUnsupported
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 	s.from = from
+	if opts != nil {
+		s.size = opts.Size
+	}
+
+	if s.backend.cfg.SPF.Enabled {
+		ctx, cancel := context.WithTimeout(context.Background(), spfTimeout)
+		defer cancel()
+
+		s.spf = s.backend.spf.Verify(ctx, net.ParseIP(s.remoteAddr), s.helo, from)
+		if s.spf.Result == spf.Fail && s.backend.cfg.SPF.RejectFail {
+			return errSPFFail
+		}
+	}
+
+	// Rate limit by sender domain once SPF shows the client may use it, so
+	// a forged sender can't use up a real domain's allowance. Bounces and
+	// mail without SPF aren't limited here.
+	if s.spf.Result == spf.Pass && s.spf.Identity == spf.IdentityMailFrom {
+		allowed, err := s.backend.rateLimiter.AllowSender(context.Background(), s.spf.Domain)
+		if err != nil {
+			return errTempLookupFailure
+		}
+		if !allowed {
+			return errRateLimited
+		}
+	}
 	return nil
 }
 
@@ -84,41 +173,98 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 		return fmt.Errorf("invalid email address")
 	}
 
-	domain := parts[1]
-	// Allow configured domain, mail.localhost for development, and jotko.site
-	allowedDomains := []string{s.backend.cfg.SMTP.Domain, "mail.localhost", "jotko.site"}
-	validDomain := false
-	for _, allowed := range allowedDomains {
-		if domain == allowed {
-			validDomain = true
-			break
+	ctx := context.Background()
+	d, err := s.backend.domains.Lookup(ctx, parts[1])
+	if err != nil {
+		return errTempLookupFailure
+	}
+	if d == nil || !d.Enabled {
+		return errRelayDenied
+	}
+
+	// Clients that declared SIZE can be turned away before sending the body
+	if d.MaxMessageSize > 0 && s.size > d.MaxMessageSize {
+		return smtp.ErrDataTooLarge
+	}
+
+	mailbox, err := s.findMailbox(ctx, to, d)
+	if err != nil {
+		return errTempLookupFailure
+	}
+	if mailbox == nil && s.backend.isTempDomain(d.Name) {
+		mailbox, err = s.provisionTempMailbox(ctx, to)
+		if err == storage.ErrAddressTaken {
+			return errNoSuchUser
+		}
+		if err != nil {
+			return errTempLookupFailure
+		}
+		if mailbox == nil {
+			return errMailboxUnavailable
 		}
 	}
-	if !validDomain {
-		return fmt.Errorf("invalid domain: %s", domain)
+	if mailbox == nil {
+		switch d.RejectPolicy {
+		case domain.PolicyAccept:
+			// Accepted here and dropped in DATA, as the domain asks
+		case domain.PolicyTempfail:
+			return errMailboxUnavailable
+		default:
+			return errNoSuchUser
+		}
 	}
 
-	s.to = append(s.to, to)
+	// A full mailbox may have room again by the time the client retries.
+	// A declared SIZE is counted too; DATA checks the real size when it can.
+	// Delivery rate limits are taken here too, where a recipient over them
+	// can be deferred without holding up the others.
+	if mailbox != nil {
+		allowed, err := s.backend.quota.Allow(ctx, mailbox.UserID, s.size)
+		if err != nil {
+			return errTempLookupFailure
+		}
+		if !allowed {
+			return errMailboxFull
+		}
+
+		allowed, err = s.backend.rateLimiter.AllowDelivery(ctx, mailbox.UserID, mailbox.ID)
+		if err != nil {
+			return errTempLookupFailure
+		}
+		if !allowed {
+			return errRateLimited
+		}
+	}
+
+	s.recipients = append(s.recipients, recipient{address: to, mailbox: mailbox, domain: d})
 	return nil
 }
 
 func (s *Session) Data(r io.Reader) error {
 	ctx := context.Background()
 
-	// Use io.TeeReader to split the stream: one for header parsing, one for MinIO streaming
-	// This allows us to read headers while simultaneously streaming to MinIO
-	headerBuf := &bytes.Buffer{}
-	teeReader := io.TeeReader(r, headerBuf)
-
-	headerLimit := int64(64 * 1024)
-	headerReader := io.LimitReader(teeReader, headerLimit)
+	// Spool the message to disk: the trace and authentication headers
+	// depend on the whole message, so they can only be prepended once it
+	// has been read. DKIM signatures are verified on the way through.
+	var verifier *dkim.Verifier
+	var tee io.Writer
+	if s.backend.cfg.DKIM.Verify {
+		verifier = dkim.NewVerifier(s.backend.resolver)
+		tee = verifier
+	}
 
-	headerSize, err := io.Copy(headerBuf, headerReader)
-	if err != nil && err != io.EOF {
-		return fmt.Errorf("failed to read headers: %w", err)
+	spool, err := spoolMessage(s.backend.cfg.SMTP.SpoolDir, r, s.sizeLimit(), tee)
+	if err != nil {
+		return err
 	}
+	defer spool.Close()
+
+	// Parse headers from the start of the message
+	headerBuf := make([]byte, 64*1024)
+	n, _ := spool.ReadAt(headerBuf, 0)
+	headerBuf = headerBuf[:n]
 
-	msg, err := message.Read(bytes.NewReader(headerBuf.Bytes()))
+	msg, err := message.Read(bytes.NewReader(headerBuf))
 	if err != nil {
 		return fmt.Errorf("failed to parse message headers: %w", err)
 	}
@@ -131,121 +277,260 @@ func (s *Session) Data(r io.Reader) error {
 		messageID = fmt.Sprintf("<%s@%s>", uuid.New().String(), s.backend.cfg.SMTP.Domain)
 	}
 
-	toAddresses := []string{}
-	if to != "" {
-		addresses, _ := mail.ParseAddressList(to)
-		for _, addr := range addresses {
-			toAddresses = append(toAddresses, addr.Address)
+	toAddresses := addressList(to)
+
+	// Unknown recipients on accept-policy domains are dropped here
+	accepted := make([]recipient, 0, len(s.recipients))
+	for _, rcpt := range s.recipients {
+		if rcpt.mailbox != nil {
+			accepted = append(accepted, rcpt)
 		}
 	}
+	if len(accepted) == 0 {
+		return nil
+	}
 
-	validMailboxes := []*storage.Mailbox{}
-	for _, recipient := range s.to {
-		mailbox, err := s.backend.db.FindMailbox(recipient)
-		if err != nil || mailbox == nil {
-			continue
+	dkimResults := []dkim.SignatureResult{}
+	if verifier != nil {
+		dkimCtx, cancel := context.WithTimeout(ctx, dkimTimeout)
+		dkimResults = verifier.Verify(dkimCtx)
+		cancel()
+	}
+
+	var dmarcEval dmarc.Evaluation
+	if s.backend.cfg.DMARC.Enabled {
+		dmarcCtx, cancel := context.WithTimeout(ctx, dmarcTimeout)
+		dmarcEval = s.backend.dmarc.Evaluate(dmarcCtx, fromDomain(from), s.spf, dkimResults)
+		cancel()
+	}
+
+	// Each recipient domain may override the sender's DMARC policy, but the
+	// reply to DATA covers every recipient. The message is refused only if
+	// all their domains reject it; otherwise those that would reject it
+	// quarantine it instead of losing it silently.
+	rejecting := 0
+	for _, rcpt := range accepted {
+		if dmarcEval.DispositionFor(rcpt.domain.DMARCOverride) == dmarc.PolicyReject {
+			rejecting++
 		}
+	}
+	if rejecting == len(accepted) {
+		return errDMARCReject
+	}
 
-		// Rate limit check
-		allowed, err := s.backend.rateLimiter.AllowEmail(ctx, mailbox.UserID)
-		if !allowed || err != nil {
-			continue
+	// Each recipient gets a copy stamped with its own trace headers, and
+	// its quota is checked and charged for that copy's size
+	header, bodyOffset := splitSpool(spool, spool.size, s.backend.cfg.SMTP.Domain)
+	copies := make([]storedCopy, 0, len(accepted))
+	for _, rcpt := range accepted {
+		disposition := dmarcEval.DispositionFor(rcpt.domain.DMARCOverride)
+		if disposition == dmarc.PolicyReject {
+			disposition = dmarc.PolicyQuarantine
 		}
 
-		validMailboxes = append(validMailboxes, mailbox)
-	}
+		emailID := uuid.New().String()
+		stamp := s.traceHeader(rcpt.address, emailID, dkimResults, dmarcEval, disposition)
+		size := int64(len(stamp)+len(header)) + spool.size - bodyOffset
 
-	if len(validMailboxes) == 0 {
-		return nil // No valid recipients
-	}
+		if err := s.checkCopyQuota(ctx, accepted, rcpt, size); err != nil {
+			return err
+		}
 
-	// For streaming: combine header buffer with remaining stream
-	// The teeReader continues reading from 'r' after headers
-	var fullStream io.Reader
-	if headerSize < headerLimit {
-		// All data was in header buffer (small email)
-		fullStream = bytes.NewReader(headerBuf.Bytes())
-	} else {
-		// We have more data - combine header buffer with remaining from teeReader
-		// teeReader will continue reading the rest of the stream
-		fullStream = io.MultiReader(bytes.NewReader(headerBuf.Bytes()), teeReader)
+		copies = append(copies, storedCopy{
+			rcpt: rcpt, emailID: emailID, stamp: stamp, disposition: disposition, size: size,
+		})
 	}
 
-	// Upload once to a shared location (use first mailbox's path as primary)
-	// For multiple recipients, we'll reference this file
-	primaryMailbox := validMailboxes[0]
-	emailID := uuid.New().String()
-	primaryPath := fmt.Sprintf("%s/%s/%s.eml", primaryMailbox.UserID, time.Now().Format("2006/01/02"), emailID)
-
-	// Stream directly to MinIO - this streams the entire email without buffering
-	err = s.backend.minio.UploadStream(ctx, primaryPath, fullStream)
-	if err != nil {
-		return fmt.Errorf("failed to upload email: %w", err)
-	}
-
-	// Extract limited text/HTML bodies from header buffer
-	var textBody, htmlBody string
-	bodyReader := bytes.NewReader(headerBuf.Bytes())
-	if bodyMsg, err := message.Read(bodyReader); err == nil {
-		if mr := bodyMsg.MultipartReader(); mr != nil {
-			if p, err := mr.NextPart(); err == nil {
-				mediaType, _, _ := p.Header.ContentType()
-				if body, err := io.ReadAll(io.LimitReader(p.Body, 10240)); err == nil {
-					if strings.HasPrefix(mediaType, "text/plain") {
-						textBody = string(body)
-					} else if strings.HasPrefix(mediaType, "text/html") {
-						htmlBody = string(body)
-					}
-				}
-			}
-		} else {
-			if body, err := io.ReadAll(io.LimitReader(bodyMsg.Body, 10240)); err == nil {
-				textBody = string(body)
+	// Everything is uploaded before any job is queued, so a failed upload
+	// can be retried by the client without delivering twice
+	for i := range copies {
+		c := &copies[i]
+		c.path = fmt.Sprintf("%s/%s/%s.eml", c.rcpt.mailbox.UserID, time.Now().Format("2006/01/02"), c.emailID)
+
+		rest := io.NewSectionReader(spool, bodyOffset, spool.size-bodyOffset)
+		object := io.MultiReader(strings.NewReader(c.stamp), bytes.NewReader(header), rest)
+		if err := s.backend.minio.Upload(ctx, c.path, object, c.size); err != nil {
+			for _, uploaded := range copies[:i] {
+				s.backend.minio.Delete(ctx, uploaded.path)
 			}
+			return errQueueFailure
 		}
 	}
 
 	// Create queue jobs for all recipients
-	// For now, all recipients point to the same file (could be optimized with copies)
-	for _, mailbox := range validMailboxes {
-		var path string
-		if mailbox == primaryMailbox {
-			path = primaryPath
-		} else {
-			// For other recipients, use the same file (shared storage)
-			// In production, you might want to copy the file for each recipient
-			path = primaryPath
+	for i, c := range copies {
+		// Create queue job for processing
+		err = jobs.Enqueue(ctx, s.backend.queue, &jobs.ProcessEmail{
+			EmailID:        c.emailID,
+			MailboxID:      c.rcpt.mailbox.ID,
+			MessageID:      messageID,
+			From:           from,
+			To:             toAddresses,
+			Subject:        subject,
+			MinIOPath:      c.path,
+			Size:           c.size,
+			Folder:         folderFor(c.disposition),
+			ReceivedSize:   spool.size,
+			ReceivedSHA256: spool.sha256,
+
+			SPFResult:        string(s.spf.Result),
+			SPFDomain:        s.spf.Domain,
+			DKIM:             dkimPayload(dkimResults),
+			DMARCResult:      string(dmarcEval.Result),
+			DMARCDisposition: string(c.disposition),
+		})
+		if err != nil {
+			// The client will send the message again, so the copies not yet
+			// queued are removed. Those already queued are still delivered,
+			// and get the retry as well.
+			for _, unqueued := range copies[i:] {
+				s.backend.minio.Delete(ctx, unqueued.path)
+			}
+			return errQueueFailure
 		}
 
-		// Approximate size (will be updated by worker when processing)
-		emailSize := int64(headerBuf.Len())
+		// A missed charge is made up when the cached usage next reloads
+		s.backend.quota.Charge(ctx, c.rcpt.mailbox.UserID, c.size)
+	}
 
-		// Create queue job for processing
-		payload := map[string]interface{}{
-			"email_id":   emailID,
-			"mailbox_id": mailbox.ID,
-			"message_id": messageID,
-			"from":       from,
-			"to":         toAddresses,
-			"subject":    subject,
-			"text_body":  textBody,
-			"html_body":  htmlBody,
-			"minio_path": path,
-			"size":       emailSize,
-		}
-
-		err = s.backend.db.CreateQueueJob("process_email", payload)
-		if err != nil {
-			continue
+	return nil
+}
+
+// dkimPayload converts verification results for a process_email job.
+func dkimPayload(results []dkim.SignatureResult) []jobs.DKIMResult {
+	out := make([]jobs.DKIMResult, 0, len(results))
+	for _, r := range results {
+		out = append(out, jobs.DKIMResult{
+			Domain:    r.Domain,
+			Selector:  r.Selector,
+			Identity:  r.Identity,
+			Algorithm: r.Algorithm,
+			Result:    string(r.Result),
+			Reason:    r.Reason,
+			HeaderB:   r.HeaderB,
+		})
+	}
+	return out
+}
+
+// sizeLimit returns the smallest message size limit among the recipients'
+// domains, or 0 if none sets one. A message over it can't be refused per
+// recipient once DATA has begun, so it is refused for all of them.
+func (s *Session) sizeLimit() int64 {
+	var limit int64
+	for _, rcpt := range s.recipients {
+		if n := rcpt.domain.MaxMessageSize; n > 0 && (limit == 0 || n < limit) {
+			limit = n
 		}
 	}
+	return limit
+}
 
+// checkCopyQuota checks rcpt's quota against the size of its stamped copy.
+// RCPT checked it against the declared size. A sole mailbox recipient can
+// still refuse the message now that its size is known, but with more,
+// refusing it would refuse it for all of them, so it is accepted.
+// Recipients with no mailbox store nothing and don't count.
+func (s *Session) checkCopyQuota(ctx context.Context, accepted []recipient, rcpt recipient, size int64) error {
+	if len(accepted) != 1 {
+		return nil
+	}
+	allowed, err := s.backend.quota.Allow(ctx, rcpt.mailbox.UserID, size)
+	if err != nil {
+		return errTempLookupFailure
+	}
+	if !allowed {
+		return errQuotaExceeded
+	}
 	return nil
 }
 
+// storedCopy is one recipient's copy of a message: the received message
+// with stamp prepended, uploaded to path.
+type storedCopy struct {
+	rcpt        recipient
+	emailID     string
+	stamp       string
+	disposition dmarc.Policy
+	path        string
+	size        int64
+}
+
+// addressList returns the bare addresses in an address header value.
+func addressList(value string) []string {
+	addresses := []string{}
+	if value == "" {
+		return addresses
+	}
+	parsed, _ := mail.ParseAddressList(value)
+	for _, addr := range parsed {
+		addresses = append(addresses, addr.Address)
+	}
+	return addresses
+}
+
+// fromDomain extracts the domain of the RFC5322.From address. DMARC needs
+// exactly one author, so anything else yields "".
+func fromDomain(from string) string {
+	addresses, err := mail.ParseAddressList(from)
+	if err != nil || len(addresses) != 1 {
+		return ""
+	}
+	address := addresses[0].Address
+	return strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+}
+
+// folderFor maps a DMARC disposition to the folder the email is stored in.
+func folderFor(disposition dmarc.Policy) string {
+	if disposition == dmarc.PolicyQuarantine {
+		return "quarantine"
+	}
+	return "inbox"
+}
+
+// findMailbox resolves a recipient to its mailbox, falling back to the
+// domain's catch-all mailbox (registered as *@domain) when enabled.
+func (s *Session) findMailbox(ctx context.Context, address string, d *storage.Domain) (*storage.Mailbox, error) {
+	mailbox, err := s.backend.directory.Lookup(ctx, address)
+	if err != nil || mailbox != nil {
+		return mailbox, err
+	}
+
+	if d.CatchAll {
+		return s.backend.directory.Lookup(ctx, "*@"+d.Name)
+	}
+	return nil, nil
+}
+
+// provisionTempMailbox creates a temp mailbox for address on first delivery.
+// It returns nil if the address is still held by an expired mailbox that the
+// worker hasn't cleaned up yet, and storage.ErrAddressTaken if it is a
+// registered user's email.
+func (s *Session) provisionTempMailbox(ctx context.Context, address string) (*storage.Mailbox, error) {
+	address = strings.ToLower(address)
+	ttl := time.Duration(s.backend.cfg.TempMail.TTL) * time.Second
+	mailbox, err := s.backend.db.CreateTempMailbox(address, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lost a race with another session; use the mailbox it created
+	if mailbox == nil {
+		mailbox, err = s.backend.db.FindMailbox(address)
+		if err != nil || mailbox == nil {
+			return nil, err
+		}
+	}
+
+	s.backend.directory.Remember(ctx, mailbox)
+	return mailbox, nil
+}
+
 func (s *Session) Reset() {
 	s.from = ""
-	s.to = nil
+	s.spf = spf.Evaluation{}
+	s.size = 0
+	s.recipients = nil
 }
 
 func (s *Session) Logout() error {
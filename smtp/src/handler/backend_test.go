@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mymail/smtp/src/config"
+	"github.com/mymail/smtp/src/quota"
+	"github.com/mymail/smtp/src/storage"
+)
+
+// newQuotaSession returns a session whose quota checker sees user-1 with
+// 100 of 1000 bytes used, cached so Postgres is never asked.
+func newQuotaSession(t *testing.T) (*Session, *miniredis.Miniredis) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	m.HSet("quota:user-1", "limit", "1000", "used", "100")
+	r, err := storage.NewRedis("redis://" + m.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	checker := quota.New(nil, r, config.QuotaConfig{Enabled: true, CacheTTL: 60})
+	return &Session{backend: &Backend{quota: checker}}, m
+}
+
+func TestCheckCopyQuota(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newQuotaSession(t)
+	bob := recipient{address: "bob@example.com", mailbox: &storage.Mailbox{ID: "mbx-1", UserID: "user-1"}}
+	carol := recipient{address: "carol@example.com", mailbox: &storage.Mailbox{ID: "mbx-2", UserID: "user-2"}}
+	// Accepted by the domain's accept policy, with nowhere to store it
+	unknown := recipient{address: "nobody@example.com"}
+
+	s.recipients = []recipient{unknown, bob}
+	accepted := []recipient{bob}
+	if err := s.checkCopyQuota(ctx, accepted, bob, 900); err != nil {
+		t.Errorf("a copy that fits: %v", err)
+	}
+	// The recipient without a mailbox doesn't make bob one of several
+	if err := s.checkCopyQuota(ctx, accepted, bob, 901); err != errQuotaExceeded {
+		t.Errorf("a copy over the quota of the sole mailbox = %v, want %v", err, errQuotaExceeded)
+	}
+
+	s.recipients = []recipient{bob, carol}
+	if err := s.checkCopyQuota(ctx, []recipient{bob, carol}, bob, 901); err != nil {
+		t.Errorf("a copy over the quota with other mailboxes = %v, want it accepted", err)
+	}
+}
+
+func TestCheckCopyQuotaLookupFailure(t *testing.T) {
+	s, m := newQuotaSession(t)
+	bob := recipient{address: "bob@example.com", mailbox: &storage.Mailbox{ID: "mbx-1", UserID: "user-1"}}
+	m.Close()
+
+	if err := s.checkCopyQuota(context.Background(), []recipient{bob}, bob, 10); err != errTempLookupFailure {
+		t.Errorf("checkCopyQuota() = %v, want %v", err, errTempLookupFailure)
+	}
+}
@@ -0,0 +1,81 @@
+package handler
+
+import "github.com/emersion/go-smtp"
+
+var (
+	errRelayDenied = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Relay access denied",
+	}
+	errNoSuchUser = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "No such user here",
+	}
+	errMailboxUnavailable = &smtp.SMTPError{
+		Code:         450,
+		EnhancedCode: smtp.EnhancedCode{4, 1, 1},
+		Message:      "Mailbox unavailable, try again later",
+	}
+	errRateLimited = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Rate limit exceeded, try again later",
+	}
+	errMailboxFull = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 2, 2},
+		Message:      "Mailbox full, try again later",
+	}
+	errQuotaExceeded = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 2, 2},
+		Message:      "Mailbox quota exceeded",
+	}
+	errSPFFail = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 23},
+		Message:      "SPF validation failed",
+	}
+	errDMARCReject = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Rejected by sender's DMARC policy",
+	}
+	errQueueFailure = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Local error in processing, try again later",
+	}
+	errTempLookupFailure = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Temporary lookup failure, try again later",
+	}
+	errSenderNotOwned = &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender address not owned by authenticated user",
+	}
+	errFromNotOwned = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "From header address not owned by authenticated user",
+	}
+	errBadRecipient = &smtp.SMTPError{
+		Code:         501,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+		Message:      "Bad recipient address syntax",
+	}
+	errTempAuthFailure = &smtp.SMTPError{
+		Code:         454,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Temporary authentication failure",
+	}
+	errTooManyAuthFailures = &smtp.SMTPError{
+		Code:         454,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many failed authentication attempts, try again later",
+	}
+)
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/emersion/go-smtp"
+)
+
+// spoolFile is a message received in DATA, held on disk until it has been
+// stored. Its size and digest are of the message exactly as received.
+type spoolFile struct {
+	*os.File
+	size   int64
+	sha256 string
+}
+
+// spoolMessage copies a message from DATA into a temporary file in dir,
+// and to tee as well if it isn't nil. If limit is positive, a message
+// longer than limit bytes is refused with 552 5.3.4 as soon as it passes
+// it, whatever SIZE the client declared; the server's own limit is already
+// enforced by the DATA reader.
+func spoolMessage(dir string, r io.Reader, limit int64, tee io.Writer) (*spoolFile, error) {
+	f, err := os.CreateTemp(dir, "mymail-*.eml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+
+	var sink io.Writer = f
+	if tee != nil {
+		sink = io.MultiWriter(f, tee)
+	}
+	counter := &countingReader{r: r, limit: limit, hash: sha256.New()}
+	if _, err := io.Copy(sink, counter); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		if smtpErr, ok := err.(*smtp.SMTPError); ok {
+			return nil, smtpErr
+		}
+		return nil, fmt.Errorf("failed to spool message: %w", err)
+	}
+
+	return &spoolFile{
+		File:   f,
+		size:   counter.n,
+		sha256: hex.EncodeToString(counter.hash.Sum(nil)),
+	}, nil
+}
+
+// Close closes and removes the spool file.
+func (s *spoolFile) Close() error {
+	err := s.File.Close()
+	os.Remove(s.Name())
+	return err
+}
+
+// countingReader counts and hashes what is read through it, failing once
+// more than limit bytes have been read if limit is positive.
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+	hash  hash.Hash
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	c.n += int64(n)
+	if c.limit > 0 && c.n > c.limit {
+		return n, smtp.ErrDataTooLarge
+	}
+	return n, err
+}
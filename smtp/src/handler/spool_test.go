@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/emersion/go-smtp"
+)
+
+const spoolTestMessage = "From: alice@example.com\r\nTo: bob@example.net\r\n\r\nHello\r\n"
+
+func TestSpoolMessage(t *testing.T) {
+	sum := sha256.Sum256([]byte(spoolTestMessage))
+	want := hex.EncodeToString(sum[:])
+
+	for _, limit := range []int64{0, int64(len(spoolTestMessage)), 1 << 20} {
+		dir := t.TempDir()
+		var tee bytes.Buffer
+		// One byte at a time, so the count and digest span many reads
+		r := iotest.OneByteReader(strings.NewReader(spoolTestMessage))
+
+		spool, err := spoolMessage(dir, r, limit, &tee)
+		if err != nil {
+			t.Fatalf("limit %d: %v", limit, err)
+		}
+		if spool.size != int64(len(spoolTestMessage)) || spool.sha256 != want {
+			t.Errorf("limit %d: size %d, sha256 %s, want %d, %s", limit, spool.size, spool.sha256, len(spoolTestMessage), want)
+		}
+		if tee.String() != spoolTestMessage {
+			t.Errorf("limit %d: tee got %q", limit, tee.String())
+		}
+
+		data, err := io.ReadAll(io.NewSectionReader(spool, 0, spool.size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != spoolTestMessage {
+			t.Errorf("limit %d: spooled %q", limit, data)
+		}
+
+		spool.Close()
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("limit %d: %d files left after Close", limit, len(entries))
+		}
+	}
+}
+
+func TestSpoolMessageTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	limit := int64(len(spoolTestMessage) - 1)
+
+	spool, err := spoolMessage(dir, strings.NewReader(spoolTestMessage), limit, nil)
+	if spool != nil {
+		spool.Close()
+		t.Error("spoolMessage() returned a spool past the limit")
+	}
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok || smtpErr.Code != 552 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 3, 4}) {
+		t.Errorf("spoolMessage() error = %v, want 552 5.3.4", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files left after refusing the message", len(entries))
+	}
+}
+
+func TestSpoolMessageReadError(t *testing.T) {
+	dir := t.TempDir()
+	r := io.MultiReader(strings.NewReader(spoolTestMessage), iotest.ErrReader(io.ErrUnexpectedEOF))
+
+	if _, err := spoolMessage(dir, r, 0, nil); err == nil {
+		t.Error("spoolMessage() succeeded after a read error")
+	} else if _, ok := err.(*smtp.SMTPError); ok {
+		t.Errorf("spoolMessage() error = %v, want a local error", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files left after the read error", len(entries))
+	}
+}
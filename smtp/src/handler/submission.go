@@ -0,0 +1,317 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+	"github.com/mymail/shared/jobs"
+	"github.com/mymail/smtp/src/auth"
+	"github.com/mymail/smtp/src/keyring"
+	"github.com/mymail/smtp/src/storage"
+)
+
+// SubmissionBackend serves mail clients sending as their mymail addresses
+// (RFC 6409). Every session must authenticate, and may only use addresses
+// belonging to the authenticated user. Accepted messages are DKIM signed,
+// filed in the sender's sent folder and queued for outbound delivery.
+type SubmissionBackend struct {
+	*Backend
+	auth *auth.Authenticator
+	keys *keyring.Keyring
+}
+
+func NewSubmissionBackend(inbound *Backend, authenticator *auth.Authenticator, keys *keyring.Keyring) *SubmissionBackend {
+	return &SubmissionBackend{
+		Backend: inbound,
+		auth:    authenticator,
+		keys:    keys,
+	}
+}
+
+func (b *SubmissionBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	remoteAddr := c.Conn().RemoteAddr().String()
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+
+	return &SubmissionSession{
+		backend:    b,
+		conn:       c,
+		remoteAddr: ip,
+		helo:       c.Hostname(),
+	}, nil
+}
+
+type SubmissionSession struct {
+	backend    *SubmissionBackend
+	conn       *smtp.Conn
+	remoteAddr string
+	helo       string
+	user       *storage.User
+	from       string
+	sender     *storage.Mailbox
+	recipients []string
+}
+
+func (s *SubmissionSession) AuthPlain(username, password string) error {
+	ctx := context.Background()
+	allowed, err := s.backend.rateLimiter.AllowAuth(ctx, s.remoteAddr)
+	if err != nil {
+		return errTempAuthFailure
+	}
+	if !allowed {
+		return errTooManyAuthFailures
+	}
+
+	user, err := s.backend.auth.Authenticate(username, password)
+	if err != nil {
+		return errTempAuthFailure
+	}
+	if user == nil {
+		s.backend.rateLimiter.AuthFailed(ctx, s.remoteAddr)
+		return smtp.ErrAuthFailed
+	}
+
+	s.user = user
+	return nil
+}
+
+func (s *SubmissionSession) Mail(from string, opts *smtp.MailOptions) error {
+	if s.user == nil {
+		return smtp.ErrAuthRequired
+	}
+	if from == "" {
+		return errSenderNotOwned
+	}
+
+	mailbox, err := s.ownedMailbox(context.Background(), from)
+	if err != nil {
+		return errTempLookupFailure
+	}
+	if mailbox == nil {
+		return errSenderNotOwned
+	}
+
+	s.from = from
+	s.sender = mailbox
+	return nil
+}
+
+func (s *SubmissionSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if s.user == nil {
+		return smtp.ErrAuthRequired
+	}
+	if _, err := mail.ParseAddress(to); err != nil {
+		return errBadRecipient
+	}
+
+	s.recipients = append(s.recipients, to)
+	return nil
+}
+
+func (s *SubmissionSession) Data(r io.Reader) error {
+	ctx := context.Background()
+
+	spool, err := spoolMessage(s.backend.cfg.SMTP.SpoolDir, r, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+
+	headerBuf := make([]byte, 64*1024)
+	n, _ := spool.ReadAt(headerBuf, 0)
+	headerBuf = headerBuf[:n]
+
+	msg, err := message.Read(bytes.NewReader(headerBuf))
+	if err != nil {
+		return fmt.Errorf("failed to parse message headers: %w", err)
+	}
+
+	// The author must be the user too, not just the envelope sender
+	from := msg.Header.Get("From")
+	authors := addressList(from)
+	if len(authors) == 0 {
+		return errFromNotOwned
+	}
+	for _, author := range authors {
+		mailbox, err := s.ownedMailbox(ctx, author)
+		if err != nil {
+			return errTempLookupFailure
+		}
+		if mailbox == nil {
+			return errFromNotOwned
+		}
+	}
+
+	allowed, err := s.backend.rateLimiter.AllowEmail(ctx, s.user.ID)
+	if err != nil {
+		return errTempLookupFailure
+	}
+	if !allowed {
+		return errRateLimited
+	}
+
+	emailID := uuid.New().String()
+
+	// Fill in fields clients commonly leave to the server (RFC 6409 section 8)
+	var added strings.Builder
+	if msg.Header.Get("Date") == "" {
+		fmt.Fprintf(&added, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	}
+	messageID := msg.Header.Get("Message-ID")
+	if messageID == "" {
+		messageID = fmt.Sprintf("<%s@%s>", emailID, s.backend.cfg.SMTP.Domain)
+		fmt.Fprintf(&added, "Message-ID: %s\r\n", messageID)
+	}
+
+	// Bcc recipients must not see each other (RFC 5322 section 3.6.3)
+	header, bodyOffset := splitSpool(spool, spool.size, s.backend.cfg.SMTP.Domain)
+	header = dropFields(header, "Bcc")
+	outgoing := func() io.Reader {
+		return io.MultiReader(strings.NewReader(added.String()), bytes.NewReader(header),
+			io.NewSectionReader(spool, bodyOffset, spool.size-bodyOffset))
+	}
+
+	var signature string
+	if s.backend.cfg.DKIM.Enabled {
+		signer, err := s.backend.keys.Signer(fromDomain(from))
+		if err != nil {
+			return errTempLookupFailure
+		}
+		if signer != nil {
+			io.Copy(signer, outgoing())
+			if signature, err = signer.Sign(); err != nil {
+				return fmt.Errorf("failed to sign message: %w", err)
+			}
+		}
+	}
+
+	var rcpt string
+	if len(s.recipients) == 1 {
+		rcpt = s.recipients[0]
+	}
+	received := receivedField(s.conn, s.helo, s.remoteAddr, s.backend.cfg.SMTP.Domain, "ESMTPA", emailID, rcpt)
+	prefix := received + signature
+	size := int64(len(prefix)+added.Len()+len(header)) + spool.size - bodyOffset
+
+	// The sent copy belongs to the user; the outbound copy is the worker's
+	// to delete once delivery is finished
+	sentPath := fmt.Sprintf("%s/%s/%s.eml", s.user.ID, time.Now().Format("2006/01/02"), emailID)
+	if err := s.backend.minio.Upload(ctx, sentPath, io.MultiReader(strings.NewReader(prefix), outgoing()), size); err != nil {
+		return errQueueFailure
+	}
+	outboundPath := fmt.Sprintf("outbound/%s/%s.eml", time.Now().Format("2006/01/02"), emailID)
+	if err := s.backend.minio.Copy(ctx, sentPath, outboundPath); err != nil {
+		s.backend.minio.Delete(ctx, sentPath)
+		return errQueueFailure
+	}
+
+	err = jobs.Enqueue(ctx, s.backend.queue, &jobs.SendEmail{
+		EmailID:    emailID,
+		UserID:     s.user.ID,
+		MailboxID:  s.sender.ID,
+		MessageID:  messageID,
+		From:       s.from,
+		Recipients: s.recipients,
+		MinIOPath:  outboundPath,
+		Size:       size,
+	})
+	if err != nil {
+		s.backend.minio.Delete(ctx, sentPath)
+		s.backend.minio.Delete(ctx, outboundPath)
+		return errQueueFailure
+	}
+
+	// A failure here loses only the sent copy; delivery is already queued
+	err = jobs.Enqueue(ctx, s.backend.queue, &jobs.ProcessEmail{
+		EmailID:   emailID,
+		MailboxID: s.sender.ID,
+		MessageID: messageID,
+		From:      from,
+		To:        addressList(msg.Header.Get("To")),
+		Subject:   msg.Header.Get("Subject"),
+		MinIOPath: sentPath,
+		Size:      size,
+		Folder:    "sent",
+		Bcc:       blindRecipients(s.recipients, msg.Header),
+
+		ReceivedSize:   spool.size,
+		ReceivedSHA256: spool.sha256,
+	})
+	if err != nil {
+		log.Printf("Failed to queue sent copy %s: %v", emailID, err)
+		s.backend.minio.Delete(ctx, sentPath)
+		return nil
+	}
+
+	// The sent copy counts towards the user's quota, though a full mailbox
+	// never stops them sending
+	s.backend.quota.Charge(ctx, s.user.ID, size)
+
+	return nil
+}
+
+// blindRecipients returns the envelope recipients that neither To nor Cc
+// names: the sent copy's Bcc. Its Bcc field is stripped before storing, and
+// clients often leave recipients out of it anyway.
+func blindRecipients(recipients []string, header message.Header) []string {
+	named := make(map[string]bool)
+	for _, field := range []string{"To", "Cc"} {
+		for _, address := range addressList(header.Get(field)) {
+			named[strings.ToLower(address)] = true
+		}
+	}
+
+	var blind []string
+	for _, rcpt := range recipients {
+		if !named[strings.ToLower(rcpt)] {
+			blind = append(blind, rcpt)
+		}
+	}
+	return blind
+}
+
+// ownedMailbox returns the authenticated user's mailbox for address, going
+// through the domain's catch-all mailbox if the user owns that. It returns
+// nil if the address isn't theirs.
+func (s *SubmissionSession) ownedMailbox(ctx context.Context, address string) (*storage.Mailbox, error) {
+	mailbox, err := s.backend.directory.Lookup(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if mailbox == nil {
+		at := strings.LastIndex(address, "@")
+		if at < 0 {
+			return nil, nil
+		}
+		if mailbox, err = s.backend.directory.Lookup(ctx, "*@"+address[at+1:]); err != nil {
+			return nil, err
+		}
+	}
+
+	if mailbox == nil || mailbox.UserID != s.user.ID {
+		return nil, nil
+	}
+	return mailbox, nil
+}
+
+func (s *SubmissionSession) Reset() {
+	s.from = ""
+	s.sender = nil
+	s.recipients = nil
+}
+
+func (s *SubmissionSession) Logout() error {
+	return nil
+}
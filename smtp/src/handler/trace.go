@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/mymail/smtp/src/dkim"
+	"github.com/mymail/smtp/src/dmarc"
+	"github.com/mymail/smtp/src/spf"
+)
+
+// maxSpoolHeader caps how much of a spooled message is scanned for the end
+// of the header block. Messages with a larger header are stored unfiltered.
+const maxSpoolHeader = 1 << 20
+
+// traceHeader builds the fields prepended to a stored message for one
+// recipient: Return-Path and Delivered-To for final delivery, the RFC 8601
+// Authentication-Results, and the RFC 5321 Received trace line.
+func (s *Session) traceHeader(rcpt, emailID string, dkimResults []dkim.SignatureResult,
+	dmarcEval dmarc.Evaluation, disposition dmarc.Policy) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Return-Path: <%s>\r\n", s.from)
+	fmt.Fprintf(&b, "Delivered-To: %s\r\n", rcpt)
+	b.WriteString(s.authResults(dkimResults, dmarcEval, disposition))
+	b.WriteString(s.received(rcpt, emailID))
+
+	return b.String()
+}
+
+// received renders the Received field for an inbound delivery.
+func (s *Session) received(rcpt, emailID string) string {
+	return receivedField(s.conn, s.helo, s.remoteAddr, s.backend.cfg.SMTP.Domain, "ESMTP", emailID, rcpt)
+}
+
+// receivedField renders an RFC 5321 Received field with the client's HELO
+// and address, our hostname, and the negotiated TLS parameters if any. The
+// protocol gets the RFC 3848 "S" suffix when TLS is in use; rcpt may be empty.
+func receivedField(conn *smtp.Conn, helo, remoteAddr, hostname, protocol, emailID, rcpt string) string {
+	if helo == "" {
+		helo = "unknown"
+	}
+
+	var tlsInfo string
+	if state, ok := conn.TLSConnectionState(); ok {
+		protocol += "S"
+		tlsInfo = fmt.Sprintf("\r\n\t(version=%s cipher=%s)",
+			tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	}
+
+	var forClause string
+	if rcpt != "" {
+		forClause = fmt.Sprintf("\r\n\tfor <%s>", rcpt)
+	}
+
+	return fmt.Sprintf("Received: from %s ([%s])\r\n\tby %s (mymail) with %s id %s%s%s;\r\n\t%s\r\n",
+		helo, remoteAddr, hostname, protocol, emailID, tlsInfo, forClause, time.Now().Format(time.RFC1123Z))
+}
+
+// authResults renders the Authentication-Results field. Checks that are
+// disabled are left out; if none ran the result is "none".
+func (s *Session) authResults(dkimResults []dkim.SignatureResult, dmarcEval dmarc.Evaluation,
+	disposition dmarc.Policy) string {
+	var results []string
+
+	if s.spf.Result != "" {
+		property := "smtp.mailfrom=" + s.spf.Sender
+		if s.spf.Identity == spf.IdentityHelo {
+			property = "smtp.helo=" + s.spf.Domain
+		}
+		results = append(results, fmt.Sprintf("spf=%s%s %s", s.spf.Result, reasonProperty(s.spf.Reason), property))
+	}
+
+	if s.backend.cfg.DKIM.Verify {
+		if len(dkimResults) == 0 {
+			results = append(results, "dkim=none")
+		}
+		for _, r := range dkimResults {
+			result := fmt.Sprintf("dkim=%s%s", r.Result, reasonProperty(r.Reason))
+			if r.Domain != "" {
+				result += fmt.Sprintf(" header.d=%s header.s=%s", r.Domain, r.Selector)
+			}
+			if r.HeaderB != "" {
+				result += " header.b=" + r.HeaderB
+			}
+			results = append(results, result)
+		}
+	}
+
+	if dmarcEval.Result != "" {
+		result := fmt.Sprintf("dmarc=%s", dmarcEval.Result)
+		if dmarcEval.Policy != "" {
+			result += fmt.Sprintf(" (p=%s dis=%s)", dmarcEval.Policy, strings.ToUpper(string(disposition)))
+		}
+		if dmarcEval.Domain != "" {
+			result += " header.from=" + dmarcEval.Domain
+		}
+		results = append(results, result)
+	}
+
+	if len(results) == 0 {
+		results = append(results, "none")
+	}
+	return fmt.Sprintf("Authentication-Results: %s;\r\n\t%s\r\n",
+		s.backend.cfg.SMTP.Domain, strings.Join(results, ";\r\n\t"))
+}
+
+// reasonProperty renders an optional reason="..." for a result, stripping
+// anything that would break the quoted string.
+func reasonProperty(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	reason = strings.Map(func(r rune) rune {
+		if r == '"' || r == '\\' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, reason)
+	return fmt.Sprintf(" reason=\"%s\"", reason)
+}
+
+// splitSpool reads the header block of a spooled message and drops any
+// Authentication-Results fields claiming to be ours, since a sender could
+// otherwise forge them (RFC 8601 section 5). It returns the filtered header
+// and the offset at which the rest of the message starts.
+func splitSpool(spool io.ReaderAt, size int64, authservID string) ([]byte, int64) {
+	buf := make([]byte, min(size, maxSpoolHeader))
+	n, _ := spool.ReadAt(buf, 0)
+	buf = buf[:n]
+
+	if bytes.HasPrefix(buf, []byte("\r\n")) {
+		return nil, 0
+	}
+	end := bytes.Index(buf, []byte("\r\n\r\n"))
+	if end < 0 {
+		// No body, or the header is too large to filter
+		if int64(n) < size {
+			return nil, 0
+		}
+		end = len(buf)
+	} else {
+		end += 2
+	}
+
+	var header bytes.Buffer
+	for _, field := range splitFields(buf[:end]) {
+		if isForgedAuthResults(field, authservID) {
+			continue
+		}
+		header.Write(field)
+	}
+	return header.Bytes(), int64(end)
+}
+
+// splitFields splits a header block into fields, keeping folded
+// continuation lines with the field they belong to.
+func splitFields(header []byte) [][]byte {
+	var fields [][]byte
+	start := 0
+	for i := 0; i < len(header); {
+		next := bytes.IndexByte(header[i:], '\n')
+		if next < 0 {
+			next = len(header)
+		} else {
+			next += i + 1
+		}
+		if i > start && header[i] != ' ' && header[i] != '\t' {
+			fields = append(fields, header[start:i])
+			start = i
+		}
+		i = next
+	}
+	if start < len(header) {
+		fields = append(fields, header[start:])
+	}
+	return fields
+}
+
+func isForgedAuthResults(field []byte, authservID string) bool {
+	name, value, ok := bytes.Cut(field, []byte(":"))
+	if !ok || !strings.EqualFold(strings.TrimSpace(string(name)), "Authentication-Results") {
+		return false
+	}
+	id, _, _ := bytes.Cut(value, []byte(";"))
+	parts := strings.Fields(string(id))
+	return len(parts) > 0 && strings.EqualFold(parts[0], authservID)
+}
+
+// dropFields removes every field with the given name from a header block.
+func dropFields(header []byte, name string) []byte {
+	var out bytes.Buffer
+	for _, field := range splitFields(header) {
+		fieldName, _, ok := bytes.Cut(field, []byte(":"))
+		if ok && strings.EqualFold(strings.TrimSpace(string(fieldName)), name) {
+			continue
+		}
+		out.Write(field)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,216 @@
+package keyring
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mymail/smtp/src/config"
+	"github.com/mymail/smtp/src/dkim"
+	"github.com/mymail/smtp/src/storage"
+)
+
+// Keyring holds the DKIM signing keys for each domain. Keys live in the
+// dkim_keys table; the ones in use are parsed once and kept in memory for a
+// short while. Private keys are never written to Redis.
+type Keyring struct {
+	db  *storage.Postgres
+	cfg *config.Config
+	ttl time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	keys    []*dkim.SigningKey
+	expires time.Time
+}
+
+func New(db *storage.Postgres, cfg *config.Config) *Keyring {
+	return &Keyring{
+		db:    db,
+		cfg:   cfg,
+		ttl:   time.Duration(cfg.DKIM.KeyCacheTTL) * time.Second,
+		cache: make(map[string]cacheEntry),
+	}
+}
+
+// Signer returns a signer for mail from domainName using every key currently
+// active for it, or nil if the domain has none.
+func (k *Keyring) Signer(domainName string) (*dkim.Signer, error) {
+	keys, err := k.SigningKeys(domainName)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	return dkim.NewSigner(keys), nil
+}
+
+// SigningKeys returns the parsed keys mail from domainName is signed with.
+func (k *Keyring) SigningKeys(domainName string) ([]*dkim.SigningKey, error) {
+	domainName = strings.ToLower(strings.TrimSuffix(domainName, "."))
+
+	k.mu.Lock()
+	entry, ok := k.cache[domainName]
+	k.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.keys, nil
+	}
+
+	rows, err := k.db.SigningDKIMKeys(domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*dkim.SigningKey, 0, len(rows))
+	for _, row := range rows {
+		signer, err := dkim.ParsePrivateKey(row.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("DKIM key %s for %s: %w", row.Selector, domainName, err)
+		}
+		keys = append(keys, &dkim.SigningKey{Domain: domainName, Selector: row.Selector, Key: signer})
+	}
+
+	k.mu.Lock()
+	k.cache[domainName] = cacheEntry{keys: keys, expires: time.Now().Add(k.ttl)}
+	k.mu.Unlock()
+	return keys, nil
+}
+
+// Invalidate drops the cached keys for a domain.
+func (k *Keyring) Invalidate(domainName string) {
+	k.mu.Lock()
+	delete(k.cache, strings.ToLower(domainName))
+	k.mu.Unlock()
+}
+
+// Generate creates a pending key for a domain. If selector is empty one is
+// derived from the key type and current month, e.g. "ed202610".
+func (k *Keyring) Generate(domainName, selector, keyType string, bits int) (*storage.DKIMKey, error) {
+	d, err := k.findDomain(domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := dkim.GenerateKey(keyType, bits)
+	if err != nil {
+		return nil, err
+	}
+	if selector == "" {
+		selector = strings.TrimSuffix(keyType, "25519") + time.Now().Format("200601")
+	}
+	return k.store(d, selector, signer)
+}
+
+// Import stores an existing PEM private key as a pending key.
+func (k *Keyring) Import(domainName, selector, privateKey string) (*storage.DKIMKey, error) {
+	d, err := k.findDomain(domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := dkim.ParsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return k.store(d, selector, signer)
+}
+
+func (k *Keyring) store(d *storage.Domain, selector string, signer crypto.Signer) (*storage.DKIMKey, error) {
+	privateKey, err := dkim.MarshalPrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := dkim.PublicKeyData(signer)
+	if err != nil {
+		return nil, err
+	}
+	return k.db.CreateDKIMKey(d.ID, selector, dkim.KeyType(signer), privateKey, publicKey)
+}
+
+// Activate starts signing with a key once its record is published. Keys of
+// the same type that were already signing keep doing so for overlap, so
+// verifiers with a stale view of DNS still see a valid signature, and then
+// retire on their own.
+func (k *Keyring) Activate(domainName, selector string, overlap time.Duration) error {
+	d, err := k.findDomain(domainName)
+	if err != nil {
+		return err
+	}
+
+	ok, err := k.db.ActivateDKIMKey(d.ID, selector, overlap)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no DKIM key %s for %s", selector, d.Name)
+	}
+	k.Invalidate(d.Name)
+	return nil
+}
+
+// Retire stops signing with a key right away. Its record can be removed from
+// DNS once mail signed with it is unlikely to be verified again.
+func (k *Keyring) Retire(domainName, selector string) error {
+	d, err := k.findDomain(domainName)
+	if err != nil {
+		return err
+	}
+
+	ok, err := k.db.RetireDKIMKey(d.ID, selector)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no DKIM key %s for %s", selector, d.Name)
+	}
+	k.Invalidate(d.Name)
+	return nil
+}
+
+// List returns every key for a domain, oldest first.
+func (k *Keyring) List(domainName string) ([]storage.DKIMKey, error) {
+	d, err := k.findDomain(domainName)
+	if err != nil {
+		return nil, err
+	}
+	return k.db.ListDKIMKeys(d.ID)
+}
+
+func (k *Keyring) findDomain(name string) (*storage.Domain, error) {
+	d, err := k.db.FindDomain(strings.ToLower(strings.TrimSuffix(name, ".")))
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, fmt.Errorf("unknown domain %s", name)
+	}
+	return d, nil
+}
+
+// RecordName returns the DNS name a key's record is published at.
+func RecordName(selector, domainName string) string {
+	return selector + "._domainkey." + domainName
+}
+
+// ImportLegacy moves the key from DKIM_PRIVATE_KEY into the keyring the first
+// time it sees a DKIM_DOMAIN without keys, so existing setups keep signing.
+func (k *Keyring) ImportLegacy() error {
+	if k.cfg.DKIM.PrivateKey == "" {
+		return nil
+	}
+
+	existing, err := k.List(k.cfg.DKIM.Domain)
+	if err != nil || len(existing) > 0 {
+		return err
+	}
+
+	// Env files often carry the PEM with escaped newlines
+	privateKey := strings.ReplaceAll(k.cfg.DKIM.PrivateKey, `\n`, "\n")
+	if _, err := k.Import(k.cfg.DKIM.Domain, k.cfg.DKIM.Selector, privateKey); err != nil {
+		return err
+	}
+	return k.Activate(k.cfg.DKIM.Domain, k.cfg.DKIM.Selector, 0)
+}
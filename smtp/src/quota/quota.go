@@ -0,0 +1,130 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mymail/smtp/src/config"
+	"github.com/mymail/smtp/src/storage"
+	"github.com/redis/go-redis/v9"
+)
+
+// Checker enforces per-user storage quotas when mail is accepted. Each
+// user's limit and usage are cached in a Redis hash that accepted mail is
+// charged to straight away, so a burst can't outrun the worker storing it.
+// The worker keeps users.used_bytes in Postgres, which the cache reloads
+// from when it expires or the worker's recalculation clears it.
+type Checker struct {
+	db    *storage.Postgres
+	redis *storage.Redis
+	cfg   config.QuotaConfig
+	ttl   time.Duration
+}
+
+// chargeScript adds to the cached usage only while it is cached; otherwise
+// the next check loads it from Postgres, which will include the message
+// once the worker has stored it.
+var chargeScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+  return redis.call('HINCRBY', KEYS[1], 'used', ARGV[1])
+end
+return false
+`)
+
+func New(db *storage.Postgres, redis *storage.Redis, cfg config.QuotaConfig) *Checker {
+	return &Checker{
+		db:    db,
+		redis: redis,
+		cfg:   cfg,
+		ttl:   time.Duration(cfg.CacheTTL) * time.Second,
+	}
+}
+
+// Usage is a user's storage limit and the bytes they hold. A limit of 0 is
+// unlimited.
+type Usage struct {
+	Limit int64
+	Used  int64
+}
+
+// Allows reports whether size more bytes fit within the limit.
+func (u Usage) Allows(size int64) bool {
+	return u.Limit <= 0 || u.Used+size <= u.Limit
+}
+
+// Allow reports whether a message of size bytes fits in the user's quota.
+// Pass a size of 0 to ask only whether the user is already over it.
+func (c *Checker) Allow(ctx context.Context, userID string, size int64) (bool, error) {
+	if !c.cfg.Enabled {
+		return true, nil
+	}
+	usage, err := c.Usage(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return usage.Allows(size), nil
+}
+
+// Usage returns the user's cached limit and usage, loading them from
+// Postgres if they aren't cached.
+func (c *Checker) Usage(ctx context.Context, userID string) (Usage, error) {
+	key := fmt.Sprintf("quota:%s", userID)
+	client := c.redis.GetClient()
+
+	cached, err := client.HMGet(ctx, key, "limit", "used").Result()
+	if err != nil {
+		return Usage{}, err
+	}
+	if limit, ok := cached[0].(string); ok {
+		if used, ok := cached[1].(string); ok {
+			usage := Usage{}
+			usage.Limit, _ = strconv.ParseInt(limit, 10, 64)
+			usage.Used, _ = strconv.ParseInt(used, 10, 64)
+			return usage, nil
+		}
+	}
+
+	quota, err := c.db.GetUserQuota(userID)
+	if err != nil {
+		return Usage{}, err
+	}
+	if quota == nil {
+		return Usage{}, nil
+	}
+	usage := Usage{Limit: c.limit(quota), Used: quota.UsedBytes}
+
+	pipe := client.TxPipeline()
+	pipe.HSet(ctx, key, "limit", usage.Limit, "used", usage.Used)
+	pipe.Expire(ctx, key, c.ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Usage{}, err
+	}
+	return usage, nil
+}
+
+// Charge counts an accepted message against the user's cached usage.
+func (c *Checker) Charge(ctx context.Context, userID string, size int64) error {
+	if !c.cfg.Enabled {
+		return nil
+	}
+	key := fmt.Sprintf("quota:%s", userID)
+	err := chargeScript.Run(ctx, c.redis.GetClient(), []string{key}, size).Err()
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
+
+// limit resolves a user's limit: their own quota, else their plan's, else
+// the default.
+func (c *Checker) limit(quota *storage.UserQuota) int64 {
+	if quota.QuotaBytes != nil {
+		return *quota.QuotaBytes
+	}
+	if limit, ok := c.cfg.PlanBytes[quota.Plan]; ok {
+		return limit
+	}
+	return c.cfg.DefaultBytes
+}
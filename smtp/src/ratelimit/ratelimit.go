@@ -3,64 +3,170 @@ package ratelimit
 import (
 	"context"
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
-	"github.com/mymail/smtp/src/storage"
+	"github.com/mymail/smtp/src/config"
+	"github.com/redis/go-redis/v9"
 )
 
+// RateLimiter enforces token buckets kept in Redis. Each bucket holds up to
+// a scope's limit and refills at that limit per period, so a client can
+// burst up to the limit but not exceed it on average.
+//
+// It only needs to run scripts, so a *redis.Client or any other
+// redis.Scripter, such as one backed by an in-memory Redis, will do.
 type RateLimiter struct {
-	redis *storage.Redis
+	client redis.Scripter
+	cfg    config.RateLimitConfig
+	now    func() time.Time
 }
 
-func New(redis *storage.Redis) *RateLimiter {
-	return &RateLimiter{redis: redis}
+// takeScript refills every bucket in KEYS and takes ARGV[2] tokens from all
+// of them, or from none if any is short, so a message is never counted
+// against one scope and then refused by another. A cost of 0 only checks
+// that a token is left. ARGV[1] is the time in milliseconds, followed by a
+// limit and a period in milliseconds for each key. A bucket expires once it
+// would have refilled.
+var takeScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local cost = tonumber(ARGV[2])
+local buckets = {}
+local allowed = 1
+
+for i, key in ipairs(KEYS) do
+  local limit = tonumber(ARGV[i * 2 + 1])
+  local period = tonumber(ARGV[i * 2 + 2])
+  local state = redis.call('HMGET', key, 'tokens', 'ts')
+  local tokens = tonumber(state[1]) or limit
+  local ts = tonumber(state[2]) or now
+  if now > ts then
+    tokens = math.min(limit, tokens + (now - ts) * limit / period)
+    ts = now
+  end
+  if tokens < math.max(cost, 1) then
+    allowed = 0
+  end
+  buckets[i] = {tokens, ts, period}
+end
+
+for i, key in ipairs(KEYS) do
+  local tokens = buckets[i][1]
+  if allowed == 1 then
+    tokens = tokens - cost
+  end
+  redis.call('HSET', key, 'tokens', tokens, 'ts', buckets[i][2])
+  redis.call('PEXPIRE', key, buckets[i][3])
+end
+
+return allowed
+`)
+
+// bucket is one scope's counter for one client.
+type bucket struct {
+	key    string
+	limit  int
+	period time.Duration
 }
 
+func New(client redis.Scripter, cfg config.RateLimitConfig) *RateLimiter {
+	return &RateLimiter{client: client, cfg: cfg, now: time.Now}
+}
+
+// AllowConnection takes a connection from the buckets of ip and of the
+// network it's in.
 func (r *RateLimiter) AllowConnection(ctx context.Context, ip string) (bool, error) {
-	key := fmt.Sprintf("ratelimit:connection:%s", ip)
-	count, err := r.redis.Incr(ctx, key)
-	if err != nil {
-		return false, err
+	buckets := []bucket{
+		{"ip:" + ip, r.cfg.ConnectionsPerIP, time.Minute},
 	}
-
-	if count == 1 {
-		r.redis.Expire(ctx, key, time.Minute)
+	if network := r.network(ip); network != "" {
+		buckets = append(buckets, bucket{"cidr:" + network, r.cfg.ConnectionsPerCIDR, time.Minute})
 	}
+	return r.take(ctx, 1, buckets...)
+}
 
-	// Allow up to 10 connections per minute per IP
-	return count <= 10, nil
+// AllowSender takes a message from the bucket of the envelope sender's
+// domain. Callers should only pass a domain SPF has verified, or a forger
+// could use up another domain's allowance.
+func (r *RateLimiter) AllowSender(ctx context.Context, domain string) (bool, error) {
+	return r.take(ctx, 1,
+		bucket{"sender:" + strings.ToLower(domain), r.cfg.EmailsPerSenderDomain, time.Hour},
+	)
 }
 
+// AllowEmail takes a message from the user's daily and hourly buckets.
 func (r *RateLimiter) AllowEmail(ctx context.Context, userID string) (bool, error) {
-	// Per user rate limit
-	userKey := fmt.Sprintf("ratelimit:email:user:%s", userID)
-	userCount, err := r.redis.Incr(ctx, userKey)
-	if err != nil {
-		return false, err
-	}
+	return r.take(ctx, 1, r.userBuckets(userID)...)
+}
 
-	if userCount == 1 {
-		r.redis.Expire(ctx, userKey, 24*time.Hour)
-	}
+// AllowDelivery takes a message from the buckets of the user and of the
+// mailbox it is delivered to.
+func (r *RateLimiter) AllowDelivery(ctx context.Context, userID, mailboxID string) (bool, error) {
+	buckets := append(r.userBuckets(userID),
+		bucket{"mailbox:" + mailboxID, r.cfg.EmailsPerMailbox, time.Hour},
+	)
+	return r.take(ctx, 1, buckets...)
+}
 
-	// Per hour rate limit
-	hourKey := fmt.Sprintf("ratelimit:email:hour:%s:%d", userID, time.Now().Unix()/3600)
-	hourCount, err := r.redis.Incr(ctx, hourKey)
-	if err != nil {
-		return false, err
+// AllowAuth reports whether ip may try to authenticate. Only failures count,
+// so a client that signs in correctly is never locked out.
+func (r *RateLimiter) AllowAuth(ctx context.Context, ip string) (bool, error) {
+	return r.take(ctx, 0, r.authBucket(ip))
+}
+
+func (r *RateLimiter) AuthFailed(ctx context.Context, ip string) error {
+	_, err := r.take(ctx, 1, r.authBucket(ip))
+	return err
+}
+
+func (r *RateLimiter) userBuckets(userID string) []bucket {
+	return []bucket{
+		{"user:day:" + userID, r.cfg.EmailsPerUser, 24 * time.Hour},
+		{"user:hour:" + userID, r.cfg.EmailsPerHour, time.Hour},
 	}
+}
 
-	if hourCount == 1 {
-		r.redis.Expire(ctx, hourKey, time.Hour)
+func (r *RateLimiter) authBucket(ip string) bucket {
+	return bucket{"auth:" + ip, r.cfg.AuthFailuresPerIP, 15 * time.Minute}
+}
+
+// network returns the CIDR that ip is grouped into, or "" if ip doesn't
+// parse or the prefix length is out of range.
+func (r *RateLimiter) network(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	bits, prefix := 128, r.cfg.IPv6Prefix
+	if v4 := parsed.To4(); v4 != nil {
+		parsed, bits, prefix = v4, 32, r.cfg.IPv4Prefix
 	}
+	mask := net.CIDRMask(prefix, bits)
+	if mask == nil {
+		return ""
+	}
+	return (&net.IPNet{IP: parsed.Mask(mask), Mask: mask}).String()
+}
 
-	// Check limits
-	if userCount > 1000 {
-		return false, nil
+// take runs takeScript over the buckets whose scope is enabled.
+func (r *RateLimiter) take(ctx context.Context, cost int, buckets ...bucket) (bool, error) {
+	keys := make([]string, 0, len(buckets))
+	args := []interface{}{r.now().UnixMilli(), cost}
+	for _, b := range buckets {
+		if b.limit <= 0 {
+			continue
+		}
+		keys = append(keys, fmt.Sprintf("ratelimit:bucket:%s", b.key))
+		args = append(args, b.limit, b.period.Milliseconds())
 	}
-	if hourCount > 100 {
-		return false, nil
+	if len(keys) == 0 {
+		return true, nil
 	}
 
-	return true, nil
+	allowed, err := takeScript.Run(ctx, r.client, keys, args...).Int()
+	if err != nil {
+		return false, err
+	}
+	return allowed == 1, nil
 }
@@ -0,0 +1,164 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mymail/smtp/src/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// testLimiter is a RateLimiter on an in-memory Redis with a clock that only
+// moves when advanced.
+type testLimiter struct {
+	*RateLimiter
+	now time.Time
+}
+
+func newTestLimiter(t *testing.T, cfg config.RateLimitConfig) *testLimiter {
+	t.Helper()
+	m := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	l := &testLimiter{RateLimiter: New(client, cfg), now: time.Unix(1700000000, 0)}
+	l.RateLimiter.now = func() time.Time { return l.now }
+	return l
+}
+
+func (l *testLimiter) advance(d time.Duration) {
+	l.now = l.now.Add(d)
+}
+
+// takeN calls allow n times and returns how many were allowed.
+func takeN(t *testing.T, n int, allow func(ctx context.Context) (bool, error)) int {
+	t.Helper()
+	allowed := 0
+	for i := 0; i < n; i++ {
+		ok, err := allow(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestBurstAndExhaustion(t *testing.T) {
+	l := newTestLimiter(t, config.RateLimitConfig{EmailsPerMailbox: 5})
+	allow := func(ctx context.Context) (bool, error) { return l.AllowDelivery(ctx, "user-1", "mbx-1") }
+
+	// A full bucket allows a burst up to the limit and no more
+	if got := takeN(t, 5, allow); got != 5 {
+		t.Errorf("burst allowed %d of 5", got)
+	}
+	if got := takeN(t, 3, allow); got != 0 {
+		t.Errorf("allowed %d past the limit", got)
+	}
+
+	// Other mailboxes have their own buckets
+	other := func(ctx context.Context) (bool, error) { return l.AllowDelivery(ctx, "user-1", "mbx-2") }
+	if got := takeN(t, 5, other); got != 5 {
+		t.Errorf("another mailbox allowed %d of 5", got)
+	}
+}
+
+func TestRefill(t *testing.T) {
+	// 60 an hour refills one token a minute
+	l := newTestLimiter(t, config.RateLimitConfig{EmailsPerMailbox: 60})
+	allow := func(ctx context.Context) (bool, error) { return l.AllowDelivery(ctx, "user-1", "mbx-1") }
+
+	if got := takeN(t, 60, allow); got != 60 {
+		t.Fatalf("burst allowed %d of 60", got)
+	}
+
+	l.advance(59 * time.Second)
+	if got := takeN(t, 1, allow); got != 0 {
+		t.Errorf("allowed before a token refilled")
+	}
+	l.advance(time.Second)
+	if got := takeN(t, 2, allow); got != 1 {
+		t.Errorf("allowed %d after one minute, want 1", got)
+	}
+
+	// A refill never takes the bucket past its limit
+	l.advance(10 * time.Hour)
+	if got := takeN(t, 61, allow); got != 60 {
+		t.Errorf("allowed %d after a long idle, want 60", got)
+	}
+}
+
+func TestAllScopesOrNone(t *testing.T) {
+	l := newTestLimiter(t, config.RateLimitConfig{EmailsPerHour: 2, EmailsPerMailbox: 3})
+
+	user1 := func(ctx context.Context) (bool, error) { return l.AllowDelivery(ctx, "user-1", "mbx-1") }
+	if got := takeN(t, 4, user1); got != 2 {
+		t.Fatalf("allowed %d for user-1, want its hourly 2", got)
+	}
+
+	// The messages user-1's bucket refused weren't taken from the mailbox's
+	user2 := func(ctx context.Context) (bool, error) { return l.AllowDelivery(ctx, "user-2", "mbx-1") }
+	if got := takeN(t, 2, user2); got != 1 {
+		t.Errorf("allowed %d for the mailbox, want the 1 left", got)
+	}
+}
+
+func TestConnectionNetwork(t *testing.T) {
+	l := newTestLimiter(t, config.RateLimitConfig{
+		ConnectionsPerIP: 10, ConnectionsPerCIDR: 2, IPv4Prefix: 24, IPv6Prefix: 64,
+	})
+
+	checks := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.2", true},
+		{"192.0.2.3", false}, // third from 192.0.2.0/24
+		{"198.51.100.1", true},
+		{"2001:db8::1", true},
+		{"2001:db8::2", true},
+		{"2001:db8::3", false}, // third from 2001:db8::/64
+		{"2001:db8:1::1", true},
+	}
+	for _, c := range checks {
+		got, err := l.AllowConnection(context.Background(), c.ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("AllowConnection(%s) = %v, want %v", c.ip, got, c.want)
+		}
+	}
+}
+
+func TestAuthCountsFailuresOnly(t *testing.T) {
+	l := newTestLimiter(t, config.RateLimitConfig{AuthFailuresPerIP: 3})
+	ctx := context.Background()
+	allow := func(ctx context.Context) (bool, error) { return l.AllowAuth(ctx, "192.0.2.1") }
+
+	if got := takeN(t, 10, allow); got != 10 {
+		t.Errorf("checks alone allowed %d of 10", got)
+	}
+	for i := 0; i < 3; i++ {
+		if err := l.AuthFailed(ctx, "192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := takeN(t, 1, allow); got != 0 {
+		t.Error("allowed after the failures ran out")
+	}
+}
+
+func TestDisabledScope(t *testing.T) {
+	l := newTestLimiter(t, config.RateLimitConfig{})
+	allow := func(ctx context.Context) (bool, error) { return l.AllowSender(ctx, "example.com") }
+
+	if got := takeN(t, 100, allow); got != 100 {
+		t.Errorf("a disabled scope allowed %d of 100", got)
+	}
+}
@@ -0,0 +1,165 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expand performs macro expansion (RFC 7208 section 7) on a domain-spec.
+func (e *evaluator) expand(spec, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", permError("truncated macro in %q", spec)
+		}
+
+		i++
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 0 {
+				return "", permError("unterminated macro in %q", spec)
+			}
+			value, err := e.expandMacro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			return "", permError("invalid macro in %q", spec)
+		}
+	}
+	return b.String(), nil
+}
+
+// expandMacro expands the body of a single %{...} macro: a letter, an
+// optional digit count, an optional "r" to reverse, and delimiters.
+func (e *evaluator) expandMacro(body, domain string) (string, error) {
+	if body == "" {
+		return "", permError("empty macro")
+	}
+
+	letter := body[0]
+	value, err := e.macroValue(letter|0x20, domain)
+	if err != nil {
+		return "", err
+	}
+
+	rest := body[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		keep, err = strconv.Atoi(rest[:digits])
+		if err != nil || keep == 0 {
+			return "", permError("invalid macro transformer in %%{%s}", body)
+		}
+	}
+	rest = rest[digits:]
+
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse = true
+		rest = rest[1:]
+	}
+
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", permError("invalid macro delimiter in %%{%s}", body)
+		}
+		delimiters = rest
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	value = strings.Join(parts, ".")
+
+	// Upper-case macro letters ask for URL escaping
+	if letter >= 'A' && letter <= 'Z' {
+		value = url.QueryEscape(value)
+	}
+	return value, nil
+}
+
+func (e *evaluator) macroValue(letter byte, domain string) (string, error) {
+	local, senderDomain := splitAddress(e.sender)
+	if local == "" {
+		local = "postmaster"
+	}
+
+	switch letter {
+	case 's':
+		return local + "@" + senderDomain, nil
+	case 'l':
+		return local, nil
+	case 'o':
+		return senderDomain, nil
+	case 'd':
+		return domain, nil
+	case 'i':
+		return dottedIP(e.ip), nil
+	case 'p':
+		// Validated names cost lookups the RFC discourages; "unknown"
+		// is the value it prescribes when none is available
+		return "unknown", nil
+	case 'v':
+		if e.ip.To4() != nil {
+			return "in-addr", nil
+		}
+		return "ip6", nil
+	case 'h':
+		return e.helo, nil
+	case 'c':
+		return e.ip.String(), nil
+	case 'r':
+		return e.checker.receiver, nil
+	case 't':
+		return strconv.FormatInt(time.Now().Unix(), 10), nil
+	}
+	return "", permError("unknown macro letter %q", letter)
+}
+
+// dottedIP formats an address for %{i}: dotted quads for IPv4 and dotted
+// nibbles for IPv6.
+func dottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0x0f))
+	}
+	return strings.Join(nibbles, ".")
+}
@@ -0,0 +1,540 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mymail/smtp/src/dns"
+)
+
+// Result is the outcome of an SPF evaluation (RFC 7208 section 2.6).
+type Result string
+
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Limits from RFC 7208 section 4.6.4.
+const (
+	maxLookups     = 10
+	maxVoidLookups = 2
+	maxMXNames     = 10
+	maxPTRNames    = 10
+)
+
+// Identity names which identity an Evaluation was made for.
+type Identity string
+
+const (
+	IdentityMailFrom Identity = "mailfrom"
+	IdentityHelo     Identity = "helo"
+)
+
+// Evaluation is the result of checking a client against one identity.
+type Evaluation struct {
+	Result   Result
+	Identity Identity
+	Domain   string
+	Sender   string
+	Reason   string
+}
+
+// Checker evaluates SPF policies using the given DNS resolver.
+type Checker struct {
+	resolver dns.Resolver
+	receiver string
+}
+
+// NewChecker returns a Checker. receiver is this host's name and is used for
+// the %{r} macro.
+func NewChecker(resolver dns.Resolver, receiver string) *Checker {
+	return &Checker{resolver: resolver, receiver: receiver}
+}
+
+// Verify checks the envelope sender of a transaction. The MAIL FROM identity
+// is used when present; for the null reverse-path, postmaster@<HELO> is
+// checked instead as RFC 7208 section 2.4 requires.
+func (c *Checker) Verify(ctx context.Context, ip net.IP, helo, mailFrom string) Evaluation {
+	identity := IdentityMailFrom
+	sender := mailFrom
+	if sender == "" {
+		identity = IdentityHelo
+		sender = "postmaster@" + helo
+	}
+
+	local, domain := splitAddress(sender)
+	if local == "" {
+		sender = "postmaster@" + domain
+	}
+
+	result, reason := c.CheckHost(ctx, ip, domain, sender, helo)
+	return Evaluation{
+		Result:   result,
+		Identity: identity,
+		Domain:   domain,
+		Sender:   sender,
+		Reason:   reason,
+	}
+}
+
+// CheckHost implements the check_host() function of RFC 7208 section 4.
+func (c *Checker) CheckHost(ctx context.Context, ip net.IP, domain, sender, helo string) (Result, string) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	e := &evaluator{
+		checker: c,
+		ip:      ip,
+		sender:  sender,
+		helo:    helo,
+	}
+	return e.checkHost(ctx, strings.ToLower(strings.TrimSuffix(domain, ".")))
+}
+
+type evaluator struct {
+	checker *Checker
+	ip      net.IP
+	sender  string
+	helo    string
+	lookups int
+	voids   int
+}
+
+// evalError aborts evaluation with a temperror or permerror result.
+type evalError struct {
+	result Result
+	reason string
+}
+
+func (e *evalError) Error() string {
+	return fmt.Sprintf("%s: %s", e.result, e.reason)
+}
+
+func permError(format string, args ...interface{}) error {
+	return &evalError{result: PermError, reason: fmt.Sprintf(format, args...)}
+}
+
+func tempError(format string, args ...interface{}) error {
+	return &evalError{result: TempError, reason: fmt.Sprintf(format, args...)}
+}
+
+func (e *evaluator) checkHost(ctx context.Context, domain string) (Result, string) {
+	if !validDomain(domain) {
+		return None, fmt.Sprintf("invalid domain %q", domain)
+	}
+
+	record, err := e.fetchRecord(ctx, domain)
+	if err != nil {
+		return resultFromError(err)
+	}
+	if record == "" {
+		return None, fmt.Sprintf("no SPF record for %s", domain)
+	}
+
+	result, reason, err := e.evaluate(ctx, domain, record)
+	if err != nil {
+		return resultFromError(err)
+	}
+	return result, reason
+}
+
+func resultFromError(err error) (Result, string) {
+	if ee, ok := err.(*evalError); ok {
+		return ee.result, ee.reason
+	}
+	return TempError, err.Error()
+}
+
+// fetchRecord returns the domain's SPF record, or "" if it has none.
+func (e *evaluator) fetchRecord(ctx context.Context, domain string) (string, error) {
+	txts, err := e.checker.resolver.LookupTXT(ctx, domain)
+	if dns.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", tempError("TXT lookup for %s: %v", domain, err)
+	}
+
+	var records []string
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+
+	switch len(records) {
+	case 0:
+		return "", nil
+	case 1:
+		return records[0], nil
+	default:
+		return "", permError("multiple SPF records for %s", domain)
+	}
+}
+
+func (e *evaluator) evaluate(ctx context.Context, domain, record string) (Result, string, error) {
+	terms := strings.Fields(record)[1:]
+
+	var redirect string
+	var mechanisms []string
+	seen := map[string]bool{}
+
+	for _, term := range terms {
+		if name, value, ok := parseModifier(term); ok {
+			name = strings.ToLower(name)
+			if name == "redirect" || name == "exp" {
+				if seen[name] {
+					return "", "", permError("duplicate %s modifier", name)
+				}
+				seen[name] = true
+			}
+			if name == "redirect" {
+				redirect = value
+			}
+			// exp= and unknown modifiers don't affect the result
+			continue
+		}
+		mechanisms = append(mechanisms, term)
+	}
+
+	for _, term := range mechanisms {
+		qualifier, mechanism := splitQualifier(term)
+		matched, err := e.match(ctx, domain, mechanism)
+		if err != nil {
+			return "", "", err
+		}
+		if matched {
+			return qualifier, fmt.Sprintf("matched %s in %s", term, domain), nil
+		}
+	}
+
+	if redirect != "" {
+		if err := e.countLookup(); err != nil {
+			return "", "", err
+		}
+		target, err := e.expand(redirect, domain)
+		if err != nil {
+			return "", "", err
+		}
+		result, reason := e.checkHost(ctx, strings.ToLower(target))
+		if result == None {
+			return "", "", permError("redirect target %s has no SPF record", target)
+		}
+		return result, reason, nil
+	}
+
+	return Neutral, fmt.Sprintf("no mechanism matched in %s", domain), nil
+}
+
+func (e *evaluator) match(ctx context.Context, domain, mechanism string) (bool, error) {
+	name, arg := mechanism, ""
+	if i := strings.IndexAny(mechanism, ":/"); i >= 0 {
+		name, arg = mechanism[:i], mechanism[i:]
+	}
+
+	switch strings.ToLower(name) {
+	case "all":
+		if arg != "" {
+			return false, permError("invalid mechanism %q", mechanism)
+		}
+		return true, nil
+
+	case "include":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.domainSpec(arg, domain, true)
+		if err != nil {
+			return false, err
+		}
+		result, reason := e.checkHost(ctx, target)
+		switch result {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case TempError:
+			return false, tempError("include:%s: %s", target, reason)
+		default:
+			return false, permError("include:%s: %s", target, reason)
+		}
+
+	case "a":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		spec, cidr4, cidr6, err := splitCIDR(arg)
+		if err != nil {
+			return false, err
+		}
+		target, err := e.domainSpec(spec, domain, false)
+		if err != nil {
+			return false, err
+		}
+		ips, err := e.lookupIP(ctx, target)
+		if err != nil {
+			return false, err
+		}
+		return e.ipMatches(ips, cidr4, cidr6), nil
+
+	case "mx":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		spec, cidr4, cidr6, err := splitCIDR(arg)
+		if err != nil {
+			return false, err
+		}
+		target, err := e.domainSpec(spec, domain, false)
+		if err != nil {
+			return false, err
+		}
+		mxs, err := e.checker.resolver.LookupMX(ctx, target)
+		if err != nil {
+			if dns.IsNotFound(err) {
+				return false, e.countVoid()
+			}
+			return false, tempError("MX lookup for %s: %v", target, err)
+		}
+		if len(mxs) > maxMXNames {
+			return false, permError("%s has more than %d MX records", target, maxMXNames)
+		}
+		for _, mx := range mxs {
+			ips, err := e.lookupIP(ctx, mx.Host)
+			if err != nil {
+				return false, err
+			}
+			if e.ipMatches(ips, cidr4, cidr6) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "ptr":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.domainSpec(arg, domain, false)
+		if err != nil {
+			return false, err
+		}
+		for _, name := range e.validatedNames(ctx) {
+			if name == target || strings.HasSuffix(name, "."+target) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, permError("invalid mechanism %q", mechanism)
+		}
+		network := arg[1:]
+		if !strings.Contains(network, "/") {
+			if strings.ToLower(name) == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return false, permError("invalid network in %q", mechanism)
+		}
+		return ipNet.Contains(e.ip), nil
+
+	case "exists":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.domainSpec(arg, domain, true)
+		if err != nil {
+			return false, err
+		}
+		ips, err := e.lookupIP(ctx, target)
+		if err != nil {
+			return false, err
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	default:
+		return false, permError("unknown mechanism %q", mechanism)
+	}
+}
+
+// domainSpec expands the ":domain-spec" argument of a mechanism, falling
+// back to the current domain when it is optional and absent.
+func (e *evaluator) domainSpec(arg, domain string, required bool) (string, error) {
+	if arg == "" {
+		if required {
+			return "", permError("missing domain-spec")
+		}
+		return domain, nil
+	}
+	if !strings.HasPrefix(arg, ":") {
+		return "", permError("invalid domain-spec %q", arg)
+	}
+	target, err := e.expand(arg[1:], domain)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(strings.TrimSuffix(target, ".")), nil
+}
+
+func (e *evaluator) countLookup() error {
+	e.lookups++
+	if e.lookups > maxLookups {
+		return permError("more than %d DNS lookups", maxLookups)
+	}
+	return nil
+}
+
+func (e *evaluator) countVoid() error {
+	e.voids++
+	if e.voids > maxVoidLookups {
+		return permError("more than %d void DNS lookups", maxVoidLookups)
+	}
+	return nil
+}
+
+func (e *evaluator) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := e.checker.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, e.countVoid()
+		}
+		return nil, tempError("address lookup for %s: %v", host, err)
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+func (e *evaluator) ipMatches(ips []net.IP, cidr4, cidr6 int) bool {
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if e.ip.To4() != nil && ip4.Mask(net.CIDRMask(cidr4, 32)).Equal(e.ip.Mask(net.CIDRMask(cidr4, 32))) {
+				return true
+			}
+			continue
+		}
+		if e.ip.To4() == nil && ip.Mask(net.CIDRMask(cidr6, 128)).Equal(e.ip.Mask(net.CIDRMask(cidr6, 128))) {
+			return true
+		}
+	}
+	return false
+}
+
+// validatedNames returns the client's PTR names that resolve back to its IP.
+// Lookup errors just shrink the list, per RFC 7208 section 5.5.
+func (e *evaluator) validatedNames(ctx context.Context) []string {
+	names, err := e.checker.resolver.LookupAddr(ctx, e.ip.String())
+	if err != nil {
+		return nil
+	}
+	if len(names) > maxPTRNames {
+		names = names[:maxPTRNames]
+	}
+
+	var validated []string
+	for _, name := range names {
+		addrs, err := e.checker.resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(e.ip) {
+				validated = append(validated, strings.ToLower(strings.TrimSuffix(name, ".")))
+				break
+			}
+		}
+	}
+	return validated
+}
+
+func parseModifier(term string) (string, string, bool) {
+	i := strings.IndexByte(term, '=')
+	if i <= 0 {
+		return "", "", false
+	}
+	name := term[:i]
+	if strings.ContainsAny(name, ":/") {
+		return "", "", false
+	}
+	return name, term[i+1:], true
+}
+
+func splitQualifier(term string) (Result, string) {
+	switch term[0] {
+	case '+':
+		return Pass, term[1:]
+	case '-':
+		return Fail, term[1:]
+	case '~':
+		return SoftFail, term[1:]
+	case '?':
+		return Neutral, term[1:]
+	}
+	return Pass, term
+}
+
+// splitCIDR separates "[:domain-spec][/cidr4][//cidr6]" into its parts.
+func splitCIDR(arg string) (string, int, int, error) {
+	cidr4, cidr6 := 32, 128
+
+	if i := strings.Index(arg, "//"); i >= 0 {
+		n, err := strconv.Atoi(arg[i+2:])
+		if err != nil || n < 0 || n > 128 {
+			return "", 0, 0, permError("invalid ip6 cidr length in %q", arg)
+		}
+		cidr6 = n
+		arg = arg[:i]
+	}
+	if i := strings.LastIndexByte(arg, '/'); i >= 0 {
+		n, err := strconv.Atoi(arg[i+1:])
+		if err != nil || n < 0 || n > 32 {
+			return "", 0, 0, permError("invalid ip4 cidr length in %q", arg)
+		}
+		cidr4 = n
+		arg = arg[:i]
+	}
+	return arg, cidr4, cidr6, nil
+}
+
+func splitAddress(address string) (string, string) {
+	i := strings.LastIndexByte(address, '@')
+	if i < 0 {
+		return "", strings.ToLower(address)
+	}
+	return address[:i], strings.ToLower(address[i+1:])
+}
+
+func validDomain(domain string) bool {
+	if domain == "" || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
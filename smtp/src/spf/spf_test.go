@@ -0,0 +1,243 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/mymail/smtp/src/dns"
+)
+
+// includeChain publishes n.example.com for n in [0, depth), each including
+// the next, ending in a record that passes 192.0.2.10. Checking 0.example.com
+// takes depth DNS lookups.
+func includeChain(depth int) map[string][]string {
+	txt := map[string][]string{}
+	for i := 0; i < depth; i++ {
+		txt[fmt.Sprintf("%d.example.com", i)] = []string{fmt.Sprintf("v=spf1 include:%d.example.com -all", i+1)}
+	}
+	txt[fmt.Sprintf("%d.example.com", depth)] = []string{"v=spf1 ip4:192.0.2.10 -all"}
+	return txt
+}
+
+func TestCheckHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolver *dns.Static
+		domain   string
+		ip       string
+		want     Result
+	}{
+		{
+			name: "include pass",
+			resolver: &dns.Static{TXT: map[string][]string{
+				"example.com":      {"v=spf1 include:_spf.example.net -all"},
+				"_spf.example.net": {"v=spf1 ip4:192.0.2.0/24 -all"},
+			}},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   Pass,
+		},
+		{
+			name: "include fail falls through to -all",
+			resolver: &dns.Static{TXT: map[string][]string{
+				"example.com":      {"v=spf1 include:_spf.example.net -all"},
+				"_spf.example.net": {"v=spf1 ip4:192.0.2.0/24 -all"},
+			}},
+			domain: "example.com",
+			ip:     "198.51.100.1",
+			want:   Fail,
+		},
+		{
+			name: "include without a record",
+			resolver: &dns.Static{TXT: map[string][]string{
+				"example.com": {"v=spf1 include:missing.example.net -all"},
+			}},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   PermError,
+		},
+		{
+			name: "include temperror",
+			resolver: &dns.Static{
+				TXT:  map[string][]string{"example.com": {"v=spf1 include:_spf.example.net -all"}},
+				Fail: map[string]bool{"_spf.example.net": true},
+			},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   TempError,
+		},
+		{
+			name: "redirect pass",
+			resolver: &dns.Static{TXT: map[string][]string{
+				"example.com":      {"v=spf1 redirect=_spf.example.net"},
+				"_spf.example.net": {"v=spf1 ip4:192.0.2.0/24 ~all"},
+			}},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   Pass,
+		},
+		{
+			name: "redirect takes the target's result",
+			resolver: &dns.Static{TXT: map[string][]string{
+				"example.com":      {"v=spf1 redirect=_spf.example.net"},
+				"_spf.example.net": {"v=spf1 ip4:192.0.2.0/24 ~all"},
+			}},
+			domain: "example.com",
+			ip:     "198.51.100.1",
+			want:   SoftFail,
+		},
+		{
+			name: "redirect ignored after a match",
+			resolver: &dns.Static{TXT: map[string][]string{
+				"example.com": {"v=spf1 ip4:198.51.100.1 redirect=_spf.example.net"},
+			}},
+			domain: "example.com",
+			ip:     "198.51.100.1",
+			want:   Pass,
+		},
+		{
+			name: "redirect without a record",
+			resolver: &dns.Static{TXT: map[string][]string{
+				"example.com": {"v=spf1 redirect=missing.example.net"},
+			}},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   PermError,
+		},
+		{
+			name:     "ten lookups allowed",
+			resolver: &dns.Static{TXT: includeChain(maxLookups)},
+			domain:   "0.example.com",
+			ip:       "192.0.2.10",
+			want:     Pass,
+		},
+		{
+			name:     "eleventh lookup",
+			resolver: &dns.Static{TXT: includeChain(maxLookups + 1)},
+			domain:   "0.example.com",
+			ip:       "192.0.2.10",
+			want:     PermError,
+		},
+		{
+			name: "include loop",
+			resolver: &dns.Static{TXT: map[string][]string{
+				"example.com": {"v=spf1 include:example.com -all"},
+			}},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   PermError,
+		},
+		{
+			name: "two void lookups allowed",
+			resolver: &dns.Static{TXT: map[string][]string{
+				"example.com": {"v=spf1 a:v1.example.com mx:v2.example.com -all"},
+			}},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   Fail,
+		},
+		{
+			name: "third void lookup",
+			resolver: &dns.Static{TXT: map[string][]string{
+				"example.com": {"v=spf1 a:v1.example.com mx:v2.example.com a:v3.example.com -all"},
+			}},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   PermError,
+		},
+		{
+			name: "ptr with a validated name",
+			resolver: &dns.Static{
+				TXT: map[string][]string{"example.com": {"v=spf1 ptr -all"}},
+				PTR: map[string][]string{"192.0.2.10": {"mail.example.com."}},
+				IP:  map[string][]net.IP{"mail.example.com": {net.ParseIP("192.0.2.10")}},
+			},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   Pass,
+		},
+		{
+			name: "ptr whose name doesn't resolve back",
+			resolver: &dns.Static{
+				TXT: map[string][]string{"example.com": {"v=spf1 ptr -all"}},
+				PTR: map[string][]string{"192.0.2.10": {"mail.example.com."}},
+				IP:  map[string][]net.IP{"mail.example.com": {net.ParseIP("198.51.100.1")}},
+			},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   Fail,
+		},
+		{
+			name: "ptr outside the domain",
+			resolver: &dns.Static{
+				TXT: map[string][]string{"example.com": {"v=spf1 ptr -all"}},
+				PTR: map[string][]string{"192.0.2.10": {"mail.example.net."}},
+				IP:  map[string][]net.IP{"mail.example.net": {net.ParseIP("192.0.2.10")}},
+			},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   Fail,
+		},
+		{
+			name: "exists with macro",
+			resolver: &dns.Static{
+				TXT: map[string][]string{"example.com": {"v=spf1 exists:%{i}._spf.example.com -all"}},
+				IP:  map[string][]net.IP{"192.0.2.10._spf.example.com": {net.ParseIP("127.0.0.2")}},
+			},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   Pass,
+		},
+		{
+			name: "exists without a record",
+			resolver: &dns.Static{
+				TXT: map[string][]string{"example.com": {"v=spf1 exists:%{i}._spf.example.com -all"}},
+			},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   Fail,
+		},
+		{
+			name: "no record",
+			resolver: &dns.Static{TXT: map[string][]string{
+				"example.com": {"google-site-verification=abc"},
+			}},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   None,
+		},
+		{
+			name: "multiple records",
+			resolver: &dns.Static{TXT: map[string][]string{
+				"example.com": {"v=spf1 -all", "v=spf1 +all"},
+			}},
+			domain: "example.com",
+			ip:     "192.0.2.10",
+			want:   PermError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewChecker(tt.resolver, "mx.example.org")
+			got, reason := c.CheckHost(context.Background(), net.ParseIP(tt.ip), tt.domain, "user@"+tt.domain, "mail.example.org")
+			if got != tt.want {
+				t.Errorf("CheckHost() = %s (%s), want %s", got, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyNullSender(t *testing.T) {
+	resolver := &dns.Static{TXT: map[string][]string{
+		"mail.example.org": {"v=spf1 ip4:192.0.2.10 -all"},
+	}}
+	c := NewChecker(resolver, "mx.example.org")
+
+	got := c.Verify(context.Background(), net.ParseIP("192.0.2.10"), "mail.example.org", "")
+	if got.Result != Pass || got.Identity != IdentityHelo || got.Sender != "postmaster@mail.example.org" {
+		t.Errorf("Verify() = %+v, want a HELO pass for postmaster@mail.example.org", got)
+	}
+}
@@ -81,3 +81,11 @@ func (m *MinIO) Get(ctx context.Context, path string) (io.Reader, error) {
 func (m *MinIO) Delete(ctx context.Context, path string) error {
 	return m.client.RemoveObject(ctx, m.bucket, path, minio.RemoveObjectOptions{})
 }
+
+// Copy duplicates an object within the bucket, server-side.
+func (m *MinIO) Copy(ctx context.Context, src, dst string) error {
+	_, err := m.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: m.bucket, Object: dst},
+		minio.CopySrcOptions{Bucket: m.bucket, Object: src})
+	return err
+}
@@ -2,13 +2,17 @@ package storage
 
 import (
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 )
 
+// ErrAddressTaken is returned by CreateTempMailbox when the address is the
+// email of a registered account, which a temp mailbox mustn't be attached to.
+var ErrAddressTaken = errors.New("address belongs to a registered user")
+
 type Postgres struct {
 	db *sqlx.DB
 }
@@ -36,8 +40,10 @@ func (p *Postgres) GetDB() *sqlx.DB {
 
 func (p *Postgres) FindMailbox(address string) (*Mailbox, error) {
 	var mailbox Mailbox
-	query := `SELECT id, user_id, address, is_alias, is_temp, created_at, updated_at 
-	          FROM mailboxes WHERE address = $1 LIMIT 1`
+	query := `SELECT id, user_id, address, is_alias, is_temp, expires_at, created_at, updated_at
+	          FROM mailboxes
+	          WHERE address = $1 AND (expires_at IS NULL OR expires_at > NOW())
+	          LIMIT 1`
 
 	err := p.db.Get(&mailbox, query, address)
 	if err == sql.ErrNoRows {
@@ -49,39 +55,271 @@ func (p *Postgres) FindMailbox(address string) (*Mailbox, error) {
 	return &mailbox, nil
 }
 
-func (p *Postgres) CreateTempMailbox(address string) (*Mailbox, error) {
+func (p *Postgres) ListMailboxAddresses() ([]string, error) {
+	var addresses []string
+	err := p.db.Select(&addresses, `SELECT address FROM mailboxes`)
+	return addresses, err
+}
+
+// CreateTempMailbox provisions a mailbox that expires after ttl. Each temp
+// mailbox gets its own placeholder user (with no usable password) to satisfy
+// the user foreign key; the worker removes both once the mailbox expires. A
+// placeholder left without a mailbox is reused. It returns nil if another
+// session created the address first, and ErrAddressTaken if a registered
+// user has that email.
+func (p *Postgres) CreateTempMailbox(address string, ttl time.Duration) (*Mailbox, error) {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the user serializes sessions provisioning the same address,
+	// so the check for its mailbox below sees any a rival committed
+	_, err = tx.Exec(`INSERT INTO users (id, email, password_hash, created_at, updated_at)
+	                  VALUES (gen_random_uuid(), $1, '', NOW(), NOW())
+	                  ON CONFLICT (email) DO NOTHING`, address)
+	if err != nil {
+		return nil, err
+	}
+	var user struct {
+		ID           string `db:"id"`
+		PasswordHash string `db:"password_hash"`
+	}
+	if err := tx.Get(&user, `SELECT id, password_hash FROM users WHERE email = $1 FOR UPDATE`, address); err != nil {
+		return nil, err
+	}
+	if user.PasswordHash != "" {
+		return nil, ErrAddressTaken
+	}
+
+	var exists bool
+	if err := tx.Get(&exists, `SELECT EXISTS (SELECT 1 FROM mailboxes WHERE address = $1)`, address); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, nil
+	}
+
 	var mailbox Mailbox
-	query := `INSERT INTO mailboxes (id, user_id, address, is_alias, is_temp, created_at, updated_at)
-	          VALUES (gen_random_uuid(), gen_random_uuid(), $1, false, true, NOW(), NOW())
-	          RETURNING id, user_id, address, is_alias, is_temp, created_at, updated_at`
+	query := `INSERT INTO mailboxes (id, user_id, address, is_alias, is_temp, expires_at, created_at, updated_at)
+	          VALUES (gen_random_uuid(), $1, $2, false, true, NOW() + make_interval(secs => $3), NOW(), NOW())
+	          RETURNING id, user_id, address, is_alias, is_temp, expires_at, created_at, updated_at`
+	if err := tx.Get(&mailbox, query, user.ID, address, ttl.Seconds()); err != nil {
+		return nil, err
+	}
+	return &mailbox, tx.Commit()
+}
 
-	err := p.db.Get(&mailbox, query, address)
+func (p *Postgres) FindDomain(name string) (*Domain, error) {
+	var domain Domain
+	query := `SELECT id, name, enabled, catch_all, max_message_size, reject_policy, dmarc_override, created_at, updated_at
+	          FROM domains WHERE name = $1 LIMIT 1`
+
+	err := p.db.Get(&domain, query, name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &mailbox, nil
+	return &domain, nil
+}
+
+// dkimKeyColumns reports keys whose overlap window has passed as retired.
+const dkimKeyColumns = `id, domain_id, selector, algorithm, private_key, public_key,
+	CASE WHEN status = 'active' AND retire_at <= NOW() THEN 'retired' ELSE status END AS status,
+	activated_at, retire_at, created_at, updated_at`
+
+func (p *Postgres) ListDKIMKeys(domainID string) ([]DKIMKey, error) {
+	keys := []DKIMKey{}
+	query := `SELECT ` + dkimKeyColumns + ` FROM dkim_keys WHERE domain_id = $1 ORDER BY created_at`
+	err := p.db.Select(&keys, query, domainID)
+	return keys, err
+}
+
+// SigningDKIMKeys returns the keys mail from a domain is currently signed
+// with. There are several while a rotation's overlap window is open.
+func (p *Postgres) SigningDKIMKeys(domainName string) ([]DKIMKey, error) {
+	keys := []DKIMKey{}
+	query := `SELECT ` + dkimKeyColumns + ` FROM dkim_keys
+	          WHERE domain_id = (SELECT id FROM domains WHERE name = $1)
+	            AND status = 'active' AND (retire_at IS NULL OR retire_at > NOW())
+	          ORDER BY activated_at DESC`
+	err := p.db.Select(&keys, query, domainName)
+	return keys, err
+}
+
+// CreateDKIMKey stores a new key as pending: it isn't used for signing
+// until it has been published and activated.
+func (p *Postgres) CreateDKIMKey(domainID, selector, algorithm, privateKey, publicKey string) (*DKIMKey, error) {
+	var key DKIMKey
+	query := `INSERT INTO dkim_keys (id, domain_id, selector, algorithm, private_key, public_key, status, created_at, updated_at)
+	          VALUES (gen_random_uuid(), $1, $2, $3, $4, $5, 'pending', NOW(), NOW())
+	          RETURNING ` + dkimKeyColumns
+
+	err := p.db.Get(&key, query, domainID, selector, algorithm, privateKey, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
 }
 
-func (p *Postgres) CreateQueueJob(jobType string, payload map[string]interface{}) error {
-	// Marshal payload to JSON for JSONB column
-	payloadJSON, err := json.Marshal(payload)
+// ActivateDKIMKey starts signing with a key. Keys of the same algorithm
+// already signing for the domain keep doing so for overlap, then retire;
+// those of other algorithms are left alone so that, say, an RSA and an
+// Ed25519 key can sign side by side. It returns false if the domain has no
+// such key.
+func (p *Postgres) ActivateDKIMKey(domainID, selector string, overlap time.Duration) (bool, error) {
+	tx, err := p.db.Beginx()
 	if err != nil {
-		return err
+		return false, err
 	}
+	defer tx.Rollback()
 
-	query := `INSERT INTO queue_jobs (id, type, payload, status, attempts, created_at)
-	          VALUES (gen_random_uuid(), $1, $2::jsonb, 'pending', 0, NOW())`
+	_, err = tx.Exec(`UPDATE dkim_keys SET retire_at = NOW() + make_interval(secs => $3), updated_at = NOW()
+	                  WHERE domain_id = $1 AND selector <> $2 AND status = 'active'
+	                    AND algorithm = (SELECT algorithm FROM dkim_keys WHERE domain_id = $1 AND selector = $2)
+	                    AND (retire_at IS NULL OR retire_at > NOW() + make_interval(secs => $3))`,
+		domainID, selector, overlap.Seconds())
+	if err != nil {
+		return false, err
+	}
+
+	result, err := tx.Exec(`UPDATE dkim_keys SET status = 'active', activated_at = COALESCE(activated_at, NOW()),
+	                          retire_at = NULL, updated_at = NOW()
+	                        WHERE domain_id = $1 AND selector = $2`, domainID, selector)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	return true, tx.Commit()
+}
+
+// RetireDKIMKey stops signing with a key immediately. It returns false if
+// the domain has no such key.
+func (p *Postgres) RetireDKIMKey(domainID, selector string) (bool, error) {
+	result, err := p.db.Exec(`UPDATE dkim_keys SET status = 'retired', retire_at = LEAST(COALESCE(retire_at, NOW()), NOW()),
+	                            updated_at = NOW()
+	                          WHERE domain_id = $1 AND selector = $2`, domainID, selector)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// FindUserByLogin finds the user a submission client authenticates as. The
+// login is either the account email or the address of one of its mailboxes.
+func (p *Postgres) FindUserByLogin(login string) (*User, error) {
+	var user User
+	query := `SELECT id, email, password_hash, created_at, updated_at FROM users WHERE email = $1
+	          UNION
+	          SELECT u.id, u.email, u.password_hash, u.created_at, u.updated_at
+	          FROM users u JOIN mailboxes m ON m.user_id = u.id
+	          WHERE m.address = $1 AND (m.expires_at IS NULL OR m.expires_at > NOW())
+	          LIMIT 1`
+
+	err := p.db.Get(&user, query, login)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
 
-	_, err = p.db.Exec(query, jobType, payloadJSON)
+func (p *Postgres) ListAppPasswords(userID string) ([]AppPassword, error) {
+	passwords := []AppPassword{}
+	query := `SELECT id, user_id, name, password_hash, last_used_at, created_at
+	          FROM app_passwords WHERE user_id = $1`
+	err := p.db.Select(&passwords, query, userID)
+	return passwords, err
+}
+
+func (p *Postgres) TouchAppPassword(id string) error {
+	_, err := p.db.Exec(`UPDATE app_passwords SET last_used_at = NOW() WHERE id = $1`, id)
 	return err
 }
 
+// GetUserQuota returns the fields a user's storage quota is decided by, or
+// nil if there is no such user.
+func (p *Postgres) GetUserQuota(userID string) (*UserQuota, error) {
+	var quota UserQuota
+	err := p.db.Get(&quota, `SELECT plan, quota_bytes, used_bytes FROM users WHERE id = $1`, userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &quota, nil
+}
+
+type User struct {
+	ID           string    `db:"id"`
+	Email        string    `db:"email"`
+	PasswordHash string    `db:"password_hash"`
+	CreatedAt    time.Time `db:"created_at"`
+	UpdatedAt    time.Time `db:"updated_at"`
+}
+
+// UserQuota is a user's plan, their own quota if it overrides the plan's,
+// and the bytes their mailboxes hold.
+type UserQuota struct {
+	Plan       string `db:"plan"`
+	QuotaBytes *int64 `db:"quota_bytes"`
+	UsedBytes  int64  `db:"used_bytes"`
+}
+
+type AppPassword struct {
+	ID           string     `db:"id"`
+	UserID       string     `db:"user_id"`
+	Name         string     `db:"name"`
+	PasswordHash string     `db:"password_hash"`
+	LastUsedAt   *time.Time `db:"last_used_at"`
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
 type Mailbox struct {
-	ID        string    `db:"id"`
-	UserID    string    `db:"user_id"`
-	Address   string    `db:"address"`
-	IsAlias   bool      `db:"is_alias"`
-	IsTemp    bool      `db:"is_temp"`
-	CreatedAt time.Time `db:"created_at"`
-	UpdatedAt time.Time `db:"updated_at"`
+	ID        string     `db:"id"`
+	UserID    string     `db:"user_id"`
+	Address   string     `db:"address"`
+	IsAlias   bool       `db:"is_alias"`
+	IsTemp    bool       `db:"is_temp"`
+	ExpiresAt *time.Time `db:"expires_at"`
+	CreatedAt time.Time  `db:"created_at"`
+	UpdatedAt time.Time  `db:"updated_at"`
+}
+
+type Domain struct {
+	ID             string    `db:"id" json:"id"`
+	Name           string    `db:"name" json:"name"`
+	Enabled        bool      `db:"enabled" json:"enabled"`
+	CatchAll       bool      `db:"catch_all" json:"catch_all"`
+	MaxMessageSize int64     `db:"max_message_size" json:"max_message_size"`
+	RejectPolicy   string    `db:"reject_policy" json:"reject_policy"`
+	DMARCOverride  string    `db:"dmarc_override" json:"dmarc_override"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// DKIMKey is a signing key for a domain. Status moves from pending (generated,
+// awaiting DNS) to active (signing) to retired; an active key with a passed
+// RetireAt is reported as retired.
+type DKIMKey struct {
+	ID          string     `db:"id"`
+	DomainID    string     `db:"domain_id"`
+	Selector    string     `db:"selector"`
+	Algorithm   string     `db:"algorithm"`
+	PrivateKey  string     `db:"private_key"`
+	PublicKey   string     `db:"public_key"`
+	Status      string     `db:"status"`
+	ActivatedAt *time.Time `db:"activated_at"`
+	RetireAt    *time.Time `db:"retire_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+	UpdatedAt   time.Time  `db:"updated_at"`
 }
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -57,3 +58,28 @@ func (r *Redis) Exists(ctx context.Context, key string) (bool, error) {
 	result, err := r.client.Exists(ctx, key).Result()
 	return result > 0, err
 }
+
+func (r *Redis) Del(ctx context.Context, keys ...string) error {
+	return r.client.Del(ctx, keys...).Err()
+}
+
+// GetJSON decodes the value stored at key into v. The returned bool reports
+// whether the key existed, so callers can tell a cache miss from an error.
+func (r *Redis) GetJSON(ctx context.Context, key string, v interface{}) (bool, error) {
+	data, err := r.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func (r *Redis) SetJSON(ctx context.Context, key string, v interface{}, expiration time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, key, data, expiration).Err()
+}
@@ -4,12 +4,16 @@ import (
 	"context"
 	"flag"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/mymail/shared/queue"
+	"github.com/mymail/worker/src/cli"
 	"github.com/mymail/worker/src/config"
+	"github.com/mymail/worker/src/delivery"
 	"github.com/mymail/worker/src/processor"
 	"github.com/mymail/worker/src/storage"
 )
@@ -21,6 +25,10 @@ func main() {
 
 	cfg := config.Load(cfgPath)
 
+	if flag.Arg(0) == "dlq" {
+		os.Exit(cli.RunDLQ(cfg, flag.Args()[1:]))
+	}
+
 	// Initialize storage
 	db, err := storage.NewPostgres(cfg.Database.URL)
 	if err != nil {
@@ -34,8 +42,28 @@ func main() {
 	}
 	defer redis.Close()
 
+	minio, err := storage.NewMinIO(cfg.MinIO)
+	if err != nil {
+		log.Fatalf("Failed to connect to MinIO: %v", err)
+	}
+
+	jobs, err := queue.Open(context.Background(), cfg.Queue.Backend, db.GetDB(), cfg.Database.URL, redis.GetClient())
+	if err != nil {
+		log.Fatalf("Failed to open job queue: %v", err)
+	}
+
+	// Outbound delivery uses system DNS and direct connections
+	outbound := delivery.New(net.DefaultResolver, &net.Dialer{
+		Timeout: time.Duration(cfg.Outbound.ConnectTimeout) * time.Second,
+	}, delivery.Options{
+		Hostname:       cfg.Outbound.Hostname,
+		Port:           cfg.Outbound.Port,
+		RequireTLS:     cfg.Outbound.RequireTLS,
+		CommandTimeout: time.Duration(cfg.Outbound.CommandTimeout) * time.Second,
+	})
+
 	// Create processor
-	proc := processor.New(db, redis, cfg)
+	proc := processor.New(db, redis, minio, jobs, outbound, cfg)
 
 	// Start workers
 	ctx, cancel := context.WithCancel(context.Background())
@@ -44,7 +72,7 @@ func main() {
 	// Start processing loop
 	go proc.Start(ctx)
 
-	// Graceful shutdown
+	// Graceful shutdown: stop claiming, then let running jobs finish
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
@@ -52,6 +80,11 @@ func main() {
 	log.Println("Shutting down worker...")
 	cancel()
 
-	// Wait for workers to finish
-	time.Sleep(2 * time.Second)
+	if !proc.Shutdown(time.Duration(cfg.Worker.ShutdownTimeout) * time.Second) {
+		// Unfinished jobs were released for other workers to run again
+		db.Close()
+		redis.Close()
+		os.Exit(1)
+	}
+	log.Println("Worker stopped")
 }
@@ -0,0 +1,184 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mymail/shared/queue"
+	"github.com/mymail/worker/src/config"
+	"github.com/mymail/worker/src/storage"
+)
+
+const dlqUsage = `usage: worker dlq <command> [flags] [job-id]
+
+Jobs that fail on every attempt are marked dead and kept with their last
+error until they are replayed or purged. Dead jobs are read from the queue
+backend selected by QUEUE_BACKEND.
+
+commands:
+  list                 show dead jobs, most recent first (-type, -limit)
+  inspect <job-id>     show a job's payload and last error
+  replay <job-id>      queue a dead job again with its attempts reset
+  replay -all          queue every dead job again (-type)
+  purge <job-id>       delete a dead job
+  purge -all           delete dead jobs (-type, -older-than)`
+
+// RunDLQ implements the "worker dlq" subcommand for managing dead jobs.
+func RunDLQ(cfg *config.Config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, dlqUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("dlq "+args[0], flag.ContinueOnError)
+	jobType := fs.String("type", "", "only jobs of this type")
+	limit := fs.Int("limit", 50, "maximum jobs to list")
+	all := fs.Bool("all", false, "replay or purge every matching dead job")
+	olderThan := fs.Duration("older-than", 0, "purge only jobs that died at least this long ago")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	rest := fs.Args()
+
+	var id string
+	switch args[0] {
+	case "list":
+		if len(rest) != 0 {
+			fmt.Fprintln(os.Stderr, dlqUsage)
+			return 2
+		}
+	case "inspect":
+		if len(rest) != 1 {
+			fmt.Fprintln(os.Stderr, dlqUsage)
+			return 2
+		}
+		id = rest[0]
+	case "replay", "purge":
+		if *all == (len(rest) == 1) || len(rest) > 1 {
+			fmt.Fprintln(os.Stderr, dlqUsage)
+			return 2
+		}
+		if !*all {
+			id = rest[0]
+		}
+	default:
+		fmt.Fprintln(os.Stderr, dlqUsage)
+		return 2
+	}
+
+	// Dead jobs live wherever the queue does
+	ctx := context.Background()
+	var dead queue.DeadLetters
+	if cfg.Queue.Backend == queue.BackendRedis {
+		redis, err := storage.NewRedis(cfg.Redis.URL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to connect to Redis: %v\n", err)
+			return 1
+		}
+		defer redis.Close()
+		if dead, err = queue.NewRedis(ctx, redis.GetClient()); err != nil {
+			return fail(err)
+		}
+	} else {
+		db, err := storage.NewPostgres(cfg.Database.URL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to connect to database: %v\n", err)
+			return 1
+		}
+		defer db.Close()
+		dead = queue.NewPostgres(db.GetDB(), cfg.Database.URL)
+	}
+
+	switch args[0] {
+	case "list":
+		jobs, err := dead.ListDead(ctx, *jobType, *limit)
+		if err != nil {
+			return fail(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTYPE\tATTEMPTS\tDIED\tLAST ERROR")
+		for _, job := range jobs {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", job.ID, job.Type, job.Attempts,
+				formatTime(job.FailedAt), truncate(lastError(job), 80))
+		}
+		w.Flush()
+
+	case "inspect":
+		job, err := dead.GetDead(ctx, id)
+		if err != nil {
+			return fail(err)
+		}
+		if job == nil {
+			return fail(fmt.Errorf("no dead job %s", id))
+		}
+		fmt.Printf("ID:         %s\n", job.ID)
+		fmt.Printf("Type:       %s\n", job.Type)
+		fmt.Printf("Status:     %s\n", job.Status)
+		fmt.Printf("Attempts:   %d\n", job.Attempts)
+		fmt.Printf("Created:    %s\n", job.CreatedAt.Format(time.RFC3339))
+		fmt.Printf("Died:       %s\n", formatTime(job.FailedAt))
+		fmt.Printf("Last error: %s\n", lastError(job))
+		fmt.Println("Payload:")
+		var payload bytes.Buffer
+		if json.Indent(&payload, job.Payload, "  ", "  ") != nil {
+			payload.Write(job.Payload)
+		}
+		fmt.Printf("  %s\n", payload.String())
+
+	case "replay":
+		n, err := dead.ReplayDead(ctx, id, *jobType)
+		if err != nil {
+			return fail(err)
+		}
+		if id != "" && n == 0 {
+			return fail(fmt.Errorf("no dead job %s", id))
+		}
+		fmt.Printf("Replayed %d jobs\n", n)
+
+	case "purge":
+		n, err := dead.PurgeDead(ctx, id, *jobType, *olderThan)
+		if err != nil {
+			return fail(err)
+		}
+		if id != "" && n == 0 {
+			return fail(fmt.Errorf("no dead job %s", id))
+		}
+		fmt.Printf("Purged %d jobs\n", n)
+	}
+	return 0
+}
+
+func fail(err error) int {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	return 1
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func lastError(job *queue.Job) string {
+	if job.LastError == "" {
+		return "-"
+	}
+	return job.LastError
+}
+
+// truncate shortens s to one line of at most n characters for tables.
+func truncate(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
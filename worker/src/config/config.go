@@ -3,12 +3,19 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
 	Database DatabaseConfig
 	Redis    RedisConfig
+	MinIO    MinIOConfig
 	Worker   WorkerConfig
+	TempMail TempMailConfig
+	Outbound OutboundConfig
+	Queue    QueueConfig
+	Quota    QuotaConfig
 }
 
 type DatabaseConfig struct {
@@ -19,9 +26,75 @@ type RedisConfig struct {
 	URL string
 }
 
+type MinIOConfig struct {
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	UseSSL    bool
+}
+
+// WorkerConfig sizes the job pool. Workers wake on NOTIFY when jobs are
+// queued and otherwise poll every PollInterval seconds. A claimed job is
+// leased for LeaseDuration seconds and the lease renewed every
+// HeartbeatInterval; the reaper returns jobs with expired leases to the
+// queue every ReaperInterval. On shutdown running jobs get ShutdownTimeout
+// seconds to finish before they are released.
+// Failed jobs are retried with exponential backoff between RetryBaseDelay and
+// RetryMaxDelay seconds, and marked dead after MaxAttempts.
+// The ByType maps override the job handlers' own settings for one type:
+// how many of its jobs run at once, the timeout in seconds for an attempt,
+// and its attempts.
 type WorkerConfig struct {
-	Concurrency int
-	BatchSize   int
+	Concurrency       int
+	BatchSize         int
+	PollInterval      int
+	LeaseDuration     int
+	HeartbeatInterval int
+	ReaperInterval    int
+	ShutdownTimeout   int
+
+	MaxAttempts    int
+	RetryBaseDelay int
+	RetryMaxDelay  int
+
+	ConcurrencyByType map[string]int
+	TimeoutByType     map[string]int
+	MaxAttemptsByType map[string]int
+}
+
+type TempMailConfig struct {
+	CleanupInterval  int
+	CleanupBatchSize int
+}
+
+// OutboundConfig controls delivery of submitted mail to remote servers.
+// RetrySchedule gives the wait after each consecutive temporary failure; the
+// last entry repeats until MaxQueueLifetime (seconds) has passed, after which
+// the message bounces.
+type OutboundConfig struct {
+	Hostname         string
+	Port             int
+	RequireTLS       bool
+	ConnectTimeout   int
+	CommandTimeout   int
+	RetrySchedule    []time.Duration
+	MaxQueueLifetime int
+	PollInterval     int
+	Concurrency      int
+}
+
+// QuotaConfig schedules the recalculation of storage usage from the stored
+// emails, every RecalcInterval seconds, RecalcBatchSize users at a time.
+type QuotaConfig struct {
+	RecalcInterval  int
+	RecalcBatchSize int
+}
+
+// QueueConfig selects the job queue backend; it must match the smtp
+// service's.
+type QueueConfig struct {
+	Backend string
 }
 
 func Load(configPath string) *Config {
@@ -32,9 +105,52 @@ func Load(configPath string) *Config {
 		Redis: RedisConfig{
 			URL: getEnv("REDIS_URL", "redis://redis:6379"),
 		},
+		MinIO: MinIOConfig{
+			Endpoint:  getEnv("MINIO_ENDPOINT", "minio:9000"),
+			AccessKey: getEnv("MINIO_ACCESS_KEY", "minioadmin"),
+			SecretKey: getEnv("MINIO_SECRET_KEY", "minioadmin"),
+			Bucket:    getEnv("MINIO_BUCKET", "mails"),
+			UseSSL:    getEnv("MINIO_USE_SSL", "false") == "true",
+		},
 		Worker: WorkerConfig{
-			Concurrency: getEnvInt("WORKER_CONCURRENCY", 10),
-			BatchSize:   getEnvInt("WORKER_BATCH_SIZE", 100),
+			Concurrency:  getEnvInt("WORKER_CONCURRENCY", 10),
+			BatchSize:    getEnvInt("WORKER_BATCH_SIZE", 100),
+			PollInterval: getEnvInt("WORKER_POLL_INTERVAL", 15),
+
+			LeaseDuration:     getEnvInt("WORKER_LEASE_DURATION", 60),
+			HeartbeatInterval: getEnvInt("WORKER_HEARTBEAT_INTERVAL", 20),
+			ReaperInterval:    getEnvInt("WORKER_REAPER_INTERVAL", 30),
+			ShutdownTimeout:   getEnvInt("WORKER_SHUTDOWN_TIMEOUT", 25),
+
+			MaxAttempts:    getEnvInt("WORKER_MAX_ATTEMPTS", 5),
+			RetryBaseDelay: getEnvInt("WORKER_RETRY_BASE_DELAY", 10),
+			RetryMaxDelay:  getEnvInt("WORKER_RETRY_MAX_DELAY", 3600),
+
+			ConcurrencyByType: getEnvIntMap("WORKER_CONCURRENCY_BY_TYPE"),
+			TimeoutByType:     getEnvIntMap("WORKER_TIMEOUT_BY_TYPE"),
+			MaxAttemptsByType: getEnvIntMap("WORKER_MAX_ATTEMPTS_BY_TYPE"),
+		},
+		TempMail: TempMailConfig{
+			CleanupInterval:  getEnvInt("TEMP_MAIL_CLEANUP_INTERVAL", 300),
+			CleanupBatchSize: getEnvInt("TEMP_MAIL_CLEANUP_BATCH_SIZE", 100),
+		},
+		Outbound: OutboundConfig{
+			Hostname:         getEnv("OUTBOUND_HOSTNAME", getEnv("SMTP_DOMAIN", "mymail.com")),
+			Port:             getEnvInt("OUTBOUND_PORT", 25),
+			RequireTLS:       getEnv("OUTBOUND_REQUIRE_TLS", "false") == "true",
+			ConnectTimeout:   getEnvInt("OUTBOUND_CONNECT_TIMEOUT", 30),
+			CommandTimeout:   getEnvInt("OUTBOUND_COMMAND_TIMEOUT", 300),
+			RetrySchedule:    getEnvDurations("OUTBOUND_RETRY_SCHEDULE", "5m,15m,30m,1h,2h,4h,8h"),
+			MaxQueueLifetime: getEnvInt("OUTBOUND_MAX_QUEUE_LIFETIME", 432000),
+			PollInterval:     getEnvInt("OUTBOUND_POLL_INTERVAL", 5),
+			Concurrency:      getEnvInt("OUTBOUND_CONCURRENCY", 10),
+		},
+		Queue: QueueConfig{
+			Backend: getEnv("QUEUE_BACKEND", "postgres"),
+		},
+		Quota: QuotaConfig{
+			RecalcInterval:  getEnvInt("QUOTA_RECALC_INTERVAL", 86400),
+			RecalcBatchSize: getEnvInt("QUOTA_RECALC_BATCH_SIZE", 500),
 		},
 	}
 }
@@ -54,3 +170,38 @@ func getEnvInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+// getEnvDurations parses a comma-separated list of durations such as
+// "5m,1h". Invalid entries are skipped; if none are valid the default is used.
+func getEnvDurations(key, defaultValue string) []time.Duration {
+	parse := func(value string) []time.Duration {
+		var durations []time.Duration
+		for _, part := range strings.Split(value, ",") {
+			if d, err := time.ParseDuration(strings.TrimSpace(part)); err == nil && d > 0 {
+				durations = append(durations, d)
+			}
+		}
+		return durations
+	}
+
+	if durations := parse(os.Getenv(key)); len(durations) > 0 {
+		return durations
+	}
+	return parse(defaultValue)
+}
+
+// getEnvIntMap parses a comma-separated list of name=number pairs such as
+// "send_email=10,cleanup_temp=1". Invalid entries are skipped.
+func getEnvIntMap(key string) map[string]int {
+	values := make(map[string]int)
+	for _, part := range strings.Split(os.Getenv(key), ",") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && n > 0 {
+			values[strings.TrimSpace(name)] = n
+		}
+	}
+	return values
+}
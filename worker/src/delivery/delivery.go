@@ -0,0 +1,330 @@
+package delivery
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Resolver is the subset of *net.Resolver used to find a domain's mail
+// exchangers. It exists so delivery can run against in-process DNS.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// Dialer opens connections to remote MTAs. *net.Dialer satisfies it; tests
+// can supply one that connects to local fake servers instead.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+var (
+	_ Resolver = net.DefaultResolver
+	_ Dialer   = (*net.Dialer)(nil)
+)
+
+// Status is the outcome of a delivery attempt for one recipient.
+type Status string
+
+const (
+	Delivered Status = "delivered"
+	Deferred  Status = "deferred"
+	Failed    Status = "failed"
+)
+
+// RecipientResult is the outcome for one recipient. Code and EnhancedCode
+// are the remote server's reply, or ones we chose for local failures.
+type RecipientResult struct {
+	Recipient    string
+	Status       Status
+	Code         int
+	EnhancedCode string
+	Message      string
+}
+
+// Diagnostic renders the reply in the form used for Diagnostic-Code.
+func (r RecipientResult) Diagnostic() string {
+	if r.EnhancedCode == "" {
+		return fmt.Sprintf("%d %s", r.Code, r.Message)
+	}
+	return fmt.Sprintf("%d %s %s", r.Code, r.EnhancedCode, r.Message)
+}
+
+// Result is the outcome of delivering a message to one domain. RemoteMTA is
+// the host that gave the final answer, if any was reached. DomainDeferred is
+// set when no exchanger would take the message at all (unreachable hosts,
+// DNS failures, 421 replies), so the whole domain should be backed off
+// rather than just this message.
+type Result struct {
+	Recipients     []RecipientResult
+	RemoteMTA      string
+	DomainDeferred bool
+}
+
+// Options configure a Client. Hostname is sent in EHLO. With RequireTLS set,
+// exchangers must offer STARTTLS with a certificate valid for their name;
+// otherwise TLS is used opportunistically without verification, as RFC 7435
+// describes.
+type Options struct {
+	Hostname       string
+	Port           int
+	RequireTLS     bool
+	CommandTimeout time.Duration
+}
+
+// Client delivers messages to remote domains over SMTP.
+type Client struct {
+	resolver Resolver
+	dialer   Dialer
+	opts     Options
+}
+
+func New(resolver Resolver, dialer Dialer, opts Options) *Client {
+	if opts.Port == 0 {
+		opts.Port = 25
+	}
+	if opts.CommandTimeout == 0 {
+		opts.CommandTimeout = 5 * time.Minute
+	}
+	return &Client{resolver: resolver, dialer: dialer, opts: opts}
+}
+
+// connError is a failure to get a usable session with one exchanger. The
+// next exchanger is tried; if none work the domain is deferred.
+type connError struct {
+	host string
+	err  error
+}
+
+func (e *connError) Error() string {
+	return fmt.Sprintf("%s: %v", e.host, e.err)
+}
+
+func (e *connError) Unwrap() error {
+	return e.err
+}
+
+// errStartTLS marks a connError from a failed TLS handshake, after which the
+// exchanger may still take the message in plaintext.
+var errStartTLS = errors.New("STARTTLS failed")
+
+// Deliver sends a message from sender to recipients, all at domain. open is
+// called once per attempt to read the message from the start, since a
+// failure part way through DATA moves on to the next exchanger.
+func (c *Client) Deliver(ctx context.Context, domain, sender string, recipients []string,
+	open func() (io.Reader, error)) *Result {
+	hosts, result := c.exchangers(ctx, domain, recipients)
+	if result != nil {
+		return result
+	}
+
+	var lastErr error
+	for _, host := range hosts {
+		result, err := c.attempt(ctx, host, sender, recipients, open, true)
+		if errors.Is(err, errStartTLS) && !c.opts.RequireTLS && ctx.Err() == nil {
+			// Opportunistic TLS: a broken handshake mustn't stop delivery
+			result, err = c.attempt(ctx, host, sender, recipients, open, false)
+		}
+		if err == nil {
+			return result
+		}
+
+		// Local problems aren't the domain's fault
+		var connErr *connError
+		if !errors.As(err, &connErr) {
+			return &Result{Recipients: allRecipients(recipients, Deferred, 451, "4.3.0", err.Error())}
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return &Result{
+		Recipients:     allRecipients(recipients, Deferred, 451, "4.4.1", lastErr.Error()),
+		DomainDeferred: true,
+	}
+}
+
+// exchangers returns the hosts to try for domain in preference order
+// (RFC 5321 section 5.1). If delivery can't proceed it returns a Result
+// instead.
+func (c *Client) exchangers(ctx context.Context, domain string, recipients []string) ([]string, *Result) {
+	mxs, err := c.resolver.LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			// No MX records: the domain itself is the implicit exchanger
+			return []string{domain}, nil
+		}
+		return nil, &Result{
+			Recipients:     allRecipients(recipients, Deferred, 451, "4.4.3", "MX lookup failed: "+err.Error()),
+			DomainDeferred: true,
+		}
+	}
+
+	// A null MX means the domain accepts no mail (RFC 7505)
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, &Result{
+			Recipients: allRecipients(recipients, Failed, 556, "5.1.10", "domain does not accept mail"),
+		}
+	}
+	if len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, nil
+}
+
+// attempt runs one SMTP transaction with host, using STARTTLS if tryTLS is
+// set and the server offers it. It returns a *connError if the session
+// failed before the server answered MAIL, so the caller can try another
+// exchanger.
+func (c *Client) attempt(ctx context.Context, host, sender string, recipients []string,
+	open func() (io.Reader, error), tryTLS bool) (*Result, error) {
+	conn, err := c.dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(c.opts.Port)))
+	if err != nil {
+		return nil, &connError{host, err}
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	client := smtp.NewClient(conn)
+	client.CommandTimeout = c.opts.CommandTimeout
+	defer client.Close()
+
+	if err := client.Hello(c.opts.Hostname); err != nil {
+		return nil, &connError{host, err}
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); ok && tryTLS {
+		tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: !c.opts.RequireTLS}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return nil, &connError{host, fmt.Errorf("%w: %v", errStartTLS, err)}
+		}
+	} else if c.opts.RequireTLS {
+		return nil, &connError{host, errors.New("STARTTLS not offered")}
+	}
+
+	result := &Result{RemoteMTA: host}
+
+	if err := client.Mail(sender, nil); err != nil {
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code == 421 {
+			return nil, &connError{host, err}
+		}
+		r := replyResult("", err)
+		result.Recipients = allRecipients(recipients, r.Status, r.Code, r.EnhancedCode, r.Message)
+		return result, nil
+	}
+
+	var accepted []string
+	for _, rcpt := range recipients {
+		if err := client.Rcpt(rcpt, nil); err != nil {
+			result.Recipients = append(result.Recipients, replyResult(rcpt, err))
+			continue
+		}
+		accepted = append(accepted, rcpt)
+	}
+	if len(accepted) == 0 {
+		client.Quit()
+		return result, nil
+	}
+
+	r, err := open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+	err = data(client, r)
+	if err != nil {
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) {
+			// The connection broke mid-transfer; nothing was accepted
+			return nil, &connError{host, err}
+		}
+	}
+	for _, rcpt := range accepted {
+		if err != nil {
+			result.Recipients = append(result.Recipients, replyResult(rcpt, err))
+		} else {
+			result.Recipients = append(result.Recipients, RecipientResult{
+				Recipient: rcpt, Status: Delivered, Code: 250,
+			})
+		}
+	}
+
+	client.Quit()
+	return result, nil
+}
+
+func data(client *smtp.Client, r io.Reader) error {
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// replyResult classifies an error returned for a command: 4xx replies are
+// deferred and 5xx replies fail. Anything that isn't an SMTP reply is
+// treated as temporary.
+func replyResult(rcpt string, err error) RecipientResult {
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return RecipientResult{Recipient: rcpt, Status: Deferred, Code: 451, EnhancedCode: "4.4.2", Message: err.Error()}
+	}
+
+	r := RecipientResult{Recipient: rcpt, Code: smtpErr.Code, Message: smtpErr.Message}
+	if smtpErr.EnhancedCode != smtp.EnhancedCodeNotSet && smtpErr.EnhancedCode != smtp.NoEnhancedCode {
+		code := smtpErr.EnhancedCode
+		r.EnhancedCode = fmt.Sprintf("%d.%d.%d", code[0], code[1], code[2])
+	}
+	if smtpErr.Code >= 500 {
+		r.Status = Failed
+	} else {
+		r.Status = Deferred
+	}
+	return r
+}
+
+// Expire turns a recipient still deferred when its message's queue lifetime
+// runs out into a permanent failure, keeping the last reply as the reason.
+func Expire(r RecipientResult) RecipientResult {
+	r.Message = "delivery time expired, last error: " + r.Diagnostic()
+	r.Status = Failed
+	r.Code = 554
+	r.EnhancedCode = "5.4.7"
+	return r
+}
+
+func allRecipients(recipients []string, status Status, code int, enhancedCode, message string) []RecipientResult {
+	results := make([]RecipientResult, 0, len(recipients))
+	for _, rcpt := range recipients {
+		results = append(results, RecipientResult{
+			Recipient:    rcpt,
+			Status:       status,
+			Code:         code,
+			EnhancedCode: enhancedCode,
+			Message:      message,
+		})
+	}
+	return results
+}
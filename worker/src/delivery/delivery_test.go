@@ -0,0 +1,333 @@
+package delivery
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const testMessage = "From: alice@example.com\r\nTo: bob@example.net\r\nSubject: Hi\r\n\r\nHello\r\n"
+
+// fakeBackend is an exchanger that accepts every recipient except those it
+// has a reply for, and records what it is sent.
+type fakeBackend struct {
+	replies map[string]*smtp.SMTPError
+
+	mu       sync.Mutex
+	messages []received
+}
+
+type received struct {
+	recipients []string
+	body       string
+	tls        bool
+}
+
+func (b *fakeBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &fakeSession{backend: b, conn: c}, nil
+}
+
+func (b *fakeBackend) received() []received {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.messages
+}
+
+type fakeSession struct {
+	backend    *fakeBackend
+	conn       *smtp.Conn
+	recipients []string
+}
+
+func (s *fakeSession) AuthPlain(username, password string) error      { return smtp.ErrAuthUnsupported }
+func (s *fakeSession) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (s *fakeSession) Reset()                                         { s.recipients = nil }
+func (s *fakeSession) Logout() error                                  { return nil }
+
+func (s *fakeSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if reply := s.backend.replies[to]; reply != nil {
+		return reply
+	}
+	s.recipients = append(s.recipients, to)
+	return nil
+}
+
+func (s *fakeSession) Data(r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	_, isTLS := s.conn.TLSConnectionState()
+	s.backend.mu.Lock()
+	s.backend.messages = append(s.backend.messages, received{s.recipients, string(body), isTLS})
+	s.backend.mu.Unlock()
+	return nil
+}
+
+// startServer runs be on a local port, offering STARTTLS if tlsConfig is
+// set, and returns its address.
+func startServer(t *testing.T, be *fakeBackend, tlsConfig *tls.Config) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtp.NewServer(be)
+	s.Domain = "mx.example.net"
+	s.TLSConfig = tlsConfig
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+// testTLSConfig returns a server config with a self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.net"},
+		DNSNames:     []string{"mx.example.net"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// fakeDialer connects exchanger names to local addresses; other names are
+// unreachable.
+type fakeDialer map[string]string
+
+func (d fakeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if local, ok := d[host]; ok {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, local)
+	}
+	return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+}
+
+// fakeResolver serves MX records; names in fail return a temporary error and
+// other missing names don't exist.
+type fakeResolver struct {
+	mx   map[string][]*net.MX
+	fail map[string]bool
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if r.fail[name] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if mxs, ok := r.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func mx(hosts ...string) []*net.MX {
+	var mxs []*net.MX
+	for i, host := range hosts {
+		mxs = append(mxs, &net.MX{Host: host + ".", Pref: uint16(10 * (i + 1))})
+	}
+	return mxs
+}
+
+func deliver(resolver Resolver, dialer Dialer, opts Options, recipients ...string) *Result {
+	opts.Hostname = "mail.example.com"
+	opts.CommandTimeout = 5 * time.Second
+	c := New(resolver, dialer, opts)
+	return c.Deliver(context.Background(), "example.net", "alice@example.com", recipients,
+		func() (io.Reader, error) { return strings.NewReader(testMessage), nil })
+}
+
+func statuses(result *Result) map[string]string {
+	got := make(map[string]string)
+	for _, r := range result.Recipients {
+		got[r.Recipient] = string(r.Status) + " " + r.EnhancedCode
+	}
+	return got
+}
+
+func TestDeliverPerRecipient(t *testing.T) {
+	be := &fakeBackend{replies: map[string]*smtp.SMTPError{
+		"gone@example.net": {Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"},
+		"full@example.net": {Code: 452, EnhancedCode: smtp.EnhancedCode{4, 2, 2}, Message: "Mailbox full"},
+	}}
+	addr := startServer(t, be, nil)
+	resolver := &fakeResolver{mx: map[string][]*net.MX{"example.net": mx("mx.example.net")}}
+
+	result := deliver(resolver, fakeDialer{"mx.example.net": addr}, Options{},
+		"bob@example.net", "gone@example.net", "full@example.net")
+
+	want := map[string]string{
+		"bob@example.net":  "delivered ",
+		"gone@example.net": "failed 5.1.1",
+		"full@example.net": "deferred 4.2.2",
+	}
+	if got := statuses(result); !equal(got, want) {
+		t.Errorf("recipients = %v, want %v", got, want)
+	}
+	if result.RemoteMTA != "mx.example.net" || result.DomainDeferred {
+		t.Errorf("RemoteMTA = %q, DomainDeferred = %v", result.RemoteMTA, result.DomainDeferred)
+	}
+
+	msgs := be.received()
+	if len(msgs) != 1 || len(msgs[0].recipients) != 1 || msgs[0].body != testMessage {
+		t.Errorf("server received %+v", msgs)
+	}
+}
+
+func TestDeliverTriesExchangersInOrder(t *testing.T) {
+	be := &fakeBackend{}
+	addr := startServer(t, be, nil)
+	resolver := &fakeResolver{mx: map[string][]*net.MX{
+		// Listed out of order; mx1 is preferred but unreachable
+		"example.net": {{Host: "mx2.example.net.", Pref: 20}, {Host: "mx1.example.net.", Pref: 10}},
+	}}
+
+	result := deliver(resolver, fakeDialer{"mx2.example.net": addr}, Options{}, "bob@example.net")
+
+	if got := statuses(result); got["bob@example.net"] != "delivered " {
+		t.Errorf("recipients = %v", got)
+	}
+	if result.RemoteMTA != "mx2.example.net" {
+		t.Errorf("RemoteMTA = %q, want mx2.example.net", result.RemoteMTA)
+	}
+}
+
+func TestDeliverImplicitMX(t *testing.T) {
+	be := &fakeBackend{}
+	addr := startServer(t, be, nil)
+
+	result := deliver(&fakeResolver{}, fakeDialer{"example.net": addr}, Options{}, "bob@example.net")
+
+	if got := statuses(result); got["bob@example.net"] != "delivered " {
+		t.Errorf("recipients = %v", got)
+	}
+}
+
+func TestDeliverDomainFailures(t *testing.T) {
+	tests := []struct {
+		name         string
+		resolver     *fakeResolver
+		want         string
+		wantDeferred bool
+	}{
+		{
+			name:         "unreachable exchangers",
+			resolver:     &fakeResolver{mx: map[string][]*net.MX{"example.net": mx("mx1.example.net", "mx2.example.net")}},
+			want:         "deferred 4.4.1",
+			wantDeferred: true,
+		},
+		{
+			name:         "MX lookup failure",
+			resolver:     &fakeResolver{fail: map[string]bool{"example.net": true}},
+			want:         "deferred 4.4.3",
+			wantDeferred: true,
+		},
+		{
+			name:     "null MX",
+			resolver: &fakeResolver{mx: map[string][]*net.MX{"example.net": {{Host: ".", Pref: 0}}}},
+			want:     "failed 5.1.10",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := deliver(tt.resolver, fakeDialer{}, Options{}, "bob@example.net")
+			if got := statuses(result)["bob@example.net"]; got != tt.want {
+				t.Errorf("status = %q, want %q", got, tt.want)
+			}
+			if result.DomainDeferred != tt.wantDeferred {
+				t.Errorf("DomainDeferred = %v, want %v", result.DomainDeferred, tt.wantDeferred)
+			}
+		})
+	}
+}
+
+func TestDeliverStartTLS(t *testing.T) {
+	broken := testTLSConfig(t)
+	// Clients require TLS 1.2, so every handshake fails
+	broken.MaxVersion = tls.VersionTLS11
+
+	tests := []struct {
+		name       string
+		tlsConfig  *tls.Config
+		requireTLS bool
+		want       string
+		wantTLS    bool
+	}{
+		{name: "opportunistic", tlsConfig: testTLSConfig(t), want: "delivered ", wantTLS: true},
+		{name: "plaintext after failed handshake", tlsConfig: broken, want: "delivered "},
+		{name: "required but failing", tlsConfig: broken, requireTLS: true, want: "deferred 4.4.1"},
+		{name: "required but not offered", requireTLS: true, want: "deferred 4.4.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			be := &fakeBackend{}
+			addr := startServer(t, be, tt.tlsConfig)
+			resolver := &fakeResolver{mx: map[string][]*net.MX{"example.net": mx("mx.example.net")}}
+
+			result := deliver(resolver, fakeDialer{"mx.example.net": addr}, Options{RequireTLS: tt.requireTLS},
+				"bob@example.net")
+
+			if got := statuses(result)["bob@example.net"]; got != tt.want {
+				t.Fatalf("status = %q, want %q", got, tt.want)
+			}
+			if msgs := be.received(); len(msgs) == 1 && msgs[0].tls != tt.wantTLS {
+				t.Errorf("delivered over TLS = %v, want %v", msgs[0].tls, tt.wantTLS)
+			}
+		})
+	}
+}
+
+func TestExpire(t *testing.T) {
+	r := Expire(RecipientResult{
+		Recipient: "bob@example.net", Status: Deferred,
+		Code: 451, EnhancedCode: "4.4.1", Message: "connection refused",
+	})
+
+	if r.Status != Failed || r.Code != 554 || r.EnhancedCode != "5.4.7" {
+		t.Errorf("Expire() = %+v, want a 554 5.4.7 failure", r)
+	}
+	if !strings.Contains(r.Message, "451 4.4.1 connection refused") {
+		t.Errorf("Message = %q, want the last reply kept", r.Message)
+	}
+}
+
+func equal(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
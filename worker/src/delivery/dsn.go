@@ -0,0 +1,112 @@
+package delivery
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Bounce describes a delivery status notification for recipients that
+// could not be reached.
+type Bounce struct {
+	ReportingMTA   string
+	Sender         string
+	ArrivalDate    time.Time
+	RemoteMTA      string
+	Recipients     []RecipientResult
+	OriginalHeader []byte
+}
+
+// DSN is a rendered delivery status notification.
+type DSN struct {
+	MessageID string
+	From      string
+	Subject   string
+	Text      string
+	Message   []byte
+}
+
+// BuildDSN renders an RFC 3464 multipart/report for b: a human readable
+// explanation, the machine readable delivery-status part, and the header of
+// the original message.
+func BuildDSN(b Bounce) *DSN {
+	now := time.Now()
+	from := "MAILER-DAEMON@" + b.ReportingMTA
+	messageID := fmt.Sprintf("<%s@%s>", randomToken(), b.ReportingMTA)
+	boundary := "dsn-" + randomToken()
+	subject := "Undelivered Mail Returned to Sender"
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "This is the mail system at host %s.\r\n\r\n", b.ReportingMTA)
+	text.WriteString("Your message could not be delivered to one or more recipients.\r\n")
+	text.WriteString("The errors reported are listed below.\r\n\r\n")
+	for _, r := range b.Recipients {
+		fmt.Fprintf(&text, "<%s>: %s\r\n", r.Recipient, r.Diagnostic())
+	}
+
+	var status strings.Builder
+	fmt.Fprintf(&status, "Reporting-MTA: dns; %s\r\n", b.ReportingMTA)
+	fmt.Fprintf(&status, "Arrival-Date: %s\r\n", b.ArrivalDate.Format(time.RFC1123Z))
+	for _, r := range b.Recipients {
+		status.WriteString("\r\n")
+		fmt.Fprintf(&status, "Final-Recipient: rfc822; %s\r\n", r.Recipient)
+		status.WriteString("Action: failed\r\n")
+		fmt.Fprintf(&status, "Status: %s\r\n", statusCode(r))
+		if b.RemoteMTA != "" {
+			fmt.Fprintf(&status, "Remote-MTA: dns; %s\r\n", b.RemoteMTA)
+		}
+		fmt.Fprintf(&status, "Diagnostic-Code: smtp; %s\r\n", r.Diagnostic())
+		fmt.Fprintf(&status, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: Mail Delivery System <%s>\r\n", from)
+	fmt.Fprintf(&msg, "To: <%s>\r\n", b.Sender)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: %s\r\n", messageID)
+	msg.WriteString("Auto-Submitted: auto-replied\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n", boundary)
+	msg.WriteString("\r\n")
+
+	fmt.Fprintf(&msg, "--%s\r\n", boundary)
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(text.String())
+	fmt.Fprintf(&msg, "\r\n--%s\r\n", boundary)
+	msg.WriteString("Content-Type: message/delivery-status\r\n\r\n")
+	msg.WriteString(status.String())
+	fmt.Fprintf(&msg, "\r\n--%s\r\n", boundary)
+	msg.WriteString("Content-Type: text/rfc822-headers\r\n\r\n")
+	msg.Write(b.OriginalHeader)
+	fmt.Fprintf(&msg, "\r\n--%s--\r\n", boundary)
+
+	return &DSN{
+		MessageID: messageID,
+		From:      from,
+		Subject:   subject,
+		Text:      text.String(),
+		Message:   msg.Bytes(),
+	}
+}
+
+// statusCode returns the RFC 3463 status for a failed recipient, derived
+// from the reply code when the server gave no enhanced code.
+func statusCode(r RecipientResult) string {
+	if r.EnhancedCode != "" {
+		return r.EnhancedCode
+	}
+	if r.Code >= 400 && r.Code < 500 {
+		return "4.0.0"
+	}
+	return "5.0.0"
+}
+
+func randomToken() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,84 @@
+package parser
+
+import (
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+)
+
+var wordDecoder = mime.WordDecoder{CharsetReader: charset.Reader}
+
+// HeaderValue is one occurrence of a header field.
+type HeaderValue struct {
+	// Value has RFC 2047 encoded-words decoded
+	Value string
+	// Raw is the field as received, unfolded, if decoding changed it
+	Raw string
+}
+
+// Fields returns every top-level header field by lowercased name. Fields
+// that occur more than once, like Received, keep the order they appear in.
+func (m *Message) Fields() map[string][]HeaderValue {
+	fields := make(map[string][]HeaderValue)
+	for f := m.Header.Fields(); f.Next(); {
+		raw := clean([]byte(f.Value()))
+		v := HeaderValue{Value: raw}
+		if decoded, err := wordDecoder.DecodeHeader(raw); err == nil && decoded != raw {
+			v = HeaderValue{Value: clean([]byte(decoded)), Raw: raw}
+		}
+		name := strings.ToLower(f.Key())
+		fields[name] = append(fields[name], v)
+	}
+	return fields
+}
+
+// Text returns the first field named key, decoded, or "".
+func (m *Message) Text(key string) string {
+	v := m.Header.Get(key)
+	if decoded, err := wordDecoder.DecodeHeader(v); err == nil {
+		v = decoded
+	}
+	return clean([]byte(v))
+}
+
+// Addresses returns the bare addresses in an address list field. A list
+// that doesn't parse yields nil.
+func (m *Message) Addresses(key string) []string {
+	h := mail.Header{Header: m.Header}
+	list, err := h.AddressList(key)
+	if err != nil {
+		return nil
+	}
+	addresses := make([]string, 0, len(list))
+	for _, addr := range list {
+		addresses = append(addresses, addr.Address)
+	}
+	return addresses
+}
+
+// MessageIDs returns the message identifiers in a field such as References,
+// in angle brackets as in the emails.message_id column. Anything after an
+// identifier that doesn't parse is dropped.
+func (m *Message) MessageIDs(key string) []string {
+	h := mail.Header{Header: m.Header}
+	ids, _ := h.MsgIDList(key)
+	for i, id := range ids {
+		ids[i] = "<" + id + ">"
+	}
+	return ids
+}
+
+// Date returns when the message says it was written, in UTC like the other
+// timestamps stored, or nil if its Date field is missing or malformed.
+func (m *Message) Date() *time.Time {
+	h := mail.Header{Header: m.Header}
+	date, err := h.Date()
+	if err != nil {
+		return nil
+	}
+	date = date.UTC()
+	return &date
+}
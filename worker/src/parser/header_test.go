@@ -0,0 +1,139 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const headerMessage = `Received: from mx.example.net by mail.example.com; Sat, 17 Oct 2026 10:00:02 +0000
+Received: from relay.example.org by mx.example.net; Sat, 17 Oct 2026 10:00:01 +0000
+Received: from laptop by relay.example.org; Sat, 17 Oct 2026 10:00:00 +0000
+From: =?utf-8?q?Ren=C3=A9e?= <renee@example.org>
+To: bob@example.net
+Cc: "Carol" <carol@example.net>, dave@example.net
+Reply-To: list@example.org
+Subject: =?iso-8859-1?q?R=E9union?= du
+ =?utf-8?b?bHVuZGk=?=
+Date: Sat, 17 Oct 2026 12:00:00 +0200
+Message-ID: <m3@example.org>
+In-Reply-To: <m2@example.org>
+References: <m1@example.org>
+ <m2@example.org>
+List-Id: =?utf-8?q?Caf=C3=A9?= club <cafe.example.org>
+List-Unsubscribe: <https://example.org/unsubscribe>, <mailto:leave@example.org>
+List-Unsubscribe-Post: List-Unsubscribe=One-Click
+X-Unknown: =?x-made-up?q?abc?=
+
+Hello
+`
+
+func parseHeader(t *testing.T, raw string) *Message {
+	t.Helper()
+	msg, err := Parse(strings.NewReader(crlf(raw)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestFieldsDecodesAndKeepsRaw(t *testing.T) {
+	fields := parseHeader(t, headerMessage).Fields()
+
+	tests := []struct {
+		name string
+		want HeaderValue
+	}{
+		{"from", HeaderValue{Value: "Renée <renee@example.org>", Raw: "=?utf-8?q?Ren=C3=A9e?= <renee@example.org>"}},
+		// Adjacent encoded-words join without the space between them
+		{"subject", HeaderValue{
+			Value: "Réunion du lundi",
+			Raw:   "=?iso-8859-1?q?R=E9union?= du =?utf-8?b?bHVuZGk=?=",
+		}},
+		// Nothing to decode, so there is no Raw
+		{"to", HeaderValue{Value: "bob@example.net"}},
+		// An encoded-word in an unknown charset is left as it is
+		{"x-unknown", HeaderValue{Value: "=?x-made-up?q?abc?="}},
+	}
+	for _, tt := range tests {
+		if got := fields[tt.name]; len(got) != 1 || got[0] != tt.want {
+			t.Errorf("Fields()[%q] = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFieldsKeepsOrder(t *testing.T) {
+	fields := parseHeader(t, headerMessage).Fields()
+
+	// Newest first, as each hop prepends its own
+	var hops []string
+	for _, v := range fields["received"] {
+		from, _, _ := strings.Cut(strings.TrimPrefix(v.Value, "from "), " ")
+		hops = append(hops, from)
+	}
+	if want := []string{"mx.example.net", "relay.example.org", "laptop"}; !reflect.DeepEqual(hops, want) {
+		t.Errorf("Received hops = %v, want %v", hops, want)
+	}
+}
+
+// The accessors processEmail fills the emails columns from.
+func TestPromotedColumns(t *testing.T) {
+	msg := parseHeader(t, headerMessage)
+
+	if got, want := msg.Text("Subject"), "Réunion du lundi"; got != want {
+		t.Errorf("Text(Subject) = %q, want %q", got, want)
+	}
+	if got, want := msg.Text("List-Id"), "Café club <cafe.example.org>"; got != want {
+		t.Errorf("Text(List-Id) = %q, want %q", got, want)
+	}
+	if got, want := msg.Text("List-Unsubscribe-Post"), "List-Unsubscribe=One-Click"; got != want {
+		t.Errorf("Text(List-Unsubscribe-Post) = %q, want %q", got, want)
+	}
+	if got := msg.Text("List-Archive"); got != "" {
+		t.Errorf("Text(List-Archive) = %q for a missing field", got)
+	}
+
+	if got, want := msg.Addresses("Cc"), []string{"carol@example.net", "dave@example.net"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Addresses(Cc) = %v, want %v", got, want)
+	}
+	if got, want := msg.Addresses("Reply-To"), []string{"list@example.org"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Addresses(Reply-To) = %v, want %v", got, want)
+	}
+	if got := msg.Addresses("Bcc"); len(got) != 0 {
+		t.Errorf("Addresses(Bcc) = %v for a missing field", got)
+	}
+
+	if got, want := msg.MessageIDs("In-Reply-To"), []string{"<m2@example.org>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MessageIDs(In-Reply-To) = %v, want %v", got, want)
+	}
+	if got, want := msg.MessageIDs("References"), []string{"<m1@example.org>", "<m2@example.org>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MessageIDs(References) = %v, want %v", got, want)
+	}
+
+	date := msg.Date()
+	if want := time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC); date == nil || !date.Equal(want) || date.Location() != time.UTC {
+		t.Errorf("Date() = %v, want %v", date, want)
+	}
+}
+
+func TestMalformedHeaderColumns(t *testing.T) {
+	msg := parseHeader(t, `From: alice@example.com
+Cc: not an address list
+Date: sometime last week
+References: <m1@example.org> garbage <m2@example.org>
+
+Hello
+`)
+
+	if got := msg.Addresses("Cc"); got != nil {
+		t.Errorf("Addresses(Cc) = %v, want nil", got)
+	}
+	if got := msg.Date(); got != nil {
+		t.Errorf("Date() = %v, want nil", got)
+	}
+	// Identifiers before the one that doesn't parse are kept
+	if got, want := msg.MessageIDs("References"), []string{"<m1@example.org>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MessageIDs(References) = %v, want %v", got, want)
+	}
+}
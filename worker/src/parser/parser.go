@@ -0,0 +1,245 @@
+// Package parser reads stored messages for the worker. Messages are
+// streamed rather than loaded whole, so their size only costs time.
+package parser
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+)
+
+// MaxBodySize caps each body kept for display and search. Anything past it
+// is still in the stored message.
+const MaxBodySize = 1 << 20
+
+// maxDepth bounds multipart nesting, which no real message comes near.
+const maxDepth = 20
+
+// Message is what the worker keeps of a parsed message.
+type Message struct {
+	Header message.Header
+
+	// TextBody and HTMLBody are the first inline text/plain and text/html
+	// parts, decoded to UTF-8
+	TextBody string
+	HTMLBody string
+
+	// Attachments are the remaining leaf parts, in message order
+	Attachments []Attachment
+}
+
+// Attachment describes a part that is saved rather than shown.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	// ContentID is how an HTML body refers to an inline part, without the
+	// angle brackets
+	ContentID string
+	Inline    bool
+
+	// Size and SHA256 are of the decoded content
+	Size   int64
+	SHA256 string
+	// Path is where SaveFunc stored the content
+	Path string
+}
+
+// SaveFunc stores the decoded content of an attachment, returning where it
+// was stored. a has everything but Size, SHA256 and Path filled in.
+type SaveFunc func(a *Attachment, content io.Reader) (string, error)
+
+// Parse walks the whole MIME tree of the message read from r, undoing
+// transfer encodings and converting charsets. Parts in an unknown encoding
+// or charset are kept as they are. Each attachment is passed to save as it
+// is reached; a nil save skips them.
+//
+// If the message is malformed, Parse returns what it extracted before the
+// fault along with the error; reading further won't help. It returns a nil
+// Message only when reading r or saving an attachment failed, which may be
+// worth retrying.
+func Parse(r io.Reader, save SaveFunc) (*Message, error) {
+	src := &source{r: r}
+	p := &parser{save: save}
+	err := p.parse(src)
+	if src.err != nil {
+		return nil, src.err
+	}
+	if p.saveErr != nil {
+		return nil, p.saveErr
+	}
+	return &p.msg, err
+}
+
+type parser struct {
+	msg     Message
+	save    SaveFunc
+	saveErr error
+}
+
+func (p *parser) parse(r io.Reader) error {
+	e, err := message.Read(r)
+	if err != nil && !tolerable(err) {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	p.msg.Header = e.Header
+	return p.walk(e, 0)
+}
+
+// walk visits e and its descendants in order.
+func (p *parser) walk(e *message.Entity, depth int) error {
+	if mr := e.MultipartReader(); mr != nil {
+		if depth >= maxDepth {
+			return errors.New("multipart nested too deeply")
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil && !tolerable(err) {
+				return fmt.Errorf("reading part: %w", err)
+			}
+			if err := p.walk(part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	mediaType, _, err := e.Header.ContentType()
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+	mediaType = strings.ToLower(mediaType)
+
+	if !isAttachment(e.Header) {
+		var dst *string
+		switch mediaType {
+		case "text/plain":
+			dst = &p.msg.TextBody
+		case "text/html":
+			dst = &p.msg.HTMLBody
+		}
+		if dst != nil {
+			// Only the first of each is the body; later inline text is
+			// typically a list footer or a signature, and not an attachment
+			if *dst != "" {
+				return nil
+			}
+			body, err := io.ReadAll(io.LimitReader(e.Body, MaxBodySize))
+			*dst = clean(body)
+			if err != nil {
+				return fmt.Errorf("decoding %s part: %w", mediaType, err)
+			}
+			return nil
+		}
+	}
+
+	if p.save == nil {
+		return nil
+	}
+	return p.attach(e, mediaType)
+}
+
+// attach saves a part as an attachment.
+func (p *parser) attach(e *message.Entity, mediaType string) error {
+	a := Attachment{
+		ContentType: mediaType,
+		ContentID:   strings.Trim(e.Header.Get("Content-Id"), " <>"),
+	}
+	disposition, params, _ := e.Header.ContentDisposition()
+	a.Inline = strings.EqualFold(disposition, "inline")
+	a.Filename = params["filename"]
+	if a.Filename == "" {
+		_, params, _ = e.Header.ContentType()
+		a.Filename = params["name"]
+	}
+	if a.Filename == "" {
+		a.Filename = fmt.Sprintf("attachment-%d", len(p.msg.Attachments)+1)
+	}
+
+	body := &content{r: e.Body, hash: sha256.New()}
+	path, err := p.save(&a, body)
+	if err == nil {
+		// Hash whatever save left unread
+		_, err = io.Copy(io.Discard, body)
+	}
+	if body.err != nil {
+		return fmt.Errorf("decoding attachment %q: %w", a.Filename, body.err)
+	}
+	if err != nil {
+		p.saveErr = fmt.Errorf("saving attachment %q: %w", a.Filename, err)
+		return p.saveErr
+	}
+
+	a.Size = body.n
+	a.SHA256 = hex.EncodeToString(body.hash.Sum(nil))
+	a.Path = path
+	p.msg.Attachments = append(p.msg.Attachments, a)
+	return nil
+}
+
+// isAttachment reports whether a part is meant to be saved rather than
+// shown. Named parts count even when marked inline, since clients list
+// them as attachments.
+func isAttachment(h message.Header) bool {
+	disposition, params, _ := h.ContentDisposition()
+	if strings.EqualFold(disposition, "attachment") || params["filename"] != "" {
+		return true
+	}
+	_, params, _ = h.ContentType()
+	return params["name"] != ""
+}
+
+// tolerable reports whether err only means a part couldn't be decoded, in
+// which case go-message hands back the raw part.
+func tolerable(err error) bool {
+	return message.IsUnknownCharset(err) || message.IsUnknownEncoding(err)
+}
+
+// clean makes a body safe to store in a text column: Postgres rejects NUL
+// bytes and invalid UTF-8, and truncation may have split a character.
+func clean(body []byte) string {
+	s := strings.ToValidUTF8(string(body), "�")
+	return strings.ReplaceAll(s, "\x00", "")
+}
+
+// source records the first error reading the underlying message, which
+// Parse treats differently from the message itself being malformed.
+type source struct {
+	r   io.Reader
+	err error
+}
+
+func (s *source) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF && s.err == nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// content hashes and counts an attachment as SaveFunc reads it, and records
+// decoding errors so they aren't mistaken for the save failing.
+type content struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+	err  error
+}
+
+func (c *content) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	c.n += int64(n)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,315 @@
+package parser
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// crlf turns the \n line endings used for readability into CRLF.
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+const nestedMessage = `From: alice@example.com
+To: bob@example.net
+Subject: Report
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+Caf=C3=A9 at noon?=20
+See the report.
+--inner
+Content-Type: text/html; charset=utf-8
+Content-Transfer-Encoding: base64
+
+PHA+Q2Fmw6kgYXQgbm9vbj88L3A+
+--inner--
+--outer
+Content-Type: text/plain; charset=utf-8
+Content-Disposition: inline
+
+--
+Sent from the list
+--outer
+Content-Type: application/pdf; name="report.pdf"
+Content-Disposition: attachment; filename="report.pdf"
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQK
+--outer--
+`
+
+func TestParseNestedMultipart(t *testing.T) {
+	var saved []string
+	save := func(a *Attachment, content io.Reader) (string, error) {
+		saved = append(saved, a.Filename)
+		return "attachments/" + a.Filename, nil
+	}
+
+	msg, err := Parse(strings.NewReader(crlf(nestedMessage)), save)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The alternative's parts are the bodies, decoded from quoted-printable
+	// and base64; the later inline text/plain is neither body nor attachment
+	if want := "Café at noon? \r\nSee the report."; msg.TextBody != want {
+		t.Errorf("TextBody = %q, want %q", msg.TextBody, want)
+	}
+	if want := "<p>Café at noon?</p>"; msg.HTMLBody != want {
+		t.Errorf("HTMLBody = %q, want %q", msg.HTMLBody, want)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Filename != "report.pdf" ||
+		msg.Attachments[0].ContentType != "application/pdf" {
+		t.Errorf("Attachments = %+v, want report.pdf", msg.Attachments)
+	}
+	if len(saved) != 1 {
+		t.Errorf("saved %v, want report.pdf only", saved)
+	}
+	if got := msg.Header.Get("Subject"); got != "Report" {
+		t.Errorf("Subject = %q", got)
+	}
+}
+
+func TestParseCharsets(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		body   string
+		want   string
+	}{
+		{
+			name:   "latin-1",
+			header: "Content-Type: text/plain; charset=iso-8859-1\nContent-Transfer-Encoding: quoted-printable",
+			body:   "Caf=E9 cr=E8me",
+			want:   "Café crème",
+		},
+		{
+			name:   "windows-1252",
+			header: "Content-Type: text/plain; charset=windows-1252",
+			body:   "\x93quoted\x94 \x80",
+			want:   "“quoted” €",
+		},
+		{
+			name:   "shift_jis",
+			header: "Content-Type: text/plain; charset=shift_jis\nContent-Transfer-Encoding: base64",
+			body:   "grGC8YLJgr+CzQ==",
+			want:   "こんにちは",
+		},
+		{
+			// Kept as it is, with invalid UTF-8 replaced so it can be stored
+			name:   "unknown charset",
+			header: "Content-Type: text/plain; charset=x-made-up",
+			body:   "caf\xe9",
+			want:   "caf�",
+		},
+		{
+			name:   "unknown transfer encoding",
+			header: "Content-Type: text/plain\nContent-Transfer-Encoding: x-uuencode",
+			body:   "plain enough",
+			want:   "plain enough",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := crlf("From: alice@example.com\nMIME-Version: 1.0\n" + tt.header + "\n\n" + tt.body)
+			msg, err := Parse(strings.NewReader(raw), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.TextBody != tt.want {
+				t.Errorf("TextBody = %q, want %q", msg.TextBody, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		wantText string
+	}{
+		{
+			name:     "truncated multipart",
+			raw:      nestedMessage[:strings.Index(nestedMessage, "--inner\nContent-Type: text/html")],
+			wantText: "Café at noon? \r\nSee the report.",
+		},
+		{
+			name: "bad base64",
+			raw: "From: alice@example.com\nContent-Type: text/plain\nContent-Transfer-Encoding: base64\n\n" +
+				"SGVsbG8=!!!not base64",
+			wantText: "Hello",
+		},
+		{
+			name: "multipart without a boundary",
+			raw:  "From: alice@example.com\nContent-Type: multipart/mixed\n\nbody\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := Parse(strings.NewReader(crlf(tt.raw)), nil)
+			if err == nil {
+				t.Error("Parse() succeeded on a malformed message")
+			}
+			// What came before the fault is kept
+			if msg == nil {
+				t.Fatal("Parse() returned a nil Message for a malformed one")
+			}
+			if msg.TextBody != tt.wantText {
+				t.Errorf("TextBody = %q, want %q", msg.TextBody, tt.wantText)
+			}
+			if got := msg.Header.Get("From"); got != "alice@example.com" {
+				t.Errorf("From = %q", got)
+			}
+		})
+	}
+}
+
+// A failure reading the stored message is worth retrying, unlike the
+// message itself being malformed.
+func TestParseReadError(t *testing.T) {
+	raw := crlf(nestedMessage)
+	r := io.MultiReader(strings.NewReader(raw[:len(raw)/2]), iotest.ErrReader(errors.New("connection reset")))
+
+	msg, err := Parse(r, nil)
+	if msg != nil {
+		t.Errorf("Parse() = %+v, want a nil Message", msg)
+	}
+	if err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Errorf("Parse() error = %v, want the read error", err)
+	}
+}
+
+const attachmentMessage = `From: alice@example.com
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="b"
+
+--b
+Content-Type: text/plain
+
+See attached.
+--b
+Content-Type: image/png
+Content-Disposition: inline
+Content-ID: <logo@example.com>
+Content-Transfer-Encoding: base64
+
+iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg==
+--b
+Content-Type: text/csv; name="totals.csv"
+Content-Transfer-Encoding: quoted-printable
+
+month,total
+october,caf=C3=A9
+--b
+Content-Type: application/octet-stream
+Content-Disposition: attachment
+
+` + "\x00\x01\x02" + `
+--b--
+`
+
+func TestParseAttachments(t *testing.T) {
+	contents := make(map[string]string)
+	save := func(a *Attachment, content io.Reader) (string, error) {
+		path := fmt.Sprintf("attachments/%d", len(contents)+1)
+		if a.ContentType == "text/csv" {
+			// Leave most of it unread; it must be hashed all the same
+			buf := make([]byte, 5)
+			n, _ := io.ReadFull(content, buf)
+			contents[path] = string(buf[:n])
+			return path, nil
+		}
+		data, err := io.ReadAll(content)
+		contents[path] = string(data)
+		return path, err
+	}
+
+	msg, err := Parse(strings.NewReader(crlf(attachmentMessage)), save)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	png, _ := base64.StdEncoding.DecodeString("iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg==")
+	want := []struct {
+		Attachment
+		content string
+	}{
+		{Attachment{Filename: "attachment-1", ContentType: "image/png", ContentID: "logo@example.com", Inline: true, Path: "attachments/1"}, string(png)},
+		{Attachment{Filename: "totals.csv", ContentType: "text/csv", Path: "attachments/2"}, "month,total\r\noctober,café"},
+		{Attachment{Filename: "attachment-3", ContentType: "application/octet-stream", Path: "attachments/3"}, "\x00\x01\x02"},
+	}
+	if len(msg.Attachments) != len(want) {
+		t.Fatalf("Attachments = %+v, want %d", msg.Attachments, len(want))
+	}
+	for i, w := range want {
+		sum := sha256.Sum256([]byte(w.content))
+		w.Size = int64(len(w.content))
+		w.SHA256 = hex.EncodeToString(sum[:])
+		if got := msg.Attachments[i]; got != w.Attachment {
+			t.Errorf("Attachments[%d] = %+v, want %+v", i, got, w.Attachment)
+		}
+	}
+	if got := contents["attachments/1"]; got != string(png) {
+		t.Errorf("saved %q for the image", got)
+	}
+}
+
+func TestParseSaveError(t *testing.T) {
+	errFull := errors.New("bucket full")
+	saves := 0
+	save := func(a *Attachment, content io.Reader) (string, error) {
+		saves++
+		if saves == 2 {
+			return "", errFull
+		}
+		io.Copy(io.Discard, content)
+		return fmt.Sprintf("attachments/%d", saves), nil
+	}
+
+	// A failed save may succeed on a retry, so nothing is returned to file
+	msg, err := Parse(strings.NewReader(crlf(attachmentMessage)), save)
+	if msg != nil {
+		t.Errorf("Parse() = %+v, want a nil Message", msg)
+	}
+	if !errors.Is(err, errFull) {
+		t.Errorf("Parse() error = %v, want the save error", err)
+	}
+	if saves != 2 {
+		t.Errorf("save called %d times, want parsing to stop at the failure", saves)
+	}
+}
+
+// An attachment that doesn't decode is the message's fault, not the save's.
+func TestParseAttachmentDecodeError(t *testing.T) {
+	raw := strings.Replace(attachmentMessage, "iVBORw0KGgo", "iVBORw0K!!!", 1)
+	save := func(a *Attachment, content io.Reader) (string, error) {
+		_, err := io.Copy(io.Discard, content)
+		return "attachments/x", err
+	}
+
+	msg, err := Parse(strings.NewReader(crlf(raw)), save)
+	if err == nil {
+		t.Error("Parse() succeeded with an undecodable attachment")
+	}
+	if msg == nil || msg.TextBody != "See attached." {
+		t.Errorf("Parse() = %+v, want what came before the fault", msg)
+	}
+}
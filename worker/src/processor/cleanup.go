@@ -0,0 +1,68 @@
+package processor
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mymail/shared/jobs"
+	"github.com/mymail/shared/queue"
+)
+
+// scheduleCleanup periodically queues a cleanup_temp job. Every replica runs
+// this; EnqueueUnique keeps at most one of them pending at a time.
+func (p *Processor) scheduleCleanup(ctx context.Context) {
+	interval := time.Duration(p.config.TempMail.CleanupInterval) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.queue.EnqueueUnique(ctx, jobs.TypeCleanupTemp); err != nil {
+				log.Printf("Error scheduling temp mailbox cleanup: %v", err)
+			}
+		}
+	}
+}
+
+// cleanupTempMailboxes deletes temp mailboxes whose TTL has passed, together
+// with their emails, metadata and MinIO objects, attachments included.
+func (p *Processor) cleanupTempMailboxes(ctx context.Context, job *queue.Job) error {
+	mailboxes, err := p.db.GetExpiredTempMailboxes(p.config.TempMail.CleanupBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, mailbox := range mailboxes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Objects go first: if the row delete fails the retry finds the same
+		// paths again, and removing a missing object is a no-op
+		paths, err := p.db.GetExclusiveObjectPaths(mailbox.ID)
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if err := p.minio.Delete(ctx, path); err != nil {
+				return err
+			}
+		}
+
+		if err := p.db.DeleteTempMailbox(mailbox.ID); err != nil {
+			return err
+		}
+
+		log.Printf("Expired temp mailbox %s (%d objects removed)", mailbox.Address, len(paths))
+	}
+
+	return nil
+}
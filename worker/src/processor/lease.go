@@ -0,0 +1,71 @@
+package processor
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+func (p *Processor) leaseDuration() time.Duration {
+	if p.config.Worker.LeaseDuration <= 0 {
+		return time.Minute
+	}
+	return time.Duration(p.config.Worker.LeaseDuration) * time.Second
+}
+
+// heartbeat keeps the leases on this worker's running jobs alive. If the
+// process dies the heartbeats stop and the reaper hands the jobs to another
+// worker once the lease runs out.
+func (p *Processor) heartbeat(ctx context.Context) {
+	interval := time.Duration(p.config.Worker.HeartbeatInterval) * time.Second
+	if interval <= 0 || interval >= p.leaseDuration() {
+		log.Printf("Heartbeat interval must be shorter than the lease; using a third of the lease")
+		interval = p.leaseDuration() / 3
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			jobs := p.runningJobs()
+			if len(jobs) == 0 {
+				continue
+			}
+			if err := p.queue.Extend(ctx, p.id, jobs, p.leaseDuration()); err != nil {
+				log.Printf("Error extending job leases: %v", err)
+			}
+		}
+	}
+}
+
+// reapExpiredLeases periodically returns jobs whose lease expired to the
+// queue. Every replica runs this; the queue makes it safe to race.
+func (p *Processor) reapExpiredLeases(ctx context.Context) {
+	interval := time.Duration(p.config.Worker.ReaperInterval) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reaped, err := p.queue.Reap(ctx, p.leaseDuration(), p.config.Worker.MaxAttempts, p.maxAttempts)
+			if err != nil {
+				log.Printf("Error reaping expired job leases: %v", err)
+				continue
+			}
+			if reaped > 0 {
+				log.Printf("Returned %d jobs with expired leases to the queue", reaped)
+			}
+		}
+	}
+}
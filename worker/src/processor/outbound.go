@@ -0,0 +1,304 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mymail/shared/jobs"
+	"github.com/mymail/shared/queue"
+	"github.com/mymail/worker/src/delivery"
+	"github.com/mymail/worker/src/storage"
+)
+
+// outboundLease is how long a claimed delivery is hidden from other workers.
+// It must outlast a slow transfer; if a worker dies the row is retried after.
+const outboundLease = 30 * time.Minute
+
+// queueOutbound handles a send_email job by splitting the recipients by
+// domain into outbound_queue rows, which runOutbound then delivers.
+func (p *Processor) queueOutbound(ctx context.Context, job *queue.Job) error {
+	var payload jobs.SendEmail
+	if err := jobs.Decode(job, &payload); err != nil {
+		return err
+	}
+
+	byDomain := make(map[string][]string)
+	for _, rcpt := range payload.Recipients {
+		at := strings.LastIndex(rcpt, "@")
+		if at < 0 {
+			continue
+		}
+		domain := strings.ToLower(rcpt[at+1:])
+		byDomain[domain] = append(byDomain[domain], rcpt)
+	}
+	if len(byDomain) == 0 {
+		return p.minio.Delete(ctx, payload.MinIOPath)
+	}
+
+	lifetime := time.Duration(p.config.Outbound.MaxQueueLifetime) * time.Second
+	return p.db.QueueOutbound(payload.EmailID, payload.UserID, payload.MailboxID, payload.From,
+		payload.MinIOPath, byDomain, lifetime)
+}
+
+// runOutbound polls outbound_queue for due deliveries and runs up to
+// Outbound.Concurrency of them at a time, claiming more as each one finishes
+// so a slow exchanger only holds up its own slot. Deliveries run under
+// jobCtx, so at shutdown it stops polling but waits for those in flight.
+func (p *Processor) runOutbound(ctx context.Context) {
+	interval := time.Duration(p.config.Outbound.PollInterval) * time.Second
+	if interval <= 0 {
+		return
+	}
+	concurrency := max(p.config.Outbound.Concurrency, 1)
+	slots := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Only this loop takes slots, so none of these sends block
+		free := concurrency - len(slots)
+		if free == 0 {
+			continue
+		}
+		messages, err := p.db.ClaimOutbound(free, outboundLease)
+		if err != nil {
+			log.Printf("Error claiming outbound mail: %v", err)
+			continue
+		}
+
+		for _, msg := range messages {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(msg storage.OutboundMessage) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				if err := p.deliverOutbound(p.jobCtx, msg); err != nil {
+					log.Printf("Error delivering %s to %s: %v", msg.EmailID, msg.Domain, err)
+				}
+			}(msg)
+		}
+	}
+}
+
+// deliverOutbound makes one delivery attempt for a queued message. Rejected
+// recipients bounce straight away; deferred ones are retried on the
+// configured schedule until the message expires, and then bounce too.
+func (p *Processor) deliverOutbound(ctx context.Context, msg storage.OutboundMessage) error {
+	var recipients []string
+	if err := json.Unmarshal([]byte(msg.Recipients), &recipients); err != nil {
+		return err
+	}
+
+	var opened []io.Reader
+	result := p.outbound.Deliver(ctx, msg.Domain, msg.Sender, recipients, func() (io.Reader, error) {
+		r, err := p.minio.Get(ctx, msg.MinIOPath)
+		if err == nil {
+			opened = append(opened, r)
+		}
+		return r, err
+	})
+	for _, r := range opened {
+		closeReader(r)
+	}
+	if ctx.Err() != nil {
+		// Abandoned at shutdown; hand the message straight to another
+		// worker rather than leave it until the lease runs out
+		if err := p.db.ReleaseOutbound(msg.ID); err != nil {
+			log.Printf("Error releasing outbound message %s: %v", msg.ID, err)
+		}
+		return ctx.Err()
+	}
+
+	var delivered int
+	var deferred []string
+	var failed []delivery.RecipientResult
+	var lastError string
+	for _, r := range result.Recipients {
+		switch r.Status {
+		case delivery.Delivered:
+			delivered++
+		case delivery.Deferred:
+			lastError = r.Diagnostic()
+			if msg.Expired {
+				failed = append(failed, delivery.Expire(r))
+			} else {
+				deferred = append(deferred, r.Recipient)
+			}
+		case delivery.Failed:
+			lastError = r.Diagnostic()
+			failed = append(failed, r)
+		}
+	}
+
+	if delivered > 0 {
+		if err := p.db.ClearDomainBackoff(msg.Domain); err != nil {
+			return err
+		}
+	}
+
+	// Bounce while the row is still queued: once it isn't, the last of the
+	// message's other deliveries to finish deletes the original the bounce
+	// quotes. If the bounce can't be filed, the failed recipients are tried
+	// again, and bounced again, with the deferred ones.
+	if len(failed) > 0 {
+		if err := p.bounce(ctx, msg, result.RemoteMTA, failed); err != nil {
+			retry := deferred
+			for _, r := range failed {
+				retry = append(retry, r.Recipient)
+			}
+			delay := retryDelay(p.config.Outbound.RetrySchedule, msg.Attempts)
+			if err := p.db.RescheduleOutbound(msg.ID, retry, delay, lastError); err != nil {
+				return err
+			}
+			return fmt.Errorf("failed to bounce: %w", err)
+		}
+	}
+
+	if len(deferred) > 0 {
+		var delay time.Duration
+		if result.DomainDeferred {
+			// The whole domain waits; the row becomes claimable with it
+			if err := p.db.DeferDomain(msg.Domain, p.config.Outbound.RetrySchedule, lastError); err != nil {
+				return err
+			}
+		} else {
+			delay = retryDelay(p.config.Outbound.RetrySchedule, msg.Attempts)
+		}
+		if err := p.db.RescheduleOutbound(msg.ID, deferred, delay, lastError); err != nil {
+			return err
+		}
+	} else {
+		status := "sent"
+		if delivered == 0 {
+			status = "failed"
+		}
+		if err := p.db.FinishOutbound(msg.ID, status, lastError); err != nil {
+			return err
+		}
+	}
+
+	if len(deferred) == 0 {
+		remaining, err := p.db.CountQueuedOutbound(msg.EmailID)
+		if err != nil {
+			return err
+		}
+		if remaining == 0 {
+			return p.minio.Delete(ctx, msg.MinIOPath)
+		}
+	}
+
+	return nil
+}
+
+// retryDelay returns the wait after the given number of earlier attempts,
+// repeating the last entry of the schedule once it runs out.
+func retryDelay(schedule []time.Duration, attempts int) time.Duration {
+	if len(schedule) == 0 {
+		return time.Hour
+	}
+	return schedule[min(attempts, len(schedule)-1)]
+}
+
+// bounce files an RFC 3464 delivery status notification in the sender's
+// mailbox for recipients that could not be delivered to. Since the sender is
+// always local, the report is stored directly instead of being sent back
+// over SMTP.
+func (p *Processor) bounce(ctx context.Context, msg storage.OutboundMessage, remoteMTA string,
+	failed []delivery.RecipientResult) error {
+	if msg.Sender == "" || msg.MailboxID == nil {
+		return nil
+	}
+
+	header, err := p.originalHeader(ctx, msg.MinIOPath)
+	if err != nil {
+		return err
+	}
+
+	dsn := delivery.BuildDSN(delivery.Bounce{
+		ReportingMTA:   p.config.Outbound.Hostname,
+		Sender:         msg.Sender,
+		ArrivalDate:    msg.CreatedAt,
+		RemoteMTA:      remoteMTA,
+		Recipients:     failed,
+		OriginalHeader: header,
+	})
+
+	emailID := uuid.New().String()
+	path := fmt.Sprintf("%s/%s/%s.eml", msg.UserID, time.Now().Format("2006/01/02"), emailID)
+	if err := p.minio.Upload(ctx, path, bytes.NewReader(dsn.Message), int64(len(dsn.Message))); err != nil {
+		return err
+	}
+
+	email := &storage.Email{
+		ID:         emailID,
+		MailboxID:  *msg.MailboxID,
+		MessageID:  dsn.MessageID,
+		From:       dsn.From,
+		To:         []string{msg.Sender},
+		Subject:    dsn.Subject,
+		TextBody:   dsn.Text,
+		MinIOPath:  path,
+		Size:       int64(len(dsn.Message)),
+		ReceivedAt: time.Now(),
+		Folder:     "inbox",
+	}
+	if err := p.db.StoreEmail(ctx, email, &storage.EmailMetadata{EmailID: emailID}, nil); err != nil {
+		p.minio.Delete(ctx, path)
+		return err
+	}
+
+	p.redis.Publish(ctx, "email:received", map[string]interface{}{
+		"email_id":   emailID,
+		"mailbox_id": *msg.MailboxID,
+	})
+
+	return nil
+}
+
+// originalHeader reads the header block of a queued message for the
+// text/rfc822-headers part of a bounce.
+func (p *Processor) originalHeader(ctx context.Context, path string) ([]byte, error) {
+	r, err := p.minio.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeReader(r)
+
+	buf := make([]byte, 64*1024)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	buf = buf[:n]
+
+	if end := bytes.Index(buf, []byte("\r\n\r\n")); end >= 0 {
+		buf = buf[:end+2]
+	}
+	return buf, nil
+}
+
+// closeReader releases an object returned by MinIO.Get, which holds its
+// connection until read to the end or closed.
+func closeReader(r io.Reader) {
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+}
@@ -2,148 +2,493 @@ package processor
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/mymail/shared/jobs"
+	"github.com/mymail/shared/queue"
 	"github.com/mymail/worker/src/config"
+	"github.com/mymail/worker/src/delivery"
+	"github.com/mymail/worker/src/parser"
 	"github.com/mymail/worker/src/storage"
 )
 
 type Processor struct {
-	db     *storage.Postgres
-	redis  *storage.Redis
-	config *config.Config
+	db       *storage.Postgres
+	redis    *storage.Redis
+	minio    *storage.MinIO
+	queue    queue.Queue
+	outbound *delivery.Client
+	config   *config.Config
+
+	// id identifies this worker as the consumer holding its job leases
+	id string
+
+	// slots bounds the number of jobs running at once to
+	// Worker.Concurrency; freed signals when one opens up, and running
+	// tracks them for shutdown.
+	slots   chan struct{}
+	freed   chan struct{}
+	running sync.WaitGroup
+
+	// Jobs run under jobCtx rather than Start's context, so that shutdown
+	// can stop claiming and still let them finish; stopJobs cancels them.
+	// stopped is closed once Start has stopped claiming.
+	jobCtx   context.Context
+	stopJobs context.CancelFunc
+	stopped  chan struct{}
+
+	// claimed holds the running jobs, whose leases heartbeat extends
+	mu      sync.Mutex
+	claimed map[string]*queue.Job
+
+	// handlers run each job type, in types order; maxAttempts is what the
+	// reaper needs of their retry policies
+	handlers    map[string]*handler
+	types       []string
+	maxAttempts map[string]int
+}
+
+func New(db *storage.Postgres, redis *storage.Redis, minio *storage.MinIO, q queue.Queue,
+	outbound *delivery.Client, cfg *config.Config) *Processor {
+	p := &Processor{
+		db:          db,
+		redis:       redis,
+		minio:       minio,
+		queue:       q,
+		outbound:    outbound,
+		config:      cfg,
+		id:          workerID(),
+		slots:       make(chan struct{}, max(cfg.Worker.Concurrency, 1)),
+		freed:       make(chan struct{}, 1),
+		stopped:     make(chan struct{}),
+		claimed:     make(map[string]*queue.Job),
+		handlers:    make(map[string]*handler),
+		maxAttempts: make(map[string]int),
+	}
+	p.jobCtx, p.stopJobs = context.WithCancel(context.Background())
+
+	p.Register(jobs.TypeProcessEmail, HandlerFunc(p.processEmail), HandlerOptions{Timeout: 5 * time.Minute})
+	p.Register(jobs.TypeSendEmail, HandlerFunc(p.queueOutbound), HandlerOptions{Timeout: time.Minute})
+	p.Register(jobs.TypeCleanupTemp, HandlerFunc(p.cleanupTempMailboxes), HandlerOptions{
+		Concurrency: 1,
+		Timeout:     10 * time.Minute,
+	})
+	p.Register(jobs.TypeRecalculateUsage, HandlerFunc(p.recalculateUsage), HandlerOptions{
+		Concurrency: 1,
+		Timeout:     30 * time.Minute,
+	})
+	return p
 }
 
-func New(db *storage.Postgres, redis *storage.Redis, cfg *config.Config) *Processor {
-	return &Processor{
-		db:     db,
-		redis:  redis,
-		config: cfg,
+// workerID names this process uniquely across replicas and restarts.
+func workerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "worker"
 	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), uuid.New().String()[:8])
 }
 
+// Start claims and runs jobs until ctx is done; Shutdown then waits for
+// the jobs still running.
 func (p *Processor) Start(ctx context.Context) {
-	ticker := time.NewTicker(1 * time.Second)
+	defer close(p.stopped)
+
+	var outbound sync.WaitGroup
+	outbound.Add(1)
+	go func() {
+		defer outbound.Done()
+		p.runOutbound(ctx)
+	}()
+	defer outbound.Wait()
+
+	go p.scheduleCleanup(ctx)
+	go p.scheduleUsageRecalculation(ctx)
+	go p.heartbeat(p.jobCtx)
+	go p.reapExpiredLeases(ctx)
+
+	// New jobs are announced by the queue; polling only catches what that
+	// misses, such as retries coming due
+	wake, err := p.queue.Wake(ctx)
+	if err != nil {
+		log.Printf("Error listening for new jobs, falling back to polling: %v", err)
+	}
+
+	interval := time.Duration(p.config.Worker.PollInterval) * time.Second
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	backlog := p.drain(ctx)
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-wake:
+			backlog = p.drain(ctx)
 		case <-ticker.C:
-			p.processBatch(ctx)
+			backlog = p.drain(ctx)
+		case <-p.freed:
+			// Pick up where a full pool left off
+			if backlog {
+				backlog = p.drain(ctx)
+			}
+		}
+	}
+}
+
+// Shutdown waits for Start to return and for running jobs and deliveries to
+// finish, for up to timeout. Whatever is still running then is cancelled
+// and released to other workers without counting the attempt. It reports
+// whether everything finished in time.
+func (p *Processor) Shutdown(timeout time.Duration) bool {
+	defer p.stopJobs()
+
+	done := make(chan struct{})
+	go func() {
+		<-p.stopped
+		p.running.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+	}
+
+	log.Printf("Shutdown deadline passed after %s; releasing unfinished jobs", timeout)
+	p.stopJobs()
+	<-done
+	return false
+}
+
+// drain claims jobs until a batch comes back short, meaning the queue is
+// empty for now. It reports whether work may remain because the pool, or
+// every handler, filled up first.
+func (p *Processor) drain(ctx context.Context) bool {
+	for ctx.Err() == nil {
+		if !p.processBatch(ctx) {
+			return false
+		}
+		if types, _ := p.claimable(); len(p.slots) == cap(p.slots) || len(types) == 0 {
+			return true
 		}
 	}
+	return false
 }
 
-func (p *Processor) processBatch(ctx context.Context) {
-	jobs, err := p.db.GetPendingJobs(p.config.Worker.BatchSize)
+// processBatch claims as many jobs as there are free slots, up to
+// Worker.BatchSize, and runs each in its own goroutine. Jobs are only
+// claimed when a slot is ready for them, so none sit in processing while
+// waiting behind others. It reports whether the batch was full, or nothing
+// could be claimed for lack of room, in which case more jobs may be waiting.
+func (p *Processor) processBatch(ctx context.Context) bool {
+	types, room := p.claimable()
+	free := cap(p.slots) - len(p.slots)
+	if free == 0 || len(types) == 0 {
+		return true
+	}
+
+	limit := min(free, room, p.config.Worker.BatchSize)
+	batch, err := p.queue.Claim(ctx, p.id, limit, p.leaseDuration(), types)
 	if err != nil {
 		log.Printf("Error fetching jobs: %v", err)
-		return
+		return false
 	}
 
-	if len(jobs) == 0 {
-		return
+	if len(batch) == 0 {
+		return false
 	}
 
-	log.Printf("Processing %d jobs", len(jobs))
+	log.Printf("Processing %d jobs", len(batch))
 
-	for _, job := range jobs {
-		if err := p.processJob(ctx, job); err != nil {
-			log.Printf("Error processing job %s: %v", job.ID, err)
-			p.db.IncrementJobAttempts(job.ID)
-			if job.Attempts >= 3 {
-				p.db.UpdateJobStatus(job.ID, "failed")
+	for _, job := range batch {
+		// A claim can take more of a type than its handler has room for
+		// when several types are capped, and shutdown may have begun since
+		// the claim; either way the job goes straight back
+		h := p.handlers[job.Type]
+		if ctx.Err() != nil || !h.acquire() {
+			if err := p.queue.Release(context.WithoutCancel(ctx), job, 0); err != nil {
+				log.Printf("Error releasing job %s: %v", job.ID, err)
 			}
-		} else {
-			p.db.UpdateJobStatus(job.ID, "completed")
+			continue
 		}
+
+		p.slots <- struct{}{}
+		p.running.Add(1)
+		p.track(job, true)
+		go func(job *queue.Job) {
+			defer p.running.Done()
+			defer p.release(h)
+			defer p.track(job, false)
+			p.runJob(p.jobCtx, h, job)
+		}(job)
 	}
+	return len(batch) == limit
 }
 
-func (p *Processor) processJob(ctx context.Context, job storage.QueueJob) error {
-	switch job.Type {
-	case "process_email":
-		return p.processEmail(ctx, job)
+// track adds a job to or removes it from the running set.
+func (p *Processor) track(job *queue.Job, running bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if running {
+		p.claimed[job.ID] = job
+	} else {
+		delete(p.claimed, job.ID)
+	}
+}
+
+// runningJobs returns a snapshot of the running set.
+func (p *Processor) runningJobs() []*queue.Job {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	jobs := make([]*queue.Job, 0, len(p.claimed))
+	for _, job := range p.claimed {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// release frees a job's pool and handler slots and tells Start, without
+// blocking, that there is room for more work.
+func (p *Processor) release(h *handler) {
+	h.release()
+	<-p.slots
+	select {
+	case p.freed <- struct{}{}:
 	default:
-		log.Printf("Unknown job type: %s", job.Type)
-		return nil
 	}
 }
 
-func (p *Processor) processEmail(ctx context.Context, job storage.QueueJob) error {
-	var payload map[string]interface{}
-	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+// runJob runs a job's handler and records the outcome. Failures are
+// retried with the handler's backoff until its attempts are used up, after
+// which the job is marked dead with its last error for the dlq command to
+// inspect. A job cancelled by Shutdown is released instead, since the
+// failure was not its own.
+func (p *Processor) runJob(ctx context.Context, h *handler, job *queue.Job) {
+	err := h.run(ctx, job)
+	cancelled := ctx.Err() != nil
+
+	// The outcome is recorded even though shutdown may have cancelled ctx
+	ctx = context.WithoutCancel(ctx)
+	if err == nil {
+		if err := p.queue.Ack(ctx, job); err != nil {
+			log.Printf("Error completing job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	if cancelled {
+		log.Printf("Releasing job %s (%s) unfinished at shutdown: %v", job.ID, job.Type, err)
+		if err := p.queue.Release(ctx, job, 0); err != nil {
+			log.Printf("Error releasing job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	attempts := job.Attempts + 1
+	var versionErr *jobs.VersionError
+	if errors.As(err, &versionErr) || attempts >= h.opts.MaxAttempts {
+		log.Printf("Job %s (%s) is dead after %d attempts: %v", job.ID, job.Type, attempts, err)
+		if err := p.queue.Bury(ctx, job, err.Error()); err != nil {
+			log.Printf("Error burying job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	delay := h.retryDelay(attempts)
+	log.Printf("Error processing job %s (attempt %d, retrying in %s): %v", job.ID, attempts, delay, err)
+	if err := p.queue.Nack(ctx, job, delay, err.Error()); err != nil {
+		log.Printf("Error rescheduling job %s: %v", job.ID, err)
+	}
+}
+
+func (p *Processor) processEmail(ctx context.Context, job *queue.Job) error {
+	var payload jobs.ProcessEmail
+	if err := jobs.Decode(job, &payload); err != nil {
 		return err
 	}
 
-	// Extract payload data
-	emailID, _ := payload["email_id"].(string)
+	emailID := payload.EmailID
 	if emailID == "" {
 		emailID = uuid.New().String()
 	}
+	folder := payload.Folder
+	if folder == "" {
+		folder = "inbox"
+	}
+
+	parsed, err := p.parseMessage(ctx, payload.MinIOPath)
+	if err != nil {
+		return err
+	}
 
-	mailboxID, _ := payload["mailbox_id"].(string)
-	messageID, _ := payload["message_id"].(string)
-	from, _ := payload["from"].(string)
-	subject, _ := payload["subject"].(string)
-	textBody, _ := payload["text_body"].(string)
-	htmlBody, _ := payload["html_body"].(string)
-	minioPath, _ := payload["minio_path"].(string)
-	size, _ := payload["size"].(float64)
-
-	to, _ := payload["to"].([]interface{})
-	toAddresses := make([]string, 0, len(to))
-	for _, addr := range to {
-		if str, ok := addr.(string); ok {
-			toAddresses = append(toAddresses, str)
+	attachments := make([]storage.Attachment, 0, len(parsed.Attachments))
+	for _, a := range parsed.Attachments {
+		attachments = append(attachments, storage.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        a.Size,
+			MinIOPath:   a.Path,
+			SHA256:      a.SHA256,
+			ContentID:   a.ContentID,
+			Inline:      a.Inline,
+		})
+	}
+
+	headers := make(map[string][]storage.HeaderValue)
+	for name, values := range parsed.Fields() {
+		for _, v := range values {
+			headers[name] = append(headers[name], storage.HeaderValue{Value: v.Value, Raw: v.Raw})
 		}
 	}
 
+	// The payload's subject is as received, and only needed if the stored
+	// header turned out unreadable
+	subject := parsed.Text("Subject")
+	if subject == "" {
+		subject = payload.Subject
+	}
+	// Bcc is normally only known to the sender's own copy
+	bcc := payload.Bcc
+	if len(bcc) == 0 {
+		bcc = parsed.Addresses("Bcc")
+	}
+	var inReplyTo string
+	if ids := parsed.MessageIDs("In-Reply-To"); len(ids) > 0 {
+		inReplyTo = ids[0]
+	}
+
 	// Create email record
 	email := &storage.Email{
 		ID:         emailID,
-		MailboxID:  mailboxID,
-		MessageID:  messageID,
-		From:       from,
-		To:         toAddresses,
+		MailboxID:  payload.MailboxID,
+		MessageID:  payload.MessageID,
+		From:       payload.From,
+		To:         payload.To,
+		CC:         parsed.Addresses("Cc"),
+		BCC:        bcc,
 		Subject:    subject,
-		TextBody:   textBody,
-		HTMLBody:   htmlBody,
-		MinIOPath:  minioPath,
-		Size:       int64(size),
+		TextBody:   parsed.TextBody,
+		HTMLBody:   parsed.HTMLBody,
+		MinIOPath:  payload.MinIOPath,
+		Size:       payload.Size,
+		SPFResult:  payload.SPFResult,
+		SPFDomain:  payload.SPFDomain,
 		ReceivedAt: time.Now(),
-	}
 
-	if err := p.db.CreateEmail(email); err != nil {
-		return err
-	}
+		DMARCResult:      payload.DMARCResult,
+		DMARCDisposition: payload.DMARCDisposition,
+		Folder:           folder,
 
-	// Create metadata
-	headers := make(map[string]interface{})
-	if h, ok := payload["headers"].(map[string]interface{}); ok {
-		headers = h
+		ReceivedSize:   payload.ReceivedSize,
+		ReceivedSHA256: payload.ReceivedSHA256,
+
+		ReplyTo:             parsed.Addresses("Reply-To"),
+		InReplyTo:           inReplyTo,
+		References:          parsed.MessageIDs("References"),
+		SentAt:              parsed.Date(),
+		ListID:              parsed.Text("List-Id"),
+		ListHelp:            parsed.Text("List-Help"),
+		ListUnsubscribe:     parsed.Text("List-Unsubscribe"),
+		ListUnsubscribePost: parsed.Text("List-Unsubscribe-Post"),
+		ListSubscribe:       parsed.Text("List-Subscribe"),
+		ListPost:            parsed.Text("List-Post"),
+		ListOwner:           parsed.Text("List-Owner"),
+		ListArchive:         parsed.Text("List-Archive"),
 	}
 
 	metadata := &storage.EmailMetadata{
 		EmailID:     emailID,
 		Headers:     headers,
-		Attachments: []interface{}{},
+		Attachments: attachments,
+		DKIMResults: payload.DKIM,
 	}
 
-	if err := p.db.CreateEmailMetadata(metadata); err != nil {
+	// With the queue in Postgres the job completes in the same transaction,
+	// so a crash can't leave the email stored but the job to run again
+	var done func(tx *sqlx.Tx) error
+	if acker, ok := p.queue.(queue.TxAcker); ok {
+		done = func(tx *sqlx.Tx) error {
+			return acker.AckTx(ctx, tx, job)
+		}
+	}
+	if err := p.db.StoreEmail(ctx, email, metadata, done); err != nil {
 		return err
 	}
 
 	// Publish notification to Redis
 	p.redis.Publish(ctx, "email:received", map[string]interface{}{
 		"email_id":   emailID,
-		"mailbox_id": mailboxID,
+		"mailbox_id": payload.MailboxID,
 	})
 
 	return nil
 }
+
+// parseMessage streams a stored message from MinIO and parses it, saving
+// each attachment beside it. A message too malformed to parse completely is
+// still filed, with whatever could be extracted, since retrying would only
+// fail the same way.
+func (p *Processor) parseMessage(ctx context.Context, path string) (*parser.Message, error) {
+	r, err := p.minio.Get(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open message: %w", err)
+	}
+	defer closeReader(r)
+
+	// Attachments are numbered in message order, so a retry overwrites
+	// rather than duplicates them
+	prefix := strings.TrimSuffix(path, ".eml") + "/attachments/"
+	n := 0
+	save := func(a *parser.Attachment, content io.Reader) (string, error) {
+		n++
+		dst := prefix + strconv.Itoa(n)
+		return dst, p.saveAttachment(ctx, dst, a.ContentType, content)
+	}
+
+	msg, err := parser.Parse(r, save)
+	if msg == nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+	if err != nil {
+		log.Printf("Message %s is malformed, storing what could be parsed: %v", path, err)
+	}
+	return msg, nil
+}
+
+// saveAttachment uploads decoded attachment content. It is spooled to disk
+// first, because MinIO buffers uploads of unknown size a whole part at a
+// time in memory.
+func (p *Processor) saveAttachment(ctx context.Context, path, contentType string, content io.Reader) error {
+	spool, err := os.CreateTemp("", "mymail-attachment-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, content)
+	if err != nil {
+		return err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return p.minio.UploadAs(ctx, path, spool, size, contentType)
+}
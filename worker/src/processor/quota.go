@@ -0,0 +1,79 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mymail/shared/jobs"
+	"github.com/mymail/shared/queue"
+)
+
+// quotaKey is the smtp service's cached view of a user's quota and usage
+// (see smtp/src/quota). Deleting it makes the next check reload both from
+// Postgres.
+const quotaKey = "quota:%s"
+
+// scheduleUsageRecalculation periodically queues a recalculate_usage job;
+// like scheduleCleanup, every replica runs it and EnqueueUnique keeps one
+// pending.
+func (p *Processor) scheduleUsageRecalculation(ctx context.Context) {
+	interval := time.Duration(p.config.Quota.RecalcInterval) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.queue.EnqueueUnique(ctx, jobs.TypeRecalculateUsage); err != nil {
+				log.Printf("Error scheduling usage recalculation: %v", err)
+			}
+		}
+	}
+}
+
+// recalculateUsage recomputes every user's storage usage from emails.size,
+// correcting counters that have drifted, and drops the smtp service's
+// cached usage for the users it corrected.
+func (p *Processor) recalculateUsage(ctx context.Context, job *queue.Job) error {
+	batch := max(p.config.Quota.RecalcBatchSize, 1)
+	checked, corrected := 0, 0
+
+	after := ""
+	for {
+		ids, err := p.db.ListUserIDs(ctx, after, batch)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			drifted, err := p.db.RecalculateUsage(ctx, id)
+			if err != nil {
+				return err
+			}
+			checked++
+			if !drifted {
+				continue
+			}
+			corrected++
+			if err := p.redis.Del(ctx, fmt.Sprintf(quotaKey, id)); err != nil {
+				log.Printf("Error clearing cached usage of user %s: %v", id, err)
+			}
+		}
+
+		if len(ids) < batch {
+			break
+		}
+		after = ids[len(ids)-1]
+	}
+
+	log.Printf("Recalculated storage usage of %d users (%d corrected)", checked, corrected)
+	return nil
+}
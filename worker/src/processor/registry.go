@@ -0,0 +1,147 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/mymail/shared/queue"
+)
+
+// JobHandler runs jobs of one type. An error counts as a failed attempt;
+// Handle should return promptly once ctx is done.
+type JobHandler interface {
+	Handle(ctx context.Context, job *queue.Job) error
+}
+
+// HandlerFunc adapts a function to JobHandler.
+type HandlerFunc func(ctx context.Context, job *queue.Job) error
+
+func (f HandlerFunc) Handle(ctx context.Context, job *queue.Job) error {
+	return f(ctx, job)
+}
+
+// HandlerOptions tune how one job type runs. Zero values fall back to the
+// worker-wide settings.
+type HandlerOptions struct {
+	// Concurrency caps how many of the pool's slots this type may hold
+	Concurrency int
+	// Timeout bounds a single attempt
+	Timeout time.Duration
+
+	MaxAttempts    int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+}
+
+type handler struct {
+	JobHandler
+	opts HandlerOptions
+
+	// slots bounds the type's running jobs; nil if only the pool does
+	slots chan struct{}
+}
+
+// Register makes the processor claim jobs of jobType and run them with h,
+// replacing any earlier handler for the type. The WORKER_*_BY_TYPE settings
+// override opts. It must be called before Start.
+func (p *Processor) Register(jobType string, h JobHandler, opts HandlerOptions) {
+	w := p.config.Worker
+	if n, ok := w.ConcurrencyByType[jobType]; ok {
+		opts.Concurrency = n
+	}
+	if n, ok := w.TimeoutByType[jobType]; ok {
+		opts.Timeout = time.Duration(n) * time.Second
+	}
+	if n, ok := w.MaxAttemptsByType[jobType]; ok {
+		opts.MaxAttempts = n
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = w.MaxAttempts
+	}
+	if opts.RetryBaseDelay <= 0 {
+		opts.RetryBaseDelay = time.Duration(max(w.RetryBaseDelay, 1)) * time.Second
+	}
+	if opts.RetryMaxDelay <= 0 {
+		opts.RetryMaxDelay = time.Duration(max(w.RetryMaxDelay, 1)) * time.Second
+	}
+
+	reg := &handler{JobHandler: h, opts: opts}
+	if opts.Concurrency > 0 && opts.Concurrency < cap(p.slots) {
+		reg.slots = make(chan struct{}, opts.Concurrency)
+	}
+
+	if _, ok := p.handlers[jobType]; !ok {
+		p.types = append(p.types, jobType)
+	}
+	p.handlers[jobType] = reg
+	p.maxAttempts[jobType] = opts.MaxAttempts
+}
+
+// claimable returns the registered types with room for another job, and
+// how many jobs they can take between them. Types without a handler are
+// never claimed, so they stay queued for a worker that has one.
+func (p *Processor) claimable() ([]string, int) {
+	var types []string
+	room := 0
+	for _, jobType := range p.types {
+		h := p.handlers[jobType]
+		if h.slots == nil {
+			types = append(types, jobType)
+			room = cap(p.slots)
+		} else if free := cap(h.slots) - len(h.slots); free > 0 {
+			types = append(types, jobType)
+			room += free
+		}
+	}
+	return types, room
+}
+
+// run handles a job under the handler's timeout.
+func (h *handler) run(ctx context.Context, job *queue.Job) error {
+	if h.opts.Timeout <= 0 {
+		return h.Handle(ctx, job)
+	}
+
+	jobCtx, cancel := context.WithTimeout(ctx, h.opts.Timeout)
+	defer cancel()
+	err := h.Handle(jobCtx, job)
+	if err != nil && ctx.Err() == nil && jobCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s: %w", h.opts.Timeout, err)
+	}
+	return err
+}
+
+// acquire takes one of the type's slots if it has any free.
+func (h *handler) acquire() bool {
+	if h.slots == nil {
+		return true
+	}
+	select {
+	case h.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *handler) release() {
+	if h.slots != nil {
+		<-h.slots
+	}
+}
+
+// retryDelay returns the wait before the next attempt of a job that has
+// failed attempts times: RetryBaseDelay doubled per failure, capped at
+// RetryMaxDelay, then jittered down by up to half so jobs that failed
+// together don't all retry together.
+func (h *handler) retryDelay(attempts int) time.Duration {
+	ceiling := h.opts.RetryMaxDelay
+	delay := h.opts.RetryBaseDelay
+	for i := 1; i < attempts && delay < ceiling; i++ {
+		delay *= 2
+	}
+	delay = min(delay, ceiling)
+	return delay/2 + rand.N(delay/2+1)
+}
@@ -1,12 +1,14 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/mymail/shared/jobs"
 )
 
 type Postgres struct {
@@ -34,33 +36,27 @@ func (p *Postgres) GetDB() *sqlx.DB {
 	return p.db
 }
 
-func (p *Postgres) GetPendingJobs(limit int) ([]QueueJob, error) {
-	var jobs []QueueJob
-	query := `SELECT id, type, payload, status, attempts, created_at, processed_at
-	          FROM queue_jobs 
-	          WHERE status = 'pending' 
-	          ORDER BY created_at ASC 
-	          LIMIT $1`
-
-	err := p.db.Select(&jobs, query, limit)
-	return jobs, err
-}
-
-func (p *Postgres) UpdateJobStatus(id string, status string) error {
-	query := `UPDATE queue_jobs SET status = $1, processed_at = NOW() WHERE id = $2`
-	_, err := p.db.Exec(query, status, id)
-	return err
-}
-
-func (p *Postgres) IncrementJobAttempts(id string) error {
-	query := `UPDATE queue_jobs SET attempts = attempts + 1 WHERE id = $2`
-	_, err := p.db.Exec(query, id)
-	return err
-}
+// StoreEmail writes an email, its metadata and its mailbox's counters in
+// one transaction, and runs done, if given, in the same transaction so the
+// job that carried the email completes with it. It is safe to repeat: an
+// email that already exists is left as it is and not counted again, and its
+// metadata is overwritten.
+func (p *Postgres) StoreEmail(ctx context.Context, email *Email, metadata *EmailMetadata,
+	done func(tx *sqlx.Tx) error) error {
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-func (p *Postgres) CreateEmail(email *Email) error {
-	query := `INSERT INTO emails (id, mailbox_id, message_id, "from", "to", cc, bcc, subject, text_body, html_body, minio_path, size, received_at, created_at)
-	          VALUES ($1, $2, $3, $4, $5::jsonb, $6::jsonb, $7::jsonb, $8, $9, $10, $11, $12, $13, NOW())
+	query := `INSERT INTO emails (id, mailbox_id, message_id, "from", "to", cc, bcc, subject, text_body, html_body, minio_path, size,
+	                              spf_result, spf_domain, dmarc_result, dmarc_disposition, folder, received_at, created_at,
+	                              reply_to, in_reply_to, "references", sent_at, list_id, list_help, list_unsubscribe,
+	                              list_unsubscribe_post, list_subscribe, list_post, list_owner, list_archive, received_size, received_sha256)
+	          VALUES ($1, $2, $3, $4, $5::jsonb, $6::jsonb, $7::jsonb, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, NOW(),
+	                  $19::jsonb, NULLIF($20, ''), $21::jsonb, $22, NULLIF($23, ''), NULLIF($24, ''), NULLIF($25, ''),
+	                  NULLIF($26, ''), NULLIF($27, ''), NULLIF($28, ''), NULLIF($29, ''), NULLIF($30, ''), NULLIF($31, ''),
+	                  NULLIF($32, 0), NULLIF($33, ''))
 	          ON CONFLICT (id) DO NOTHING
 	          RETURNING id`
 
@@ -69,48 +65,325 @@ func (p *Postgres) CreateEmail(email *Email) error {
 	toJSON, _ := json.Marshal(email.To)
 	ccJSON, _ := json.Marshal(email.CC)
 	bccJSON, _ := json.Marshal(email.BCC)
+	replyToJSON, _ := json.Marshal(email.ReplyTo)
+	referencesJSON, _ := json.Marshal(email.References)
 
-	err := p.db.Get(&email.ID, query,
+	var id string
+	err = tx.GetContext(ctx, &id, query,
 		email.ID, email.MailboxID, email.MessageID, email.From, toJSON, ccJSON, bccJSON,
-		email.Subject, email.TextBody, email.HTMLBody, email.MinIOPath, email.Size, email.ReceivedAt)
+		email.Subject, email.TextBody, email.HTMLBody, email.MinIOPath, email.Size,
+		email.SPFResult, email.SPFDomain, email.DMARCResult, email.DMARCDisposition, email.Folder, email.ReceivedAt,
+		replyToJSON, email.InReplyTo, referencesJSON, email.SentAt, email.ListID, email.ListHelp, email.ListUnsubscribe,
+		email.ListUnsubscribePost, email.ListSubscribe, email.ListPost, email.ListOwner, email.ListArchive,
+		email.ReceivedSize, email.ReceivedSHA256)
+	switch {
+	case err == sql.ErrNoRows:
+		// Stored by an earlier attempt, and counted then
+	case err != nil:
+		return err
+	default:
+		// Mailbox before user, the order every writer of these counters
+		// locks them in
+		var userID string
+		err = tx.GetContext(ctx, &userID, `UPDATE mailboxes SET email_count = email_count + 1, size_bytes = size_bytes + $2
+		                                   WHERE id = $1 RETURNING user_id`, email.MailboxID, email.Size)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE users SET used_bytes = used_bytes + $2 WHERE id = $1`, userID, email.Size)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Ensure we always have valid JSON (empty object {} for nil map, empty array [] for nil slice)
+	if metadata.Headers == nil {
+		metadata.Headers = make(map[string][]HeaderValue)
+	}
+	if metadata.Attachments == nil {
+		metadata.Attachments = []Attachment{}
+	}
+	if metadata.DKIMResults == nil {
+		metadata.DKIMResults = []jobs.DKIMResult{}
+	}
+
+	headersJSON, _ := json.Marshal(metadata.Headers)
+	attachmentsJSON, _ := json.Marshal(metadata.Attachments)
+	dkimJSON, _ := json.Marshal(metadata.DKIMResults)
+
+	query = `INSERT INTO email_metadata (id, email_id, headers, attachments, dkim_results, created_at)
+	         VALUES (gen_random_uuid(), $1, $2::jsonb, $3::jsonb, $4::jsonb, NOW())
+	         ON CONFLICT (email_id) DO UPDATE
+	         SET headers = EXCLUDED.headers, attachments = EXCLUDED.attachments, dkim_results = EXCLUDED.dkim_results
+	         RETURNING id`
+	if err := tx.GetContext(ctx, &metadata.ID, query, metadata.EmailID, headersJSON, attachmentsJSON, dkimJSON); err != nil {
+		return err
+	}
+
+	if done != nil {
+		if err := done(tx); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *Postgres) GetExpiredTempMailboxes(limit int) ([]Mailbox, error) {
+	var mailboxes []Mailbox
+	query := `SELECT id, user_id, address, is_temp, expires_at
+	          FROM mailboxes
+	          WHERE is_temp = true AND expires_at <= NOW()
+	          ORDER BY expires_at ASC
+	          LIMIT $1`
 
-	// If no rows returned, email already existed (ON CONFLICT DO NOTHING)
-	// This is fine - the email was already processed
+	err := p.db.Select(&mailboxes, query, limit)
+	return mailboxes, err
+}
+
+// GetExclusiveObjectPaths returns the MinIO paths of a mailbox's emails that
+// no other mailbox references, together with their attachments. Each
+// recipient gets its own copy of a message, but copies stored before that
+// may still share one object, so only these are safe to delete.
+func (p *Postgres) GetExclusiveObjectPaths(mailboxID string) ([]string, error) {
+	var paths []string
+	query := `WITH exclusive AS (
+	            SELECT e.id, e.minio_path
+	            FROM emails e
+	            WHERE e.mailbox_id = $1
+	              AND NOT EXISTS (
+	                SELECT 1 FROM emails o
+	                WHERE o.minio_path = e.minio_path AND o.mailbox_id <> $1
+	              )
+	          )
+	          SELECT minio_path FROM exclusive
+	          UNION
+	          SELECT a ->> 'minioPath'
+	          FROM exclusive x
+	          JOIN email_metadata m ON m.email_id = x.id
+	          CROSS JOIN LATERAL jsonb_array_elements(COALESCE(m.attachments, '[]'::jsonb)) a
+	          WHERE a ->> 'minioPath' <> ''`
+
+	err := p.db.Select(&paths, query, mailboxID)
+	return paths, err
+}
+
+// DeleteTempMailbox removes a temp mailbox along with its emails and
+// metadata (via cascading foreign keys), and the placeholder user that was
+// created for it once that user owns nothing else.
+func (p *Postgres) DeleteTempMailbox(id string) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var deleted struct {
+		UserID    string `db:"user_id"`
+		SizeBytes int64  `db:"size_bytes"`
+	}
+	err = tx.Get(&deleted, `DELETE FROM mailboxes WHERE id = $1 AND is_temp = true RETURNING user_id, size_bytes`, id)
 	if err == sql.ErrNoRows {
 		return nil
 	}
+	if err != nil {
+		return err
+	}
 
-	return err
+	if _, err := tx.Exec(`UPDATE users SET used_bytes = used_bytes - $2 WHERE id = $1`, deleted.UserID, deleted.SizeBytes); err != nil {
+		return err
+	}
+
+	query := `DELETE FROM users
+	          WHERE id = $1 AND password_hash = ''
+	            AND NOT EXISTS (SELECT 1 FROM mailboxes WHERE user_id = $1)`
+	if _, err := tx.Exec(query, deleted.UserID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (p *Postgres) CreateEmailMetadata(metadata *EmailMetadata) error {
-	query := `INSERT INTO email_metadata (id, email_id, headers, attachments, created_at)
-	          VALUES (gen_random_uuid(), $1, $2::jsonb, $3::jsonb, NOW())
-	          RETURNING id`
+// ListUserIDs returns up to limit user IDs after the given one, in order,
+// for walking every user a page at a time.
+func (p *Postgres) ListUserIDs(ctx context.Context, after string, limit int) ([]string, error) {
+	var ids []string
+	err := p.db.SelectContext(ctx, &ids, `SELECT id FROM users WHERE id > $1 ORDER BY id LIMIT $2`, after, limit)
+	return ids, err
+}
 
-	// Marshal to JSON for JSONB columns
-	// Ensure we always have valid JSON (empty object {} for nil map, empty array [] for nil slice)
-	if metadata.Headers == nil {
-		metadata.Headers = make(map[string]interface{})
+// RecalculateUsage recomputes a user's mailbox counters and used_bytes from
+// the emails they hold, reporting whether used_bytes had drifted. The rows
+// are locked first, mailboxes before the user as StoreEmail does, so a
+// concurrent store is either counted here or adds to the corrected total.
+func (p *Postgres) RecalculateUsage(ctx context.Context, userID string) (bool, error) {
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
 	}
-	if metadata.Attachments == nil {
-		metadata.Attachments = []interface{}{}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT id FROM mailboxes WHERE user_id = $1 ORDER BY id FOR UPDATE`, userID); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return false, err
 	}
 
-	headersJSON, _ := json.Marshal(metadata.Headers)
-	attachmentsJSON, _ := json.Marshal(metadata.Attachments)
+	query := `UPDATE mailboxes SET email_count = counts.email_count, size_bytes = counts.size_bytes
+	          FROM (
+	            SELECT m.id, count(e.id) AS email_count, coalesce(sum(e.size), 0) AS size_bytes
+	            FROM mailboxes m LEFT JOIN emails e ON e.mailbox_id = m.id
+	            WHERE m.user_id = $1
+	            GROUP BY m.id
+	          ) AS counts
+	          WHERE mailboxes.id = counts.id
+	            AND (mailboxes.email_count <> counts.email_count OR mailboxes.size_bytes <> counts.size_bytes)`
+	if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+		return false, err
+	}
+
+	query = `UPDATE users SET used_bytes = usage.used_bytes
+	         FROM (SELECT coalesce(sum(size_bytes), 0) AS used_bytes FROM mailboxes WHERE user_id = $1) AS usage
+	         WHERE users.id = $1 AND users.used_bytes <> usage.used_bytes`
+	result, err := tx.ExecContext(ctx, query, userID)
+	if err != nil {
+		return false, err
+	}
+	drifted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return drifted > 0, tx.Commit()
+}
+
+// QueueOutbound adds one outbound_queue row per recipient domain, due
+// immediately and bouncing if still undelivered after lifetime. Rows already
+// queued for the same email and domain are left alone, so a retried
+// send_email job doesn't deliver twice.
+func (p *Postgres) QueueOutbound(emailID, userID, mailboxID, sender, minioPath string,
+	byDomain map[string][]string, lifetime time.Duration) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO outbound_queue (id, email_id, user_id, mailbox_id, sender, domain, recipients, minio_path,
+	                                      status, attempts, next_attempt_at, expires_at, created_at, updated_at)
+	          VALUES (gen_random_uuid(), $1, $2, NULLIF($3, ''), $4, $5, $6::jsonb, $7,
+	                  'queued', 0, NOW(), NOW() + make_interval(secs => $8), NOW(), NOW())
+	          ON CONFLICT (email_id, domain) DO NOTHING`
+
+	for domain, recipients := range byDomain {
+		recipientsJSON, _ := json.Marshal(recipients)
+		if _, err := tx.Exec(query, emailID, userID, mailboxID, sender, domain, recipientsJSON, minioPath,
+			lifetime.Seconds()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ClaimOutbound returns up to limit queued deliveries that are due and whose
+// domain isn't backed off. Claimed rows have next_attempt_at pushed out by
+// lease, so other workers skip them while the attempt runs and pick them up
+// again if this worker dies part way.
+func (p *Postgres) ClaimOutbound(limit int, lease time.Duration) ([]OutboundMessage, error) {
+	var messages []OutboundMessage
+	query := `UPDATE outbound_queue
+	          SET next_attempt_at = NOW() + make_interval(secs => $2), updated_at = NOW()
+	          WHERE id IN (
+	            SELECT q.id FROM outbound_queue q
+	            WHERE q.status = 'queued' AND q.next_attempt_at <= NOW()
+	              AND NOT EXISTS (
+	                SELECT 1 FROM outbound_domains d
+	                WHERE d.domain = q.domain AND d.retry_at > NOW()
+	              )
+	            ORDER BY q.next_attempt_at ASC
+	            LIMIT $1
+	            FOR UPDATE OF q SKIP LOCKED
+	          )
+	          RETURNING id, email_id, user_id, mailbox_id, sender, domain, recipients, minio_path,
+	                    status, attempts, created_at, expires_at <= NOW() AS expired`
+
+	err := p.db.Select(&messages, query, limit, lease.Seconds())
+	return messages, err
+}
+
+// ReleaseOutbound makes a claimed message due again without recording an
+// attempt.
+func (p *Postgres) ReleaseOutbound(id string) error {
+	_, err := p.db.Exec(`UPDATE outbound_queue SET next_attempt_at = NOW(), updated_at = NOW()
+	                     WHERE id = $1 AND status = 'queued'`, id)
+	return err
+}
+
+// RescheduleOutbound records a failed attempt, leaving the recipients that
+// are still to be tried queued for another attempt after delay.
+func (p *Postgres) RescheduleOutbound(id string, recipients []string, delay time.Duration, lastError string) error {
+	query := `UPDATE outbound_queue
+	          SET recipients = $2::jsonb, attempts = attempts + 1, last_error = $3,
+	              next_attempt_at = NOW() + make_interval(secs => $4), updated_at = NOW()
+	          WHERE id = $1`
 
-	return p.db.Get(&metadata.ID, query, metadata.EmailID, headersJSON, attachmentsJSON)
+	recipientsJSON, _ := json.Marshal(recipients)
+	_, err := p.db.Exec(query, id, recipientsJSON, lastError, delay.Seconds())
+	return err
+}
+
+// FinishOutbound marks a delivery as done, either "sent" or "failed".
+func (p *Postgres) FinishOutbound(id, status, lastError string) error {
+	query := `UPDATE outbound_queue
+	          SET status = $2, attempts = attempts + 1, last_error = NULLIF($3, ''), updated_at = NOW()
+	          WHERE id = $1`
+	_, err := p.db.Exec(query, id, status, lastError)
+	return err
+}
+
+// CountQueuedOutbound returns how many deliveries of an email are still
+// queued, including ones in progress.
+func (p *Postgres) CountQueuedOutbound(emailID string) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM outbound_queue WHERE email_id = $1 AND status = 'queued'`
+	err := p.db.Get(&count, query, emailID)
+	return count, err
+}
+
+// DeferDomain backs off delivery to a domain after a failure to reach it.
+// The wait is schedule[n-1] for the nth consecutive failure, repeating the
+// last entry once the schedule runs out.
+func (p *Postgres) DeferDomain(domain string, schedule []time.Duration, lastError string) error {
+	seconds := make([]float64, 0, len(schedule))
+	for _, d := range schedule {
+		seconds = append(seconds, d.Seconds())
+	}
+
+	query := `INSERT INTO outbound_domains (domain, failures, retry_at, last_error, updated_at)
+	          VALUES ($1, 1, NOW() + make_interval(secs => ($2::float8[])[1]), $3, NOW())
+	          ON CONFLICT (domain) DO UPDATE
+	          SET failures = outbound_domains.failures + 1,
+	              retry_at = NOW() + make_interval(secs => ($2::float8[])[
+	                LEAST(outbound_domains.failures + 1, cardinality($2::float8[]))]),
+	              last_error = EXCLUDED.last_error, updated_at = NOW()`
+
+	_, err := p.db.Exec(query, domain, pq.Array(seconds), lastError)
+	return err
+}
+
+// ClearDomainBackoff resets a domain's failure count once it accepts mail.
+func (p *Postgres) ClearDomainBackoff(domain string) error {
+	_, err := p.db.Exec(`DELETE FROM outbound_domains WHERE domain = $1`, domain)
+	return err
 }
 
-type QueueJob struct {
-	ID          string     `db:"id"`
-	Type        string     `db:"type"`
-	Payload     string     `db:"payload"`
-	Status      string     `db:"status"`
-	Attempts    int        `db:"attempts"`
-	CreatedAt   time.Time  `db:"created_at"`
-	ProcessedAt *time.Time `db:"processed_at"`
+type Mailbox struct {
+	ID        string     `db:"id"`
+	UserID    string     `db:"user_id"`
+	Address   string     `db:"address"`
+	IsTemp    bool       `db:"is_temp"`
+	ExpiresAt *time.Time `db:"expires_at"`
 }
 
 type Email struct {
@@ -126,13 +399,74 @@ type Email struct {
 	HTMLBody   string    `db:"html_body"`
 	MinIOPath  string    `db:"minio_path"`
 	Size       int64     `db:"size"`
+	SPFResult  string    `db:"spf_result"`
+	SPFDomain  string    `db:"spf_domain"`
 	ReceivedAt time.Time `db:"received_at"`
+
+	DMARCResult      string `db:"dmarc_result"`
+	DMARCDisposition string `db:"dmarc_disposition"`
+	Folder           string `db:"folder"`
+
+	// The message as received, before this server's trace fields; Size is
+	// that of the stored copy
+	ReceivedSize   int64  `db:"received_size"`
+	ReceivedSHA256 string `db:"received_sha256"`
+
+	// Promoted from the header; empty when absent
+	ReplyTo             []string   `db:"reply_to"`
+	InReplyTo           string     `db:"in_reply_to"`
+	References          []string   `db:"references"`
+	SentAt              *time.Time `db:"sent_at"`
+	ListID              string     `db:"list_id"`
+	ListHelp            string     `db:"list_help"`
+	ListUnsubscribe     string     `db:"list_unsubscribe"`
+	ListUnsubscribePost string     `db:"list_unsubscribe_post"`
+	ListSubscribe       string     `db:"list_subscribe"`
+	ListPost            string     `db:"list_post"`
+	ListOwner           string     `db:"list_owner"`
+	ListArchive         string     `db:"list_archive"`
 }
 
 type EmailMetadata struct {
-	ID          string                 `db:"id"`
-	EmailID     string                 `db:"email_id"`
-	Headers     map[string]interface{} `db:"headers"`
-	Attachments []interface{}          `db:"attachments"`
-	CreatedAt   time.Time              `db:"created_at"`
+	ID          string                   `db:"id"`
+	EmailID     string                   `db:"email_id"`
+	Headers     map[string][]HeaderValue `db:"headers"`
+	Attachments []Attachment             `db:"attachments"`
+	DKIMResults []jobs.DKIMResult        `db:"dkim_results"`
+	CreatedAt   time.Time                `db:"created_at"`
+}
+
+// HeaderValue is one occurrence of a field in email_metadata.headers, which
+// maps lowercased field names to their values in message order.
+type HeaderValue struct {
+	Value string `json:"value"`
+	// Raw is the field before RFC 2047 decoding, if that changed it
+	Raw string `json:"raw,omitempty"`
+}
+
+// Attachment is one entry of email_metadata.attachments. The content is
+// stored decoded at MinIOPath, so it can be served without the message.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	MinIOPath   string `json:"minioPath"`
+	SHA256      string `json:"sha256"`
+	ContentID   string `json:"contentId,omitempty"`
+	Inline      bool   `json:"inline,omitempty"`
+}
+
+type OutboundMessage struct {
+	ID         string    `db:"id"`
+	EmailID    string    `db:"email_id"`
+	UserID     string    `db:"user_id"`
+	MailboxID  *string   `db:"mailbox_id"`
+	Sender     string    `db:"sender"`
+	Domain     string    `db:"domain"`
+	Recipients string    `db:"recipients"`
+	MinIOPath  string    `db:"minio_path"`
+	Status     string    `db:"status"`
+	Attempts   int       `db:"attempts"`
+	CreatedAt  time.Time `db:"created_at"`
+	Expired    bool      `db:"expired"`
 }
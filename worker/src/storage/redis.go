@@ -37,6 +37,10 @@ func (r *Redis) GetClient() *redis.Client {
 	return r.client
 }
 
+func (r *Redis) Del(ctx context.Context, keys ...string) error {
+	return r.client.Del(ctx, keys...).Err()
+}
+
 func (r *Redis) Publish(ctx context.Context, channel string, message interface{}) error {
 	return r.client.Publish(ctx, channel, message).Err()
 }